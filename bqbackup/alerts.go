@@ -0,0 +1,218 @@
+package bqbackup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAggregateWindow = time.Minute
+	// maxAggregateWindows caps how long a dataset that keeps failing holds
+	// back its alert, in windows.
+	maxAggregateWindows = 5
+)
+
+// failureAlerts sends alerts about failed tables while a project is still
+// being backed up. A dataset's failures are batched over a sliding window:
+// its alert goes out once the window passes without another of its tables
+// failing, or maxAggregateWindows windows after the first failure, so a
+// failing dataset sends a few combined messages rather than one per table.
+// Alerts are queued and delivered one at a time. A nil *failureAlerts sends
+// nothing.
+type failureAlerts struct {
+	discordWebhook   string
+	workspaceWebhook string
+	projectID        string
+	window           time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wake   chan struct{}
+	done   chan struct{}
+
+	mu      sync.Mutex
+	pending map[string]*alertBatch
+	queue   [][]tableResult
+	// sent are the batches queued so far, for the project's summary.
+	sent   [][]tableResult
+	closed bool
+}
+
+type alertBatch struct {
+	tables []tableResult
+	first  time.Time
+	timer  *time.Timer
+}
+
+func newFailureAlerts(ctx context.Context, discordWebhook, workspaceWebhook, projectID string, window time.Duration) *failureAlerts {
+	if window <= 0 || discordWebhook == "" && workspaceWebhook == "" {
+		return nil
+	}
+	a := &failureAlerts{
+		discordWebhook:   discordWebhook,
+		workspaceWebhook: workspaceWebhook,
+		projectID:        projectID,
+		window:           window,
+		wake:             make(chan struct{}, 1),
+		done:             make(chan struct{}),
+		pending:          make(map[string]*alertBatch),
+	}
+	a.ctx, a.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	go a.deliver()
+	return a
+}
+
+// add batches a failed table into its dataset's next alert.
+func (a *failureAlerts) add(result tableResult) {
+	if a == nil || result.Status != statusFailed {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return
+	}
+	datasetID := result.DatasetID
+	batch := a.pending[datasetID]
+	if batch == nil {
+		batch = &alertBatch{first: time.Now()}
+		batch.timer = time.AfterFunc(a.window, func() { a.flush(datasetID, batch) })
+		a.pending[datasetID] = batch
+	} else {
+		// The window slides with each failure, but only so far.
+		batch.timer.Reset(min(a.window, time.Until(batch.first.Add(maxAggregateWindows*a.window))))
+	}
+	batch.tables = append(batch.tables, result)
+}
+
+func (a *failureAlerts) flush(datasetID string, batch *alertBatch) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	// The batch may have been flushed by close, or by an earlier firing of
+	// its timer.
+	if a.pending[datasetID] != batch {
+		return
+	}
+	delete(a.pending, datasetID)
+	a.enqueue(batch.tables)
+}
+
+// enqueue queues an alert for delivery. a.mu must be held.
+func (a *failureAlerts) enqueue(tables []tableResult) {
+	a.queue = append(a.queue, tables)
+	a.sent = append(a.sent, tables)
+	a.signal()
+}
+
+// signal wakes up delivery, unless it is already due to look at the queue.
+func (a *failureAlerts) signal() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (a *failureAlerts) deliver() {
+	defer close(a.done)
+	for range a.wake {
+		for {
+			a.mu.Lock()
+			if len(a.queue) == 0 {
+				closed := a.closed
+				a.mu.Unlock()
+				if closed {
+					return
+				}
+				break
+			}
+			tables := a.queue[0]
+			a.queue = a.queue[1:]
+			a.mu.Unlock()
+			a.send(tables)
+		}
+	}
+}
+
+// close sends the alerts of the failures still batched and waits until every
+// queued alert is delivered.
+func (a *failureAlerts) close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	datasetIDs := make([]string, 0, len(a.pending))
+	for datasetID := range a.pending {
+		datasetIDs = append(datasetIDs, datasetID)
+	}
+	sort.Strings(datasetIDs)
+	for _, datasetID := range datasetIDs {
+		batch := a.pending[datasetID]
+		batch.timer.Stop()
+		delete(a.pending, datasetID)
+		a.enqueue(batch.tables)
+	}
+	a.closed = true
+	a.signal()
+	a.mu.Unlock()
+	<-a.done
+	a.cancel()
+}
+
+// abandon drops the alerts not sent yet, e.g. when the run timed out and the
+// project's summary reports its failures instead.
+func (a *failureAlerts) abandon() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	for datasetID, batch := range a.pending {
+		batch.timer.Stop()
+		delete(a.pending, datasetID)
+	}
+	a.queue, a.closed = nil, true
+	a.signal()
+	a.mu.Unlock()
+	a.cancel()
+	<-a.done
+}
+
+// batches returns the failures alerted together so far.
+func (a *failureAlerts) batches() [][]tableResult {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([][]tableResult(nil), a.sent...)
+}
+
+func (a *failureAlerts) send(tables []tableResult) {
+	datasetID := tables[0].DatasetID
+	tableIDs := make([]string, len(tables))
+	for i, t := range tables {
+		tableIDs[i] = t.TableID
+	}
+	if a.workspaceWebhook != "" {
+		message := workspaceTableLine(tables[0]) + "\n"
+		if len(tables) > 1 {
+			message = workspaceGroupLine(datasetID, statusFailed, tables) + "\n"
+			message += fmt.Sprintf("Tables: `%s`\n", strings.Join(tableIDs, "`, `"))
+		}
+		message = "*Backup failures " + time.Now().Format("2006-01-02 15:04") + "*\n" + message
+		message += fmt.Sprintf("-------------| *Project : %s*\n", a.projectID)
+		sendWorkspaceMessage(a.ctx, a.workspaceWebhook, message)
+	}
+	if a.discordWebhook != "" {
+		message := discordTableLine(tables[0]) + "\n"
+		if len(tables) > 1 {
+			message = discordGroupLine(datasetID, statusFailed, tables) + "\n"
+			message += fmt.Sprintf("Tables: `%s`\n", strings.Join(tableIDs, "`, `"))
+		}
+		message += fmt.Sprintf("\nProject : %s", a.projectID)
+		sendDiscordMessage(a.ctx, a.discordWebhook, "BigQuery Backup Failures", message)
+	}
+}
@@ -0,0 +1,125 @@
+package bqbackup
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFailureAlerts(t *testing.T) {
+	const window = 200 * time.Millisecond
+	failed := func(datasetID, tableID string) tableResult {
+		return tableResult{DatasetID: datasetID, TableID: tableID, Status: statusFailed, Reason: "boom"}
+	}
+	// Each step adds its tables after waiting for its delay.
+	type step struct {
+		delay  time.Duration
+		tables []tableResult
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		want  [][]string
+	}{
+		{
+			name: "batched per dataset",
+			steps: []step{
+				{0, []tableResult{failed("sales", "orders"), failed("analytics", "events"), failed("sales", "customers"), {DatasetID: "sales", TableID: "products", Status: statusSuccess}}},
+			},
+			want: [][]string{{"analytics.events"}, {"sales.orders", "sales.customers"}},
+		},
+		{
+			name: "window slides",
+			steps: []step{
+				{0, []tableResult{failed("sales", "orders")}},
+				{window / 4, []tableResult{failed("sales", "customers")}},
+				{window / 4, []tableResult{failed("sales", "products")}},
+			},
+			want: [][]string{{"sales.orders", "sales.customers", "sales.products"}},
+		},
+		{
+			name: "window passed",
+			steps: []step{
+				{0, []tableResult{failed("sales", "orders")}},
+				{3 * window, []tableResult{failed("sales", "customers")}},
+			},
+			want: [][]string{{"sales.orders"}, {"sales.customers"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var messages []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body struct {
+					Embeds []struct{ Description string }
+				}
+				json.NewDecoder(r.Body).Decode(&body)
+				mu.Lock()
+				messages = append(messages, body.Embeds[0].Description)
+				mu.Unlock()
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer server.Close()
+
+			a := newFailureAlerts(context.Background(), server.URL, "", "p", window)
+			for _, step := range tt.steps {
+				time.Sleep(step.delay)
+				for _, r := range step.tables {
+					a.add(r)
+				}
+			}
+			a.close()
+
+			var got [][]string
+			for _, batch := range a.batches() {
+				var tables []string
+				for _, r := range batch {
+					tables = append(tables, r.DatasetID+"."+r.TableID)
+				}
+				got = append(got, tables)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("batches() = %v, want %v", got, tt.want)
+			}
+			if len(messages) != len(tt.want) {
+				t.Errorf("sent %d alerts, want %d: %q", len(messages), len(tt.want), messages)
+			}
+		})
+	}
+}
+
+func TestNotificationLines(t *testing.T) {
+	results := []tableResult{
+		{DatasetID: "sales", TableID: "orders", Status: statusFailed},
+		{DatasetID: "sales", TableID: "products", Status: statusSuccess},
+		{DatasetID: "sales", TableID: "customers", Status: statusFailed},
+		{DatasetID: "analytics", TableID: "events", Status: statusFailed},
+	}
+	batches := [][]tableResult{{results[0], results[2]}, {results[3]}}
+	tableLine := func(r tableResult) string { return r.TableID }
+	groupLine := func(datasetID, status string, group []tableResult) string {
+		return strings.Repeat("*", len(group)) + datasetID
+	}
+	tests := []struct {
+		name    string
+		batches [][]tableResult
+		want    []string
+	}{
+		{"no alerts", nil, []string{"orders", "products", "customers", "events"}},
+		{"alerted together", batches, []string{"**sales", "products", "events"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := notificationLines(results, tt.batches, tableLine, groupLine); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("notificationLines() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
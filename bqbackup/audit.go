@@ -0,0 +1,167 @@
+package bqbackup
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// runAudit compares the live BigQuery inventory of each project with its most
+// recent backup and reports what is not covered. It only reads.
+func runAudit(args []string) {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	projectFile := fs.String("f", defaultProjectFile, "File containing list of project IDs")
+	projectList := fs.String("projects", "", "Comma-separated list of project IDs (instead of -f)")
+	locationList := fs.String("locations", "", "Comma-separated dataset locations to audit, e.g. EU,europe-west1 (defaults to every location)")
+	minCoverage := fs.Float64("min-coverage", 0, "Exit with status 1 if any project's coverage is below this percentage")
+	webhook := fs.String("webhook", "", "Discord webhook URL")
+	workspaceWebhook := fs.String("workspace", "", "Google Workspace Chat webhook URL")
+	stateDir := fs.String("state-dir", defaultStateDir, "Directory containing the catalog")
+	fs.Parse(args)
+
+	projects, err := resolveProjects(fs, *projectFile, *projectList)
+	if err != nil {
+		fmt.Printf("Failed to read projects: %v\n", err)
+		os.Exit(1)
+	}
+
+	entries, err := readCatalog(*stateDir)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Failed to read catalog: %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	message := "BigQuery backup coverage audit:\n"
+	belowMinimum := false
+	for _, projectID := range projects {
+		client, err := bigquery.NewClient(ctx, projectID)
+		if err != nil {
+			fmt.Printf("Failed to create BigQuery client for project %s: %v\n", projectID, err)
+			os.Exit(1)
+		}
+		inventory := make(map[string][]string)
+		datasets, err := listDatasets(ctx, client)
+		if err != nil {
+			fmt.Printf("Failed to list datasets of project %s: %v\n", projectID, err)
+			os.Exit(1)
+		}
+		datasets, _ = filterDatasetsByLocation(ctx, bigQueryProject{client}, datasets, splitList(*locationList))
+		for _, datasetID := range datasets {
+			if inventory[datasetID], err = listTables(ctx, client.Dataset(datasetID)); err != nil {
+				fmt.Printf("Failed to list tables of dataset %s: %v\n", datasetID, err)
+				os.Exit(1)
+			}
+		}
+		client.Close()
+
+		date, backedUp := latestBackupResults(entries, projectID)
+		coverage, gaps := auditProject(inventory, backedUp)
+		if coverage < *minCoverage {
+			belowMinimum = true
+		}
+
+		message += fmt.Sprintf("\n**%s**: %.1f%% covered", projectID, coverage)
+		if date != "" {
+			message += fmt.Sprintf(" (latest backup %s)", date)
+		} else {
+			message += " (no backup recorded)"
+		}
+		message += "\n"
+		for _, gap := range gaps {
+			message += fmt.Sprintf("* %s\n", gap)
+		}
+	}
+	fmt.Print(message)
+
+	if *workspaceWebhook != "" {
+		sendWorkspaceMessage(ctx, *workspaceWebhook, message)
+	}
+	if *webhook != "" {
+		sendDiscordMessage(ctx, *webhook, "BigQuery Backup Audit", message)
+	}
+	if belowMinimum {
+		os.Exit(1)
+	}
+}
+
+// latestBackupResults returns the most recent backup date of a project and the
+// outcome of each table on that date, keyed by "dataset.table". When several
+// runs backed up a table that day, the latest one wins.
+func latestBackupResults(entries []catalogEntry, projectID string) (string, map[string]tableResult) {
+	var runs []catalogEntry
+	date := ""
+	for _, entry := range entries {
+		if entry.Kind != "" || entry.ProjectID != projectID {
+			continue
+		}
+		runs = append(runs, entry)
+		if entry.Date > date {
+			date = entry.Date
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Started.Before(runs[j].Started) })
+
+	results := make(map[string]tableResult)
+	for _, run := range runs {
+		if run.Date != date {
+			continue
+		}
+		for _, t := range run.Tables {
+			results[t.DatasetID+"."+t.TableID] = t
+		}
+	}
+	return date, results
+}
+
+// auditProject returns the percentage of live tables that were backed up
+// successfully and a line for every table or dataset that was not.
+func auditProject(inventory map[string][]string, backedUp map[string]tableResult) (float64, []string) {
+	datasets := make([]string, 0, len(inventory))
+	for datasetID := range inventory {
+		datasets = append(datasets, datasetID)
+	}
+	sort.Strings(datasets)
+
+	backedUpDatasets := make(map[string]bool)
+	for name := range backedUp {
+		backedUpDatasets[strings.SplitN(name, ".", 2)[0]] = true
+	}
+
+	total, covered := 0, 0
+	var gaps []string
+	for _, datasetID := range datasets {
+		tables := inventory[datasetID]
+		total += len(tables)
+		if !backedUpDatasets[datasetID] {
+			if len(tables) > 0 {
+				gaps = append(gaps, fmt.Sprintf("%s: new dataset, %d tables not backed up", datasetID, len(tables)))
+			}
+			continue
+		}
+		sort.Strings(tables)
+		for _, tableID := range tables {
+			result, ok := backedUp[datasetID+"."+tableID]
+			switch {
+			case !ok:
+				gaps = append(gaps, fmt.Sprintf("%s.%s: new table, not backed up", datasetID, tableID))
+			case result.Status == statusSuccess:
+				covered++
+			case result.Status == statusSkipped:
+				gaps = append(gaps, fmt.Sprintf("%s.%s: skipped (%s)", datasetID, tableID, result.Reason))
+			default:
+				gaps = append(gaps, fmt.Sprintf("%s.%s: %s %s", datasetID, tableID, result.Status, result.Reason))
+			}
+		}
+	}
+
+	if total == 0 {
+		return 100, gaps
+	}
+	return float64(covered) * 100 / float64(total), gaps
+}
@@ -0,0 +1,124 @@
+package bqbackup
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// autotuneCooldown keeps a burst of failures from the same overload from
+	// shrinking the limit more than once.
+	autotuneCooldown = 30 * time.Second
+	// autotuneSlowFactor is how much slower than usual a job has to be to
+	// count as a sign of overload.
+	autotuneSlowFactor = 2
+	// autotuneMinSlowJob keeps the jitter of quick jobs from counting as
+	// slowness.
+	autotuneMinSlowJob = 10 * time.Second
+)
+
+// workerController limits the extract jobs in flight in a project with
+// --autotune-workers, instead of a fixed number of workers per CPU. The limit
+// grows by one after a limit's worth of jobs succeeded at their usual
+// latency, and shrinks by one when a job is unusually slow and by half on a
+// quota or transient error. A nil *workerController doesn't limit anything.
+type workerController struct {
+	min, max int
+
+	mu       sync.Mutex
+	limit    int
+	inFlight int
+	// wake is closed whenever a slot may have become free.
+	wake       chan struct{}
+	successes  int
+	latency    float64
+	lastShrink time.Time
+}
+
+func newWorkerController(initial, minLimit, maxLimit int) *workerController {
+	return &workerController{
+		min:   minLimit,
+		max:   maxLimit,
+		limit: min(max(initial, minLimit), maxLimit),
+		wake:  make(chan struct{}),
+	}
+}
+
+// acquire waits for a free slot.
+func (c *workerController) acquire(ctx context.Context) error {
+	if c == nil {
+		return nil
+	}
+	for {
+		c.mu.Lock()
+		if c.inFlight < c.limit {
+			c.inFlight++
+			c.mu.Unlock()
+			return nil
+		}
+		wake := c.wake
+		c.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release frees a slot and adjusts the limit by how the job went. Its
+// latency is taken per GiB exported, with jobs under a GiB counting as one.
+func (c *workerController) release(elapsed time.Duration, numBytes int64, err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+	defer func() {
+		close(c.wake)
+		c.wake = make(chan struct{})
+	}()
+
+	if err != nil {
+		if class := classifyError(err); class == errorClassQuota || class == errorClassTransient {
+			c.shrink(c.limit/2, class+" error")
+		}
+		return
+	}
+
+	latency := elapsed.Seconds() / max(float64(numBytes)/(1<<30), 1)
+	if c.latency > 0 && latency > autotuneSlowFactor*c.latency && elapsed > autotuneMinSlowJob {
+		c.shrink(c.limit-1, "slow extract job")
+	} else {
+		c.successes++
+		if c.successes >= c.limit && c.limit < c.max {
+			c.setLimit(c.limit+1, "extract jobs keeping up")
+		}
+	}
+	if c.latency == 0 {
+		c.latency = latency
+	} else {
+		c.latency = 0.8*c.latency + 0.2*latency
+	}
+}
+
+func (c *workerController) shrink(limit int, reason string) {
+	if time.Since(c.lastShrink) < autotuneCooldown {
+		return
+	}
+	c.lastShrink = time.Now()
+	c.setLimit(limit, reason)
+}
+
+func (c *workerController) setLimit(limit int, reason string) {
+	limit = min(max(limit, c.min), c.max)
+	c.successes = 0
+	if limit == c.limit {
+		return
+	}
+	fmt.Printf("Extract jobs in flight: %d -> %d (%s)\n", c.limit, limit, reason)
+	c.limit = limit
+}
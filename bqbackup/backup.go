@@ -0,0 +1,1703 @@
+package bqbackup
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+
+	"github.com/schollz/progressbar/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+const (
+	defaultRetentionDays = 7
+	defaultStateDir      = "/var/log/bq-backup"
+	logFileName          = "backup_log.csv"
+	jsonLogFileName      = "backup_log.jsonl"
+	maxLogFileSize       = 10 * 1024 * 1024 // 10MB
+	logArchiveDir        = "archive"
+	defaultProjectFile   = "project.txt"
+	statusSuccess        = "✅"
+	statusFailed         = "❌"
+	statusSkipped        = "⏭️"
+	slowestTablesCount   = 10
+	tempTableLabel       = "bq-backup-temp"
+	runLabel             = "bq-backup-run"
+)
+
+// backupScope narrows an ad-hoc backup down to one dataset or table.
+type backupScope struct {
+	DatasetID string `json:"dataset_id"`
+	TableID   string `json:"table_id,omitempty"`
+}
+
+func (s backupScope) String() string {
+	if s.TableID == "" {
+		return s.DatasetID
+	}
+	return s.DatasetID + "." + s.TableID
+}
+
+// Main runs the bq-backup command line with args, the arguments after the
+// program name.
+func Main(args []string) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "diff-runs":
+			runDiffRuns(args[1:])
+			return
+		case "diff-backups":
+			runDiffBackups(args[1:])
+			return
+		case "check":
+			runCheck(args[1:])
+			return
+		case "audit":
+			runAudit(args[1:])
+			return
+		case "usage":
+			runUsage(args[1:])
+			return
+		case "list":
+			runList(args[1:])
+			return
+		case "verify":
+			runVerify(args[1:])
+			return
+		case "restore":
+			runRestore(args[1:])
+			return
+		case "rescue":
+			runRescue(args[1:])
+			return
+		case "explain-failure":
+			runExplainFailure(args[1:])
+			return
+		case "migrate-state":
+			runMigrateState(args[1:])
+			return
+		case "backup":
+			runBackup("backup", args[1:])
+			return
+		}
+	}
+
+	runBackup("bq-backup", args)
+}
+
+// runBackup runs a backup of every project given with -f or --projects. The
+// "backup" subcommand instead backs up a single --project, optionally narrowed
+// down to one --dataset and --table.
+func runBackup(name string, args []string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	adhoc := name == "backup"
+	var opts Options
+	var adhocProject string
+	if adhoc {
+		fs.StringVar(&adhocProject, "project", "", "Project ID to back up")
+		fs.StringVar(&opts.DatasetID, "dataset", "", "Dataset to back up (defaults to every dataset)")
+		fs.StringVar(&opts.TableID, "table", "", "Table to back up (requires --dataset)")
+	}
+	projectFile := fs.String("f", defaultProjectFile, "File containing list of project IDs")
+	projectList := fs.String("projects", "", "Comma-separated list of project IDs (instead of -f)")
+	bucketName := fs.String("bucket", "", "GCS bucket name")
+	configFile := ""
+	var every time.Duration
+	if !adhoc {
+		fs.StringVar(&configFile, "config", "", "JSON file with tenant blocks, each with its own projects, bucket, credentials, retention and notification channels (instead of -f and --bucket)")
+		fs.DurationVar(&every, "every", 0, "Keep running and back up the tenants of --config this often, e.g. 24h, applying changes to the file from the next run (0 runs once, unless the file sets every)")
+	}
+	retentionDays := fs.Int("retention", defaultRetentionDays, "Retention period in days")
+	webhook := fs.String("webhook", "", "Discord webhook URL")
+	workspaceWebhook := fs.String("workspace", "", "Google Workspace Chat webhook URL")
+	tagid := fs.String("tagid", "", "Comma-separated list of Discord tag IDs")
+	locationList := fs.String("locations", "", "Comma-separated dataset locations to back up, e.g. EU,europe-west1 (defaults to every location)")
+	runTag := fs.String("run-tag", "", "Comma-separated tags recorded with this run, to find its backups with list and restore --tag")
+	fs.BoolVar(&opts.TemporaryHold, "temporary-hold", false, "Place a temporary hold on exported backup objects")
+	tempTableMaxAge := fs.Int("temp-table-max-age", 24, "Delete leftover temporary tables older than this many hours (0 disables)")
+	fs.StringVar(&opts.Reservation, "reservation", "", "BigQuery reservation (projects/P/locations/L/reservations/R, or none for on-demand) to run materialization queries in")
+	fs.StringVar(&opts.MaterializeWindow, "materialize-window", "", "Daily local time window (HH:MM-HH:MM) outside which no materialization queries are started")
+	materializeMinutes := fs.Int("materialize-timeout", 360, "Cancel materializing an external table after this many minutes and mark it failed (0 disables)")
+	skipExpiring := fs.Int("skip-expiring-within", 0, "Skip tables that expire within this many days (0 disables)")
+	fs.BoolVar(&opts.SkipSnapshots, "skip-snapshots", false, "Skip snapshot tables")
+	fs.BoolVar(&opts.SkipClones, "skip-clones", false, "Skip table clones")
+	fs.BoolVar(&opts.ReadbackProbe, "readback-probe", false, "Count each table's rows through a temporary external table over its backup and fail tables whose count differs")
+	fs.DurationVar(&opts.ReadbackSLO, "readback-slo", 0, "Report read-back probes that take longer than this, e.g. 30s (0 disables)")
+	fs.StringVar(&opts.Format, "format", "avro", "File format to export tables in: avro or parquet")
+	fs.BoolVar(&opts.HivePartitions, "hive-partitions", false, "Export partitioned tables one partition per COLUMN=VALUE directory, for engines reading the backup in place")
+	fs.Int64Var(&opts.TinyTableBytes, "tiny-table-bytes", 0, "Tables smaller than this many bytes are exported concurrently (0 disables)")
+	fs.IntVar(&opts.TinyTableConcurrency, "tiny-table-concurrency", 8, "Number of tiny tables exported concurrently per dataset")
+	fs.BoolVar(&opts.BundleTinyTables, "bundle-tiny-tables", false, "Move the exported files of tiny tables into one zip archive per dataset")
+	fs.BoolVar(&opts.Connections, "connections", false, "Write the project's BigQuery connections (Cloud SQL, Spanner, Omni, ...) without secrets into the backup")
+	fs.BoolVar(&opts.InformationSchema, "information-schema", false, "Write snapshots of each dataset's INFORMATION_SCHEMA.TABLES, COLUMNS and VIEWS into the backup")
+	labelMode := fs.String("label-mode", "denylist", "How table labels select tables: denylist (skip bq-backup:exclude) or allowlist (only bq-backup:include)")
+	runTimeout := fs.Duration("run-timeout", 0, "Report what is done and exit with status 3 if the run is still going after this long, e.g. 6h (0 disables)")
+	fs.IntVar(&opts.MaxAttempts, "retries", defaultMaxAttempts, "Number of attempts for export jobs that fail with a transient error")
+	fs.BoolVar(&opts.AutotuneWorkers, "autotune-workers", false, "Adapt the number of extract jobs in flight to quota errors and job latency, between --min-workers and --max-workers")
+	fs.IntVar(&opts.MinWorkers, "min-workers", 1, "Fewest extract jobs in flight with --autotune-workers")
+	fs.IntVar(&opts.MaxWorkers, "max-workers", 16, "Most extract jobs in flight with --autotune-workers")
+	fs.IntVar(&opts.MaxErrors, "max-errors", 0, "Abort a project after this many consecutive table failures and send one alert about it (0 disables)")
+	fs.IntVar(&opts.MetadataConcurrency, "metadata-concurrency", 16, "Number of table metadata requests in flight while a project's tables are prefetched")
+	fs.BoolVar(&opts.Estimate, "estimate", false, "Fetch every table's metadata and print how much each project would export and for how long, without backing anything up")
+	liveView := fs.Bool("tui", false, "Show a live table of in-flight tables, failures, throughput and ETA")
+	fs.StringVar(&opts.LogFileFormat, "log-file-format", "csv", "Format of the status log in the state directory: csv or jsonl")
+	fs.BoolVar(&opts.StrictRetention, "strict-retention", false, "Report objects without a date in their path instead of cleaning them up by creation time")
+	fs.IntVar(&opts.MaxLogArchives, "log-archive-keep", defaultMaxLogArchives, "Number of rotated status log archives to keep (0 keeps all)")
+	fs.StringVar(&opts.StateDir, "state-dir", defaultStateDir, "Directory for the status log, catalog and log archives (empty disables local files)")
+	k8s := fs.Bool("k8s", false, "Kubernetes preset: JSON status logs on stdout only, health endpoints and graceful SIGTERM")
+	fs.DurationVar(&opts.AggregateWindow, "aggregate-window", defaultAggregateWindow, "Batch a dataset's failures into one alert while it is backed up, sent once this long passes without another failure (0 sends none)")
+	fs.StringVar(&opts.ReplicateDir, "replicate-to", "", "Directory, such as a mounted volume, to copy exported files to as a secondary destination")
+	fs.Int64Var(&opts.MaxBandwidth, "max-bandwidth", 0, "Limit copies to --replicate-to to this many bytes per second (0 is unlimited)")
+	fs.StringVar(&opts.KMSKeyVersion, "kms-key", "", "Cloud KMS asymmetric signing key version to sign each _COMPLETE.json manifest with")
+	fs.StringVar(&opts.CompletionWebhook, "completion-webhook", "", "URL to POST a JSON event to when a project's backup is complete")
+	fs.IntVar(&opts.Tickets.After, "ticket-after", 0, "Open or update an issue when a table fails this many runs in a row (0 disables)")
+	fs.StringVar(&opts.Tickets.GitHubRepo, "github-repo", "", "GitHub repository (owner/name) for persistent failure issues")
+	fs.StringVar(&opts.Tickets.GitHubToken, "github-token", os.Getenv("GITHUB_TOKEN"), "GitHub token (defaults to $GITHUB_TOKEN)")
+	fs.StringVar(&opts.Tickets.JiraURL, "jira-url", "", "Jira base URL for persistent failure issues")
+	fs.StringVar(&opts.Tickets.JiraProject, "jira-project", "", "Jira project key")
+	fs.StringVar(&opts.Tickets.JiraUser, "jira-user", os.Getenv("JIRA_USER"), "Jira user (defaults to $JIRA_USER)")
+	fs.StringVar(&opts.Tickets.JiraToken, "jira-token", os.Getenv("JIRA_TOKEN"), "Jira API token (defaults to $JIRA_TOKEN)")
+	fs.StringVar(&opts.GrafanaURL, "grafana-url", "", "Grafana base URL to push run annotations to")
+	fs.StringVar(&opts.GrafanaToken, "grafana-token", os.Getenv("GRAFANA_TOKEN"), "Grafana API token (defaults to $GRAFANA_TOKEN)")
+	hookCommands := make([]string, len(hookEvents))
+	for i, event := range hookEvents {
+		fs.StringVar(&hookCommands[i], event+"-hook", "", fmt.Sprintf("Shell command to run at each %s event, with the event as JSON on stdin", event))
+	}
+	fs.BoolVar(&opts.FakeBackend, "fake-backend", false, "Back up a built-in set of fake datasets into an in-memory bucket instead of using GCP, for dry runs")
+	simulateFailures := fs.Float64("simulate-failures", 0, "Fraction of tables to report as failed on purpose after backing them up, to rehearse alerting")
+	hideFlags(fs, "simulate-failures")
+	healthAddr := fs.String("health-addr", "", "Address to serve /healthz and /readyz on (defaults to :8080 with --k8s)")
+	fs.Parse(args)
+	// out routes stdout through JSON logs with --k8s.
+	var out *jsonStdout
+	if *k8s {
+		// Even errors in flag values are logged as JSON.
+		var err error
+		if out, err = startJSONStdout(); err != nil {
+			fmt.Printf("Failed to route output through JSON logs: %v\n", err)
+			os.Exit(1)
+		}
+		defer out.close()
+	}
+
+	opts.SkipCleanup = adhoc
+	opts.TempTableMaxAge = time.Duration(*tempTableMaxAge) * time.Hour
+	opts.MaterializeTimeout = time.Duration(*materializeMinutes) * time.Minute
+	opts.SkipExpiringWithin = time.Duration(*skipExpiring) * 24 * time.Hour
+	opts.LabelAllowlist = *labelMode == "allowlist"
+	if *labelMode != "denylist" && *labelMode != "allowlist" {
+		fmt.Printf("Invalid --label-mode %q, expected denylist or allowlist\n", *labelMode)
+		exitRun(out, 1)
+	}
+	if *simulateFailures < 0 || *simulateFailures > 1 {
+		fmt.Printf("Invalid --simulate-failures %v, expected a rate between 0 and 1\n", *simulateFailures)
+		exitRun(out, 1)
+	}
+	if *simulateFailures > 0 {
+		fmt.Printf("Simulating failures of %.0f%% of tables\n", *simulateFailures*100)
+	}
+	if *k8s {
+		if !isFlagSet(fs, "state-dir") {
+			opts.StateDir = ""
+		}
+		if *healthAddr == "" {
+			*healthAddr = ":8080"
+		}
+	}
+	if opts.Tickets.After > 0 && opts.StateDir == "" {
+		fmt.Println("--ticket-after needs --state-dir, failure streaks are counted from the catalog")
+		exitRun(out, 1)
+	}
+	var live *liveStatus
+	if *liveView && out == nil {
+		live = newLiveStatus()
+	}
+	var tagIDs []string
+	if *tagid != "" {
+		tagIDs = strings.Split(*tagid, ",")
+	}
+	opts.Locations = splitList(*locationList)
+	opts.RunTags = splitList(*runTag)
+	for i, event := range hookEvents {
+		if hookCommands[i] != "" {
+			opts.Hooks = append(opts.Hooks, execHook{event: event, command: hookCommands[i]})
+		}
+	}
+
+	if (*bucketName == "" && configFile == "") || (adhoc && (adhocProject == "" || (opts.TableID != "" && opts.DatasetID == ""))) {
+		if adhoc {
+			fmt.Println("Usage: bq-backup backup --project=PROJECT_ID [--dataset=DATASET [--table=TABLE]] --bucket=BUCKET_NAME [options]")
+		} else {
+			fmt.Println("Usage: bq-backup -f=PROJECT_FILE|--projects=PROJECT_IDS --bucket=BUCKET_NAME [options]\n       bq-backup --config=CONFIG_FILE [options]")
+		}
+		fs.PrintDefaults()
+		exitRun(out, 1)
+	}
+
+	if every < 0 || every > 0 && (configFile == "" || opts.Estimate) {
+		fmt.Println("--every needs --config and can't be combined with --estimate")
+		exitRun(out, 1)
+	}
+
+	var config backupConfig
+	if configFile != "" {
+		var err error
+		config, err = readConfig(configFile)
+		if err != nil {
+			fmt.Printf("Failed to read config: %v\n", err)
+			exitRun(out, 1)
+		}
+	}
+	b, err := newBackupRun(config.options(opts))
+	if err != nil {
+		fmt.Printf("Failed to set up the run: %v\n", err)
+		exitRun(out, 1)
+	}
+	b.simulateFailureRate, b.jsonOut, b.tui = *simulateFailures, out, live
+
+	projects := []string{adhocProject}
+	if !adhoc && configFile == "" {
+		var err error
+		projects, err = resolveProjects(fs, *projectFile, *projectList)
+		if err != nil {
+			fmt.Printf("Failed to read projects: %v\n", err)
+			exitRun(out, 1)
+		}
+	}
+
+	if opts.FakeBackend {
+		if b.fake, err = startFakeBackend(); err != nil {
+			fmt.Printf("Failed to start fake backend: %v\n", err)
+			exitRun(out, 1)
+		}
+		fmt.Println("Using the fake backend: notifications, tickets, Grafana annotations and the state directory are off")
+		defer func() {
+			fmt.Printf("Fake backend contents:\n%s\n", b.fake.summary())
+			b.fake.close()
+		}()
+	}
+	var status atomic.Pointer[statusTracker]
+	if *healthAddr != "" && !opts.Estimate {
+		startHealthServer(*healthAddr, &status)
+	}
+
+	// Cancel in-flight work on SIGTERM so the run wraps up within the
+	// termination grace period.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if configFile != "" {
+		// backupTenants returns whether the run timed out.
+		backupTenants := func(b *backupRun, config backupConfig) bool {
+			ctx := b.open(ctx, *runTimeout)
+			defer b.close()
+			status.Store(b.state)
+
+			var reports []tenantReport
+			for _, t := range config.Tenants {
+				if ctx.Err() != nil {
+					fmt.Println("Shutting down, skipping remaining tenants")
+					break
+				}
+				if t.RetentionDays == 0 {
+					t.RetentionDays = *retentionDays
+				}
+				if len(t.TagIDs) == 0 {
+					t.TagIDs = tagIDs
+				}
+				fmt.Printf("Backing up tenant %s\n", t.Name)
+				reports = append(reports, b.backupTenant(ctx, t))
+			}
+			printTenantReports(reports)
+			return timedOut(ctx)
+		}
+		// An estimate is a one-off, even of a file that sets every.
+		if opts.Estimate || every == 0 && config.Every == "" {
+			if backupTenants(b, config) {
+				exitRun(out, exitCodeRunTimeout)
+			}
+			return
+		}
+		// A file that drops every falls back to the interval the service
+		// started with.
+		serveBackups(ctx, configFile, config, config.interval(every), b.format, func(config backupConfig) {
+			run, err := newBackupRun(config.options(opts))
+			if err != nil {
+				fmt.Printf("Failed to set up the run: %v\n", err)
+				return
+			}
+			run.simulateFailureRate, run.fake, run.jsonOut, run.tui = b.simulateFailureRate, b.fake, b.jsonOut, b.tui
+			backupTenants(run, config)
+		})
+		return
+	}
+
+	ctx = b.open(ctx, *runTimeout)
+	status.Store(b.state)
+	b.backupTenant(ctx, tenantConfig{
+		Projects:         projects,
+		Bucket:           *bucketName,
+		RetentionDays:    *retentionDays,
+		DiscordWebhook:   *webhook,
+		WorkspaceWebhook: *workspaceWebhook,
+		TagIDs:           tagIDs,
+	})
+	b.close()
+	if timedOut(ctx) {
+		exitRun(out, exitCodeRunTimeout)
+	}
+}
+
+// projectListing is what a project's run backs up, listed before any of
+// the tenant's projects is backed up.
+type projectListing struct {
+	projectID   string
+	datasets    []string
+	excluded    []excludedDataset
+	tables      map[string][]string
+	totalTables int
+	cache       *metadataCache
+	plan        backupPlan
+	// failures are the failed results of the datasets, or of the project,
+	// that couldn't be listed. They count towards totalTables.
+	failures []tableResult
+}
+
+// backupTenant backs up every project of a tenant with the tenant's
+// credentials, bucket and notification channels.
+func (b *backupRun) backupTenant(ctx context.Context, t tenantConfig) tenantReport {
+	report := tenantReport{Name: t.Name, Projects: len(t.Projects)}
+	bucketName := t.Bucket
+	if b.fake != nil {
+		// A dry run alerts no one.
+		t.DiscordWebhook, t.WorkspaceWebhook = "", ""
+	}
+
+	opts, err := t.clientOptions(ctx, b.fake)
+	if err != nil {
+		fmt.Printf("Failed to set up credentials: %v\n", err)
+		report.Err = err
+		return report
+	}
+	storageClient, err := storage.NewClient(ctx, opts...)
+	if err != nil {
+		fmt.Printf("Failed to create Storage client: %v\n", err)
+		report.Err = err
+		return report
+	}
+	defer storageClient.Close()
+	store := gcsStore{storageClient}
+
+	signer, err := newManifestSigner(ctx, b.kmsKeyVersion, opts...)
+	if err != nil {
+		fmt.Printf("Failed to set up manifest signing: %v\n", err)
+		report.Err = err
+		return report
+	}
+
+	checkBucketRetentionPolicy(ctx, storageClient, bucketName, t.RetentionDays)
+	provenance := b.newRunProvenance(ctx, t, storageClient)
+	b.state.markReady()
+
+	// List every project's tables up front so progress is counted in
+	// tables across all of the tenant's projects.
+	var listings []projectListing
+	for _, projectID := range t.Projects {
+		if ctx.Err() != nil {
+			fmt.Println("Shutting down, skipping remaining projects")
+			break
+		}
+
+		l, err := b.listProject(ctx, projectID, opts)
+		if err != nil {
+			fmt.Printf("Failed to create BigQuery client for project %s: %v\n", projectID, err)
+			continue
+		}
+		if b.estimateOnly {
+			printEstimate(b.stateDir, projectID, l.plan)
+			continue
+		}
+		listings = append(listings, l)
+	}
+	if len(listings) == 0 {
+		return report
+	}
+
+	allTables := 0
+	for _, l := range listings {
+		allTables += l.totalTables
+	}
+	bar := progressbar.NewOptions(allTables,
+		progressbar.OptionSetDescription("Backing up"),
+		progressbar.OptionShowCount(),
+		progressbar.OptionSetWidth(30),
+		progressbar.OptionSetPredictTime(true),
+		progressbar.OptionClearOnFinish(),
+		progressbar.OptionSpinnerType(14),
+		progressbar.OptionSetVisibility(b.showProgress()),
+	)
+	defer bar.Finish()
+
+	for i, l := range listings {
+		if ctx.Err() != nil {
+			fmt.Println("Shutting down, skipping remaining projects")
+			break
+		}
+		projectID := l.projectID
+		client, err := bigquery.NewClient(ctx, projectID, opts...)
+		if err != nil {
+			fmt.Printf("Failed to create BigQuery client for project %s: %v\n", projectID, err)
+			bar.Add(l.totalTables)
+			continue
+		}
+		// Writers are quiesced right before the project is backed up, not
+		// when it was listed.
+		event := HookEvent{Event: HookPreRun, RunID: b.runID, ProjectID: projectID, Date: time.Now().Format("2006-01-02")}
+		if err := b.runPreRunHooks(ctx, event); err != nil {
+			fmt.Printf("Skipping project %s, pre-run hook failed: %v\n", projectID, err)
+			client.Close()
+			bar.Add(l.totalTables)
+			continue
+		}
+		c := projectClients{bq: client, gcs: storageClient, tables: bigQueryProject{client}, objects: store}
+		datasets, excluded, tables, totalTables, plan := l.datasets, l.excluded, l.tables, l.totalTables, l.plan
+		b.prefetched = l.cache
+
+		cpuCount := runtime.NumCPU()
+		numWorkers := max(cpuCount/2, 1)
+		// With autotuning there are enough workers for the most jobs in
+		// flight, and the controller decides how many of them may export.
+		b.extractWorkers = nil
+		if b.autotuneWorkers {
+			b.extractWorkers = newWorkerController(numWorkers, b.minWorkers, b.maxWorkers)
+			numWorkers = b.maxWorkers
+		}
+
+		started := time.Now()
+		rep := newReporter(t.DiscordWebhook, t.WorkspaceWebhook, t.TagIDs)
+		rep.excluded = markNewExclusions(b.stateDir, excluded, projectID)
+		rep.replicateDir, rep.readbackSLO = b.replicateDir, b.readbackSLO
+		rep.alerts = newFailureAlerts(ctx, t.DiscordWebhook, t.WorkspaceWebhook, projectID, b.aggregateWindow)
+		// The project's work is cancelled if its circuit breaker trips.
+		projectCtx, abort := context.WithCancelCause(ctx)
+		rep.breaker = newCircuitBreaker(b.maxErrors, abort)
+		entry := catalogEntry{
+			RunID:     b.runID,
+			Date:      started.Format("2006-01-02"),
+			ProjectID: projectID,
+			Bucket:    bucketName,
+			Started:   started,
+			Tenant:    t.Name,
+			Tags:      b.runTags,
+			Excluded:  datasetIDs(excluded),
+
+			ConfigFingerprint: provenance.ConfigFingerprint,
+			Identity:          provenance.Identity,
+		}
+		if b.scope.DatasetID != "" {
+			entry.Kind = catalogKindAdhoc
+			entry.Scope = &backupScope{DatasetID: b.scope.DatasetID, TableID: b.scope.TableID}
+		}
+		b.watchdog.watch(entry, rep)
+		jobs := make(chan string, len(datasets))
+		var wg sync.WaitGroup
+
+		bar.Describe(fmt.Sprintf("Backing up project %s (%d/%d)", projectID, i+1, len(listings)))
+		b.tui.startProject(projectID, len(datasets), totalTables, plan.bytes)
+		b.state.startProject(projectID, len(datasets), totalTables, plan.bytes)
+
+		// Schemas are compared against the project's latest earlier backup.
+		previousDate, err := previousBackupDate(ctx, store, bucketName, projectID, started.Format("2006-01-02"))
+		if err != nil {
+			fmt.Printf("Failed to find the previous backup of project %s: %v\n", projectID, err)
+		}
+		for _, failure := range l.failures {
+			b.logStatus(rep, started.Format("2006-01-02"), projectID, failure)
+			bar.Add(1)
+		}
+
+		for i := 0; i < numWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for datasetID := range jobs {
+					if projectCtx.Err() != nil {
+						continue
+					}
+					b.backupDataset(projectCtx, c, rep, bucketName, projectID, previousDate, datasetID, tables[datasetID], bar)
+					b.tui.finishDataset()
+					b.state.finishDataset()
+				}
+			}()
+		}
+
+		for _, datasetID := range plan.datasets {
+			jobs <- datasetID
+		}
+		close(jobs)
+
+		wg.Wait()
+		abort(nil)
+		// The bar is drawn again as the next project's tables finish.
+		bar.Clear()
+		b.tui.finishProject()
+		b.state.finishProject()
+		aborted := rep.breaker.tripped()
+		if aborted {
+			// Tables the project won't back up no longer count as work left.
+			bar.Add(totalTables - len(rep.results))
+			rep.note = rep.breaker.note(totalTables - len(rep.results))
+			fmt.Printf("%s: %s\n", projectID, rep.note)
+		}
+
+		// A narrowed run only sees some of the project's locations.
+		if b.connections && b.scope.DatasetID == "" && !aborted {
+			if err := writeConnections(ctx, client, storageClient, bucketName, projectID, started.Format("2006-01-02"), datasets, opts...); err != nil {
+				fmt.Printf("Failed to write connections of project %s: %v\n", projectID, err)
+			}
+		}
+
+		entry.Finished, entry.Tables = time.Now(), rep.results
+		report.Tables += len(entry.Tables)
+		report.Failed += countFailed(entry)
+		// The watchdog recorded and reported a project it timed out.
+		if !b.watchdog.claim(rep) {
+			rep.alerts.abandon()
+			client.Close()
+			continue
+		}
+		if err := appendCatalogEntry(b.stateDir, entry); err != nil {
+			fmt.Printf("Failed to write catalog entry: %v\n", err)
+		}
+
+		// Only mark the backup complete if the run was not interrupted
+		if ctx.Err() == nil && !aborted {
+			manifest := newManifest(entry)
+			manifest.Provenance = &provenance
+			manifestURL, err := writeManifest(ctx, store, signer, bucketName, manifest, b.scope.DatasetID != "")
+			if err != nil {
+				fmt.Printf("Failed to write completion marker for project %s: %v\n", projectID, err)
+			} else if b.completionWebhook != "" {
+				sendCompletionEvent(b.completionWebhook, manifest, manifestURL)
+			}
+		}
+
+		// The secondary copy is made once the backup is final, and its
+		// failures are reported apart from the tables'.
+		if b.replicateDir != "" && ctx.Err() == nil {
+			rep.replicaFailures = b.replicateBackup(ctx, storageClient, bucketName, projectID, entry.Date)
+			if len(rep.replicaFailures) > 0 {
+				fmt.Printf("Failed to replicate %d objects of project %s to %s:\n", len(rep.replicaFailures), projectID, b.replicateDir)
+				for _, line := range formatReplicaFailures(rep.replicaFailures) {
+					fmt.Println(line)
+				}
+			}
+		}
+
+		if slowest := formatSlowestTables(rep.results, slowestTablesCount); len(slowest) > 0 {
+			fmt.Printf("Slowest tables for project %s:\n", projectID)
+			for _, line := range slowest {
+				fmt.Println(line)
+			}
+		}
+		if changes := formatSchemaChanges(rep.results); len(changes) > 0 {
+			fmt.Printf("Schema changes for project %s:\n", projectID)
+			for _, line := range changes {
+				fmt.Println(line)
+			}
+		}
+		if slow := formatSlowReadbacks(rep.results, b.readbackSLO); len(slow) > 0 {
+			fmt.Printf("Read-back probes over %s for project %s:\n", b.readbackSLO, projectID)
+			for _, line := range slow {
+				fmt.Println(line)
+			}
+		}
+		if gaps := formatCoverageGaps(rep.excluded, rep.results); len(gaps) > 0 {
+			fmt.Printf("Not covered in project %s:\n", projectID)
+			for _, line := range gaps {
+				fmt.Println(line)
+			}
+		}
+
+		// Clean up old backups, unless today's backup was abandoned and they
+		// may be the latest good ones
+		if ctx.Err() == nil && !b.skipCleanup && !aborted {
+			b.cleanupOldBackups(ctx, store, bucketName, projectID, t.RetentionDays)
+			if b.replicateDir != "" {
+				b.cleanupReplica(projectID, t.RetentionDays)
+			}
+		}
+
+		// Send notifications after each project's backup is completed, once
+		// its last failures are alerted
+		rep.alerts.close()
+		rep.sendNotifications(context.WithoutCancel(ctx), projectID)
+		b.watchdog.done(rep)
+		if b.grafanaURL != "" && b.fake == nil {
+			sendGrafanaAnnotation(b.grafanaURL, b.grafanaToken, entry)
+		}
+		// Failure streaks are counted over backups of the whole project.
+		if b.tickets.enabled() && entry.Kind == "" && b.fake == nil {
+			b.tickets.fileTicketsForPersistentFailures(b.stateDir, entry)
+		}
+
+		event.Tables, event.Failed = len(entry.Tables), countFailed(entry)
+		if err := b.runPostRunHooks(ctx, event); err != nil {
+			fmt.Printf("Post-run hook failed for project %s: %v\n", projectID, err)
+		}
+		client.Close()
+	}
+	// Projects the run ended in the middle of still get their post-run
+	// hooks.
+	b.runPendingPostRunHooks(ctx, "the run ended before the project was backed up")
+	return report
+}
+
+// listProject lists what a project's run backs up and plans it from the
+// prefetched metadata of its tables, with a BigQuery client of its own.
+func (b *backupRun) listProject(ctx context.Context, projectID string, opts []option.ClientOption) (projectListing, error) {
+	client, err := bigquery.NewClient(ctx, projectID, opts...)
+	if err != nil {
+		return projectListing{}, err
+	}
+	defer client.Close()
+
+	lister := bigQueryProject{client}
+	datasets, excluded, failures := b.listProjectDatasets(ctx, lister, projectID)
+	// Leftover temporary tables are the run's own, and are deleted before
+	// they could be listed as tables to back up.
+	if b.tempTableMaxAge > 0 && !b.estimateOnly {
+		cleanupLeftoverTempTables(ctx, client, projectID, datasets, b.tempTableMaxAge)
+	}
+	datasets, tables, tableFailures := b.listDatasetTables(ctx, lister, datasets)
+	failures = append(failures, tableFailures...)
+	totalTables := 0
+	for _, datasetID := range datasets {
+		totalTables += len(tables[datasetID])
+	}
+	// Fetch every table's metadata concurrently rather than one by one as
+	// tables are backed up, and plan the run from it.
+	cache := prefetchMetadata(ctx, lister, projectID, datasets, tables, totalTables, b.metadataConcurrency, b.showProgress())
+	return projectListing{
+		projectID:   projectID,
+		datasets:    datasets,
+		excluded:    excluded,
+		failures:    failures,
+		tables:      tables,
+		totalTables: totalTables + len(failures),
+		cache:       cache,
+		plan:        planBackup(b.policy, datasets, tables, cache, time.Now()),
+	}, nil
+}
+
+// exitRun ends a backup run that failed to start with code, writing out
+// stdout routed through out first, as os.Exit skips deferred calls.
+func exitRun(out *jsonStdout, code int) {
+	out.close()
+	os.Exit(code)
+}
+
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// resolveProjects returns the projects given with --projects, or read from the
+// -f project file otherwise. The two flags are mutually exclusive.
+func resolveProjects(fs *flag.FlagSet, projectFile, projectList string) ([]string, error) {
+	if projectList == "" {
+		return readProjectFile(projectFile)
+	}
+	if isFlagSet(fs, "f") {
+		return nil, errors.New("-f and --projects are mutually exclusive")
+	}
+	return splitList(projectList), nil
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func readProjectFile(filePath string) ([]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var projects []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		project := strings.TrimSpace(scanner.Text())
+		if project != "" {
+			projects = append(projects, project)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return projects, nil
+}
+
+// listDatasets lists the datasets of the client's project. On error it
+// returns the datasets listed so far.
+func listDatasets(ctx context.Context, client *bigquery.Client) ([]string, error) {
+	it := client.Datasets(ctx)
+	var datasets []string
+	for {
+		ds, err := it.Next()
+		if err == iterator.Done {
+			return datasets, nil
+		}
+		if err != nil {
+			return datasets, err
+		}
+		datasets = append(datasets, ds.DatasetID)
+	}
+}
+
+// listProjectDatasets lists the datasets of a project that are backed up.
+// What can't be listed is backed up as far as it was listed and reported as
+// failed, rather than ending the run.
+func (b *backupRun) listProjectDatasets(ctx context.Context, lister datasetLister, projectID string) ([]string, []excludedDataset, []tableResult) {
+	var failures []tableResult
+	datasets := []string{b.scope.DatasetID}
+	if b.scope.DatasetID == "" {
+		var err error
+		if datasets, err = lister.Datasets(ctx); err != nil && ctx.Err() == nil {
+			fmt.Printf("Failed to list datasets of project %s: %v\n", projectID, err)
+			failures = append(failures, listingFailure("*", "Failed to list datasets", err))
+		}
+	}
+	datasets, excluded := filterDatasetsByLocation(ctx, lister, datasets, b.locations)
+	return datasets, excluded, failures
+}
+
+// listDatasetTables lists the tables of datasets that are backed up. A
+// dataset whose tables can't be listed is reported as failed and left out,
+// so its metadata and stats are left as they are.
+func (b *backupRun) listDatasetTables(ctx context.Context, lister datasetLister, datasets []string) ([]string, map[string][]string, []tableResult) {
+	var failures []tableResult
+	tables := make(map[string][]string, len(datasets))
+	listed := make([]string, 0, len(datasets))
+	for _, datasetID := range datasets {
+		tables[datasetID] = []string{b.scope.TableID}
+		if b.scope.TableID == "" {
+			var err error
+			if tables[datasetID], err = lister.Tables(ctx, datasetID); err != nil && ctx.Err() == nil {
+				fmt.Printf("Failed to list tables of dataset %s: %v\n", datasetID, err)
+				failures = append(failures, listingFailure(datasetID, "Failed to list tables", err))
+				delete(tables, datasetID)
+				continue
+			}
+		}
+		listed = append(listed, datasetID)
+	}
+	return listed, tables, failures
+}
+
+// filterDatasetsByLocation keeps the datasets located in one of locations,
+// compared case-insensitively, and returns the others separately. An empty
+// list keeps every dataset, and so is a dataset whose location can't be read.
+func filterDatasetsByLocation(ctx context.Context, lister datasetLister, datasets, locations []string) ([]string, []excludedDataset) {
+	if len(locations) == 0 {
+		return datasets, nil
+	}
+
+	var kept, skipped []string
+	var excluded []excludedDataset
+	for _, datasetID := range datasets {
+		meta, err := lister.DatasetMetadata(ctx, datasetID)
+		if err != nil {
+			// Its backup fails visibly, rather than it going unbacked
+			// without a trace.
+			fmt.Printf("Failed to get location of dataset %s, keeping it: %v\n", datasetID, err)
+			kept = append(kept, datasetID)
+			continue
+		}
+		matched := false
+		for _, location := range locations {
+			if strings.EqualFold(meta.Location, location) {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			kept = append(kept, datasetID)
+		} else {
+			skipped = append(skipped, fmt.Sprintf("%s (%s)", datasetID, meta.Location))
+			excluded = append(excluded, excludedDataset{DatasetID: datasetID, Location: meta.Location})
+		}
+	}
+	if len(skipped) > 0 {
+		fmt.Printf("Skipping %d datasets outside %s: %s\n", len(skipped), strings.Join(locations, ", "), strings.Join(skipped, ", "))
+	}
+	return kept, excluded
+}
+
+// projectClients are what a project is backed up through. A regular table
+// only goes through tables and objects; bq and gcs serve the optional
+// features, such as external tables, read-back probes, holds and bundles.
+type projectClients struct {
+	bq      *bigquery.Client
+	gcs     *storage.Client
+	tables  tableExporter
+	objects objectStore
+}
+
+func (b *backupRun) backupDataset(ctx context.Context, c projectClients, rep *reporter, bucketName, projectID, previousDate, datasetID string, tables []string, bar *progressbar.ProgressBar) {
+	dataset := c.bq.Dataset(datasetID)
+
+	today := time.Now().Format("2006-01-02")
+	if err := writeDatasetMetadata(ctx, dataset, c.objects, bucketName, projectID, today); err != nil {
+		fmt.Printf("Failed to write metadata for dataset %s: %v\n", datasetID, err)
+	}
+	if b.informationSchema {
+		if err := writeInformationSchema(ctx, c.bq, dataset, c.gcs, bucketName, projectID, today); err != nil {
+			fmt.Printf("Failed to write INFORMATION_SCHEMA snapshot for dataset %s: %v\n", datasetID, err)
+		}
+	}
+
+	tiny, large := b.splitTinyTables(ctx, c.bq, dataset, tables)
+	results := b.backupTables(ctx, c, rep, bucketName, projectID, today, previousDate, datasetID, tiny, b.tinyTableConcurrency, bar)
+	if b.bundleTinyTables && b.scope.TableID == "" {
+		var exported []string
+		for _, result := range results {
+			if result.Status == statusSuccess {
+				exported = append(exported, result.TableID)
+			}
+		}
+		if len(exported) > 0 {
+			if err := bundleTables(ctx, c.gcs, bucketName, projectID, today, datasetID, exported); err != nil {
+				fmt.Printf("Failed to archive tiny tables of dataset %s, leaving their files in place: %v\n", datasetID, err)
+			}
+		}
+	}
+	results = append(results, b.backupTables(ctx, c, rep, bucketName, projectID, today, previousDate, datasetID, large, 1, bar)...)
+
+	// A single-table backup must not replace the stats of the whole dataset.
+	if b.scope.TableID != "" {
+		return
+	}
+	// Nor must the stats of a cancelled project's unfinished dataset.
+	if ctx.Err() != nil {
+		return
+	}
+	if err := writeDatasetStats(ctx, c.objects, bucketName, projectID, today, datasetID, b.runID, results); err != nil {
+		fmt.Printf("Failed to write stats for dataset %s: %v\n", datasetID, err)
+	}
+}
+
+// backupTables backs up tables with up to concurrency tables in flight,
+// advancing bar as each table finishes.
+func (b *backupRun) backupTables(ctx context.Context, c projectClients, rep *reporter, bucketName, projectID, today, previousDate, datasetID string, tables []string, concurrency int, bar *progressbar.ProgressBar) []tableResult {
+	var results []tableResult
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(concurrency, 1))
+	for _, tableID := range tables {
+		// Tables not started yet are left out once the project is cancelled.
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(tableID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			b.tui.startTable(datasetID, tableID)
+			b.state.startTable(datasetID, tableID)
+			result := b.logStatus(rep, today, projectID, b.backupDatasetTable(ctx, c, bucketName, projectID, today, previousDate, datasetID, tableID))
+			bar.Add(1)
+			event := HookEvent{Event: HookPostTable, RunID: b.runID, ProjectID: projectID, Date: today,
+				DatasetID: datasetID, TableID: tableID, Status: result.Status, Reason: result.Reason}
+			if err := b.runHooks(ctx, event); err != nil {
+				fmt.Printf("Post-table hook failed for %s.%s: %v\n", datasetID, tableID, err)
+			}
+			mu.Lock()
+			results = append(results, result)
+			mu.Unlock()
+		}(tableID)
+	}
+	wg.Wait()
+	return results
+}
+
+func (b *backupRun) backupDatasetTable(ctx context.Context, c projectClients, bucketName, projectID, today, previousDate, datasetID, tableID string) tableResult {
+	result := tableResult{DatasetID: datasetID, TableID: tableID, Status: statusSuccess, Started: time.Now()}
+	meta, ok := b.prefetched.table(datasetID, tableID)
+	if !ok {
+		var err error
+		meta, err = c.tables.TableMetadata(ctx, datasetID, tableID)
+		if err != nil {
+			result.fail("Failed to get metadata", err)
+			return result
+		}
+	}
+	result.NumBytes = meta.NumBytes
+	result.NumRows = meta.NumRows
+	result.BaseTable = baseTableReference(meta)
+
+	if reason := b.policy.skipReason(meta, time.Now()); reason != "" {
+		result.Status, result.Reason = statusSkipped, reason
+		return result
+	}
+
+	event := HookEvent{Event: HookPreTable, RunID: b.runID, ProjectID: projectID, Date: today, DatasetID: datasetID, TableID: tableID}
+	if err := b.runHooks(ctx, event); err != nil {
+		result.fail("Pre-table hook failed", err)
+		return result
+	}
+
+	sourceID := tableID
+	if meta.Type == bigquery.ExternalTable {
+		if !b.materializeWindow.contains(time.Now()) {
+			result.Status, result.Reason = statusSkipped, fmt.Sprintf("outside materialization window %s", b.materializeWindow)
+			return result
+		}
+		// Handle external table export
+		dataset := c.bq.Dataset(datasetID)
+		tempTable, err := newTempTable(ctx, dataset, tableID, b.runID)
+		if err != nil {
+			result.fail("Failed to create temporary table", err)
+			return result
+		}
+		if err := b.createTempTable(ctx, c.bq, tempTable, dataset.Table(tableID), meta); err != nil {
+			result.fail("Failed to create temporary table", err)
+			return result
+		}
+		defer func() {
+			if err := deleteTempTable(ctx, tempTable); err != nil {
+				fmt.Printf("Failed to delete temporary table %s: %v\n", tempTable.TableID, err)
+			}
+		}()
+		sourceID = tempTable.TableID
+	}
+
+	// The files of an earlier run of the day can be neither replaced nor
+	// deleted while they are held, so their holds are lifted for the export.
+	prefix := backupPath(projectID, today, datasetID, tableID) + "/"
+	if b.temporaryHold {
+		if err := holdPrefix(ctx, c.gcs, c.objects, bucketName, prefix, false); err != nil {
+			result.fail("Failed to release temporary hold", err)
+			return result
+		}
+	}
+	var objects []*storage.ObjectAttrs
+	err := retryTransient(ctx, b.maxAttempts, fmt.Sprintf("Export of %s.%s", datasetID, tableID), func() error {
+		if err := b.extractWorkers.acquire(ctx); err != nil {
+			return err
+		}
+		exportStarted := time.Now()
+		var err error
+		objects, err = b.backupTable(ctx, c, sourceID, meta, bucketName, projectID, today, datasetID, tableID)
+		b.extractWorkers.release(time.Since(exportStarted), meta.NumBytes, err)
+		if err != nil {
+			result.recordAttempt(err)
+		}
+		return err
+	})
+	if err == nil {
+		err = removeStaleFiles(ctx, c.objects, bucketName, prefix, objects)
+	}
+	if err != nil {
+		if b.temporaryHold {
+			// Whatever the failed export left keeps the hold.
+			if err := holdPrefix(ctx, c.gcs, c.objects, bucketName, prefix, true); err != nil {
+				fmt.Printf("Failed to place temporary hold on %s: %v\n", prefix, err)
+			}
+		}
+		result.fail("Failed to back up table", err)
+		return result
+	}
+	if b.temporaryHold {
+		if err := holdObjects(ctx, c.gcs, bucketName, objects, true); err != nil {
+			result.fail("Failed to place temporary hold", err)
+			return result
+		}
+	}
+	result.ExportedFiles = len(objects)
+	for _, attrs := range objects {
+		result.ExportedBytes += attrs.Size
+	}
+
+	result.SchemaChanges, err = writeTableSchema(ctx, c.objects, bucketName, projectID, today, previousDate, datasetID, tableID, meta.Schema)
+	if err != nil {
+		fmt.Printf("Failed to write schema of %s.%s: %v\n", datasetID, tableID, err)
+	}
+	if err := writeTableConstraints(ctx, c.objects, bucketName, projectID, today, datasetID, tableID, meta.TableConstraints); err != nil {
+		fmt.Printf("Failed to write keys of %s.%s: %v\n", datasetID, tableID, err)
+	}
+
+	if b.readbackProbe {
+		probe, err := b.probeReadback(ctx, c.bq, c.gcs, c.bq.Dataset(datasetID), bucketName, projectID, today, tableID)
+		if err != nil {
+			result.fail("Read-back probe failed", err)
+			return result
+		}
+		result.Readback = &probe
+		// External tables have no row count to compare with.
+		if meta.Type != bigquery.ExternalTable {
+			low, high := meta.NumRows, meta.NumRows
+			if after, err := c.tables.TableMetadata(ctx, datasetID, tableID); err == nil {
+				low, high = min(low, after.NumRows), max(high, after.NumRows)
+			}
+			if probe.Rows < low || probe.Rows > high {
+				result.Status, result.Reason = statusFailed, fmt.Sprintf("read-back returned %d rows, expected %s", probe.Rows, formatRowRange(low, high))
+				result.ErrorClass = errorClassValidation
+				return result
+			}
+		}
+	}
+
+	// The table is backed up; only its failure is simulated, and reported
+	// and notified like a real one. Retrying it would only slow the run.
+	if simulateFailure(b.simulateFailureRate) {
+		result.recordAttempt(errSimulatedFailure)
+		result.fail("Failed to back up table", errSimulatedFailure)
+		result.Simulated = true
+	}
+	return result
+}
+
+// formatRowRange formats the row counts a table had while it was exported.
+// Rows written during the export may or may not be in its files, so any
+// count from before the export to after it is expected.
+func formatRowRange(low, high uint64) string {
+	if low == high {
+		return fmt.Sprint(low)
+	}
+	return fmt.Sprintf("%d to %d", low, high)
+}
+
+// listTables lists the tables of dataset. On error it returns the tables
+// listed so far.
+func listTables(ctx context.Context, dataset *bigquery.Dataset) ([]string, error) {
+	it := dataset.Tables(ctx)
+	var tables []string
+	for {
+		tbl, err := it.Next()
+		if err == iterator.Done {
+			return tables, nil
+		}
+		if err != nil {
+			return tables, err
+		}
+		tables = append(tables, tbl.TableID)
+	}
+}
+
+// listingFailure is the failed result of a dataset whose tables, or with
+// datasetID "*" of a project whose datasets, couldn't be listed, so what
+// wasn't listed shows up as a failure instead of going unbacked unnoticed.
+func listingFailure(datasetID, reason string, err error) tableResult {
+	result := tableResult{DatasetID: datasetID, TableID: "*", Started: time.Now()}
+	result.fail(reason, err)
+	return result
+}
+
+// newTempTable picks a temporary table name for tableID that is unique to this
+// run and not already taken in the dataset.
+func newTempTable(ctx context.Context, dataset *bigquery.Dataset, tableID, runID string) (*bigquery.Table, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		tempTable := dataset.Table(fmt.Sprintf("%s_temp_%s_%s", tableID, runID, randomHex(4)))
+		_, err := tempTable.Metadata(ctx)
+		if isNotFound(err) {
+			return tempTable, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("could not find an unused temporary table name for %s", tableID)
+}
+
+// deleteTempTable deletes a temporary table of the run even once ctx is
+// cancelled, within tempTableDeleteTimeout so a shutting down run still ends
+// within its termination grace period.
+func deleteTempTable(ctx context.Context, table *bigquery.Table) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), tempTableDeleteTimeout)
+	defer cancel()
+	return table.Delete(ctx)
+}
+
+func (b *backupRun) createTempTable(ctx context.Context, client *bigquery.Client, tempTable, source *bigquery.Table, meta *bigquery.TableMetadata) error {
+	where, err := partitionFilter(ctx, client, source, meta)
+	if err != nil {
+		return err
+	}
+	query := client.Query(b.withReservation(fmt.Sprintf("CREATE TABLE %s OPTIONS(labels=[(\"%s\", \"true\"), (\"%s\", \"%s\")]) AS SELECT * FROM %s%s",
+		quoteTable(tempTable), tempTableLabel, runLabel, b.runID, quoteTable(source), where)))
+	job, err := query.Run(ctx)
+	if err != nil {
+		return err
+	}
+	return withJob(job, b.waitForMaterialization(ctx, job, source.DatasetID+"."+source.TableID))
+}
+
+const materializeProgressInterval = 30 * time.Second
+
+// tempTableDeleteTimeout bounds deleting a temporary table of the run.
+const tempTableDeleteTimeout = 30 * time.Second
+
+// waitForMaterialization polls a CTAS job, printing the bytes processed so far,
+// and cancels it once it has run longer than the run's materialization
+// timeout.
+func (b *backupRun) waitForMaterialization(ctx context.Context, job *bigquery.Job, name string) error {
+	started := time.Now()
+	ticker := time.NewTicker(materializeProgressInterval)
+	defer ticker.Stop()
+	for {
+		status, err := job.Status(ctx)
+		if err != nil {
+			return err
+		}
+		if status.Done() {
+			return status.Err()
+		}
+
+		elapsed := time.Since(started)
+		if b.materializeTimeout > 0 && elapsed > b.materializeTimeout {
+			cancelJob(job, name)
+			return fmt.Errorf("materialization still running after %s: %w", b.materializeTimeout, context.DeadlineExceeded)
+		}
+		if b.tui == nil && elapsed >= materializeProgressInterval {
+			processed := int64(0)
+			if status.Statistics != nil {
+				processed = status.Statistics.TotalBytesProcessed
+			}
+			fmt.Printf("Materializing %s: %s processed, %s elapsed\n", name, formatBytes(processed), elapsed.Round(time.Second))
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			cancelJob(job, name)
+			return ctx.Err()
+		}
+	}
+}
+
+// cancelJob cancels a query job with a fresh context, as the run's context may
+// already be done.
+func cancelJob(job *bigquery.Job, name string) {
+	if err := job.Cancel(context.Background()); err != nil {
+		fmt.Printf("Failed to cancel materialization of %s: %v\n", name, err)
+	}
+}
+
+var legacyTempTablePattern = regexp.MustCompile(`^.+_temp_(\d+)$`)
+
+func cleanupLeftoverTempTables(ctx context.Context, client *bigquery.Client, projectID string, datasets []string, maxAge time.Duration) {
+	cutoff := time.Now().Add(-maxAge)
+	var deleted []string
+	for _, datasetID := range datasets {
+		dataset := client.Dataset(datasetID)
+		tables, err := listTables(ctx, dataset)
+		if err != nil {
+			fmt.Printf("Failed to list dataset %s for leftover temporary tables: %v\n", datasetID, err)
+			continue
+		}
+		for _, tableID := range tables {
+			if !strings.Contains(tableID, "_temp_") {
+				continue
+			}
+
+			table := dataset.Table(tableID)
+			meta, err := table.Metadata(ctx)
+			if err != nil {
+				fmt.Printf("Failed to get metadata for leftover temporary table %s.%s: %v\n", datasetID, tableID, err)
+				continue
+			}
+			if !isLeftoverTempTable(tableID, meta, cutoff) {
+				continue
+			}
+
+			if err := table.Delete(ctx); err != nil {
+				fmt.Printf("Failed to delete leftover temporary table %s.%s: %v\n", datasetID, tableID, err)
+				continue
+			}
+			deleted = append(deleted, fmt.Sprintf("%s.%s (created %s)", datasetID, tableID, meta.CreationTime.Format(time.RFC3339)))
+		}
+	}
+
+	if len(deleted) > 0 {
+		fmt.Printf("Deleted %d leftover temporary tables in project %s:\n", len(deleted), projectID)
+		for _, name := range deleted {
+			fmt.Printf("* %s\n", name)
+		}
+	}
+}
+
+func isLeftoverTempTable(tableID string, meta *bigquery.TableMetadata, cutoff time.Time) bool {
+	if meta.Type != bigquery.RegularTable || !meta.CreationTime.Before(cutoff) {
+		return false
+	}
+	if meta.Labels[tempTableLabel] == "true" {
+		return true
+	}
+
+	// Tables from older versions carry no labels: only treat them as ours
+	// when they were created within an hour of the timestamp in their name.
+	match := legacyTempTablePattern.FindStringSubmatch(tableID)
+	if match == nil {
+		return false
+	}
+	unix, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return false
+	}
+	created := meta.CreationTime.Sub(time.Unix(unix, 0))
+	return created >= 0 && created <= time.Hour
+}
+
+func newRunID() string {
+	return time.Now().UTC().Format("20060102t150405") + "_" + randomHex(3)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// backupTable exports sourceID, whose metadata is meta, into the backup
+// directory of tableID and returns the exported files.
+func (b *backupRun) backupTable(ctx context.Context, c projectClients, sourceID string, meta *bigquery.TableMetadata, bucketName, projectID, date, datasetID, tableID string) ([]*storage.ObjectAttrs, error) {
+	basePath := backupPath(projectID, date, datasetID, tableID)
+	settings := b.tableExportSettings(projectID, datasetID, tableID)
+	var objects []*storage.ObjectAttrs
+	var err error
+	if b.isHivePartitioned(meta) {
+		objects, err = exportPartitions(ctx, c, datasetID, sourceID, meta, settings, bucketName, basePath)
+	} else {
+		objects, err = exportFiles(ctx, c.tables, datasetID, sourceID, settings, c.objects, bucketName, basePath, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// removeStaleFiles deletes the files under prefix that are not among the
+// files just exported, such as those of an earlier export of the table on the
+// same day, so verify, restores and read-back probes only see this export.
+// They are only removed once the new export succeeded, so a failed export
+// keeps the earlier one.
+func removeStaleFiles(ctx context.Context, store objectStore, bucketName, prefix string, exported []*storage.ObjectAttrs) error {
+	current := make(map[string]bool, len(exported))
+	for _, attrs := range exported {
+		current[attrs.Name] = true
+	}
+	objects, err := listObjects(ctx, store, bucketName, prefix)
+	if err != nil {
+		return fmt.Errorf("failed to list earlier files: %w", err)
+	}
+	for _, attrs := range objects {
+		if current[attrs.Name] {
+			continue
+		}
+		if err := store.Delete(ctx, bucketName, attrs.Name, attrs.Generation); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+			return fmt.Errorf("failed to delete earlier file %s: %w", attrs.Name, err)
+		}
+	}
+	return nil
+}
+
+// verifyExportedFiles checks the files written by an extract job against the
+// number of files the job reports, and that none of them is empty. Files left
+// over from an earlier export of the same table and date are not counted, and
+// only the files of this export are returned.
+func verifyExportedFiles(status *bigquery.JobStatus, objects []*storage.ObjectAttrs) ([]*storage.ObjectAttrs, error) {
+	if status.Statistics == nil {
+		return objects, nil
+	}
+	var exported []*storage.ObjectAttrs
+	for _, attrs := range objects {
+		if !attrs.Created.Before(status.Statistics.StartTime) {
+			exported = append(exported, attrs)
+		}
+	}
+
+	stats, ok := status.Statistics.Details.(*bigquery.ExtractStatistics)
+	if !ok {
+		return exported, nil
+	}
+	var expected int64
+	for _, count := range stats.DestinationURIFileCounts {
+		expected += count
+	}
+	if int64(len(exported)) != expected {
+		return nil, fmt.Errorf("%w: extraction job reported %d files, found %d", errExportVerification, expected, len(exported))
+	}
+	for _, attrs := range exported {
+		if attrs.Size == 0 {
+			return nil, fmt.Errorf("%w: exported file %s is empty", errExportVerification, attrs.Name)
+		}
+	}
+	return exported, nil
+}
+
+func checkBucketRetentionPolicy(ctx context.Context, storageClient *storage.Client, bucketName string, retentionDays int) {
+	attrs, err := storageClient.Bucket(bucketName).Attrs(ctx)
+	if err != nil {
+		fmt.Printf("Failed to get bucket attributes: %v\n", err)
+		return
+	}
+	if attrs.RetentionPolicy == nil {
+		return
+	}
+
+	period := attrs.RetentionPolicy.RetentionPeriod
+	if period > time.Duration(retentionDays)*24*time.Hour {
+		fmt.Printf("Warning: bucket %s retention policy (%s, locked: %t) is longer than --retention=%d, old backups will be kept until the policy expires\n",
+			bucketName, period, attrs.RetentionPolicy.IsLocked, retentionDays)
+	}
+}
+
+// errCleanupStopped stops the listing of a cleanup that can't go on.
+var errCleanupStopped = errors.New("cleanup stopped")
+
+// cleanupOldBackups deletes the project's backups older than retentionDays.
+// Rate limits and transient errors are waited out with backoff; if they
+// persist, cleanup stops and the next run resumes from the cursor saved in
+// the state directory instead of listing everything again. With strict
+// retention, objects without a date in their path are left alone and
+// reported instead of having their age judged by their creation time.
+func (b *backupRun) cleanupOldBackups(ctx context.Context, store objectStore, bucketName, projectID string, retentionDays int) {
+	prefix := pathSegment(projectID) + "/"
+	// The cursor is the last object gone through; StartOffset includes it.
+	last := b.readCleanupCursor(bucketName, projectID)
+	if last != "" {
+		fmt.Printf("Resuming cleanup of project %s after %s\n", projectID, last)
+	}
+
+	now := time.Now()
+	cutoffDate := now.AddDate(0, 0, -retentionDays)
+	locked := 0
+	var undated []string
+	var backoff cleanupBackoff
+	completed := false
+	seen := 0
+	for {
+		// A failed listing starts again after the last object gone through.
+		err := store.List(ctx, bucketName, &storage.Query{Prefix: prefix, StartOffset: last}, func(attrs *storage.ObjectAttrs) error {
+			backoff.reset()
+			if attrs.Name == last {
+				return nil
+			}
+
+			date, ok := backupDate(attrs)
+			if !ok {
+				undated = append(undated, attrs.Name)
+			}
+			if date.Before(cutoffDate) && (ok || !b.strictRetention) {
+				if isRetentionLocked(attrs, now) {
+					locked++
+				} else if !deleteOldBackup(ctx, store, bucketName, attrs, &backoff) {
+					return errCleanupStopped
+				}
+			}
+
+			last = attrs.Name
+			if seen++; seen%cleanupCursorInterval == 0 {
+				b.saveCleanupCursor(bucketName, projectID, last)
+			}
+			return nil
+		})
+		if err == nil {
+			completed = true
+			break
+		}
+		if errors.Is(err, errCleanupStopped) {
+			break
+		}
+		if backoff.wait(ctx, "Listing objects for cleanup", err) {
+			continue
+		}
+		fmt.Printf("Failed to list objects for cleanup, the next run resumes after %s: %v\n", last, err)
+		break
+	}
+	if completed {
+		b.saveCleanupCursor(bucketName, projectID, "")
+	} else {
+		b.saveCleanupCursor(bucketName, projectID, last)
+	}
+
+	if locked > 0 {
+		fmt.Printf("Warning: skipped %d old backup objects for project %s that are under hold or retention lock\n", locked, projectID)
+	}
+	if len(undated) > 0 && b.strictRetention {
+		fmt.Printf("Warning: %d objects for project %s have no date in their path and were not cleaned up:\n", len(undated), projectID)
+		for _, name := range undated {
+			fmt.Printf("* %s\n", name)
+		}
+	} else if len(undated) > 0 {
+		fmt.Printf("%d objects for project %s have no date in their path, their creation time was used for retention\n", len(undated), projectID)
+	}
+}
+
+// deleteOldBackup deletes an expired object, waiting out rate limits, and
+// reports false if cleanup should stop.
+func deleteOldBackup(ctx context.Context, store objectStore, bucketName string, attrs *storage.ObjectAttrs, backoff *cleanupBackoff) bool {
+	for {
+		err := store.Delete(ctx, bucketName, attrs.Name, attrs.Generation)
+		switch {
+		case err == nil, errors.Is(err, storage.ErrObjectNotExist):
+			// A retried delete may find the object already gone.
+			backoff.reset()
+			fmt.Printf("Deleted old backup %s\n", attrs.Name)
+			return true
+		case backoff.wait(ctx, "Deleting "+attrs.Name, err):
+			continue
+		case backoff.retries >= cleanupMaxRetries || ctx.Err() != nil:
+			fmt.Printf("Failed to delete old backup %s, stopping cleanup until the next run: %v\n", attrs.Name, err)
+			return false
+		default:
+			fmt.Printf("Failed to delete old backup %s: %v\n", attrs.Name, err)
+			backoff.reset()
+			return true
+		}
+	}
+}
+
+func isRetentionLocked(attrs *storage.ObjectAttrs, now time.Time) bool {
+	if attrs.TemporaryHold || attrs.EventBasedHold {
+		return true
+	}
+	if attrs.RetentionExpirationTime.After(now) {
+		return true
+	}
+	return attrs.Retention != nil && attrs.Retention.RetainUntil.After(now)
+}
+
+// backupDate returns the date of the backup an object belongs to, taken from
+// the PROJECT/DATE/ segment of its path. Objects whose path has no date fall
+// back to their creation time, and ok is false.
+func backupDate(attrs *storage.ObjectAttrs) (date time.Time, ok bool) {
+	parts := strings.Split(attrs.Name, "/")
+	if len(parts) >= 3 {
+		if date, err := time.Parse("2006-01-02", parts[1]); err == nil {
+			return date, true
+		}
+	}
+	return attrs.Created, false
+}
+
+// logStatus records a table's outcome in the project's reporter and the
+// run's status.
+func (b *backupRun) logStatus(r *reporter, date, projectID string, result tableResult) tableResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result.Finished = time.Now()
+	if seconds := result.duration().Seconds(); seconds > 0 && result.Status == statusSuccess {
+		result.MBPerSec = float64(result.NumBytes) / 1024 / 1024 / seconds
+	}
+
+	// Append result to the buffer for the catalog and notifications
+	r.results = append(r.results, result)
+	r.breaker.record(result)
+	r.alerts.add(result)
+	b.tui.finishTable(result)
+	b.state.finishTable(result)
+
+	b.writeStatusLog(date, projectID, result, logReason(result))
+	return result
+}
+
+func logReason(result tableResult) string {
+	if result.Reason != "" {
+		return result.Reason
+	}
+	if result.BaseTable != "" {
+		return "base table " + result.BaseTable
+	}
+	return "no issue"
+}
+
+// writeStatusLog records a table's outcome in the status log and, with
+// --k8s, on stdout.
+func (b *backupRun) writeStatusLog(date, projectID string, result tableResult, reason string) {
+	entry := statusLogEntry{Date: date, ProjectID: projectID, tableResult: result}
+	if b.jsonOut != nil {
+		if err := b.jsonOut.writeJSON(entry); err != nil {
+			fmt.Printf("Failed to write log entry: %v\n", err)
+		}
+	}
+	b.statusLog.write(entry, reason)
+}
+
+func formatSlowestTables(results []tableResult, n int) []string {
+	sorted := make([]tableResult, len(results))
+	copy(sorted, results)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].duration() > sorted[j].duration() })
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+
+	var lines []string
+	for _, r := range sorted {
+		lines = append(lines, fmt.Sprintf("* %s.%s - %s (%.2f MB/s)", r.DatasetID, r.TableID, r.duration().Round(time.Second), r.MBPerSec))
+	}
+	return lines
+}
+
+func manageLogFileSize(filePath, runID string, maxArchives int) error {
+	// Check the size of the file
+	fileInfo, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return nil // File does not exist, no management needed
+	} else if err != nil {
+		return err // Return other errors
+	}
+
+	// If the file is larger than maxLogFileSize, compress it
+	if fileInfo.Size() > maxLogFileSize {
+		err := compressLogFile(filePath, runID)
+		if err != nil {
+			return err
+		}
+		if err := pruneLogArchives(filepath.Dir(filePath), maxArchives); err != nil {
+			fmt.Printf("Failed to prune log archives: %v\n", err)
+		}
+
+		// Create a new empty log file
+		_, err = os.Create(filePath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compressLogFile(filePath, runID string) error {
+	zipFilePath := archiveFileName(filepath.Dir(filePath), runID)
+	if err := os.MkdirAll(filepath.Dir(zipFilePath), 0755); err != nil {
+		return err
+	}
+	zipFile, err := os.Create(zipFilePath)
+	if err != nil {
+		return err
+	}
+	defer zipFile.Close()
+
+	zipWriter := zip.NewWriter(zipFile)
+	defer zipWriter.Close()
+
+	fileToZip, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer fileToZip.Close()
+
+	info, err := fileToZip.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.Base(filePath)
+
+	writer, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, fileToZip)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// archiveFileName names a log archive after the time, host and run that
+// rotated the log, so hosts sharing a state directory never collide.
+func archiveFileName(stateDir, runID string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return filepath.Join(stateDir, logArchiveDir, fmt.Sprintf("backup_log_%s_%s_%s.zip",
+		time.Now().UTC().Format("20060102t150405"), pathSegment(hostname), runID))
+}
+
+const defaultMaxLogArchives = 50
+
+// pruneLogArchives deletes the oldest log archives beyond the newest keep (0
+// keeps all).
+func pruneLogArchives(stateDir string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	archives, err := filepath.Glob(filepath.Join(stateDir, logArchiveDir, "backup_log_*.zip"))
+	if err != nil {
+		return err
+	}
+	if len(archives) <= keep {
+		return nil
+	}
+
+	modTimes := make(map[string]time.Time, len(archives))
+	for _, archive := range archives {
+		if info, err := os.Stat(archive); err == nil {
+			modTimes[archive] = info.ModTime()
+		}
+	}
+	sort.Slice(archives, func(i, j int) bool { return modTimes[archives[i]].Before(modTimes[archives[j]]) })
+	for _, archive := range archives[:len(archives)-keep] {
+		if err := os.Remove(archive); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,515 @@
+package bqbackup
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	bq "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+	raw "google.golang.org/api/storage/v1"
+)
+
+func TestBackupDatasetTable(t *testing.T) {
+	const (
+		bucket = "bucket"
+		today  = "2024-05-02"
+		stale  = "p/2024-05-02/sales/orders/000000000001.avro"
+	)
+	tests := []struct {
+		name  string
+		table string
+		opts  Options
+		// prefetch prefetches the table's metadata before setup.
+		prefetch bool
+		setup    func(f *fakeBackend)
+
+		wantStatus  string
+		wantReason  string
+		wantClass   string
+		wantObjects []string
+		wantHeld    []string
+	}{
+		{
+			name:        "exported",
+			table:       "orders",
+			wantStatus:  statusSuccess,
+			wantObjects: []string{"p/2024-05-02/sales/orders.schema.json", "p/2024-05-02/sales/orders/000000000000.avro"},
+		},
+		{
+			name:       "missing",
+			table:      "gone",
+			wantStatus: statusFailed,
+			wantReason: "Failed to get metadata",
+			wantClass:  errorClassNotFound,
+		},
+		{
+			name:        "export rule",
+			table:       "orders",
+			opts:        Options{ExportRules: []ExportRule{{Dataset: "sales", Format: "parquet", Compression: "snappy"}}},
+			wantStatus:  statusSuccess,
+			wantObjects: []string{"p/2024-05-02/sales/orders.schema.json", "p/2024-05-02/sales/orders/000000000000.parquet"},
+		},
+		{
+			name:     "prefetched",
+			table:    "orders",
+			prefetch: true,
+			setup: func(f *fakeBackend) {
+				f.fail(http.MethodGet, "/projects/p/datasets/sales/tables", http.StatusNotFound, "notFound")
+			},
+			wantStatus:  statusSuccess,
+			wantObjects: []string{"p/2024-05-02/sales/orders.schema.json", "p/2024-05-02/sales/orders/000000000000.avro"},
+		},
+		{
+			name:  "extract fails",
+			table: "orders",
+			setup: func(f *fakeBackend) {
+				f.fail(http.MethodPost, "/projects/p/jobs", http.StatusForbidden, "accessDenied")
+			},
+			wantStatus: statusFailed,
+			wantReason: "Failed to back up table",
+			wantClass:  errorClassPermission,
+		},
+		{
+			name:  "earlier export is replaced",
+			table: "orders",
+			setup: func(f *fakeBackend) {
+				putTestObject(f, bucket, stale, time.Now().Add(-time.Hour), raw.Object{})
+			},
+			wantStatus:  statusSuccess,
+			wantObjects: []string{"p/2024-05-02/sales/orders.schema.json", "p/2024-05-02/sales/orders/000000000000.avro"},
+		},
+		{
+			name:  "held earlier export is replaced",
+			table: "orders",
+			opts:  Options{TemporaryHold: true},
+			setup: func(f *fakeBackend) {
+				putTestObject(f, bucket, stale, time.Now().Add(-time.Hour), raw.Object{TemporaryHold: true})
+				putTestObject(f, bucket, "p/2024-05-02/sales/orders/000000000000.avro", time.Now().Add(-time.Hour), raw.Object{TemporaryHold: true})
+			},
+			wantStatus:  statusSuccess,
+			wantObjects: []string{"p/2024-05-02/sales/orders.schema.json", "p/2024-05-02/sales/orders/000000000000.avro"},
+			wantHeld:    []string{"p/2024-05-02/sales/orders/000000000000.avro"},
+		},
+		{
+			name:  "held earlier export keeps its hold if the export fails",
+			table: "orders",
+			opts:  Options{TemporaryHold: true},
+			setup: func(f *fakeBackend) {
+				putTestObject(f, bucket, stale, time.Now().Add(-time.Hour), raw.Object{TemporaryHold: true})
+				f.fail(http.MethodPost, "/projects/p/jobs", http.StatusForbidden, "accessDenied")
+			},
+			wantStatus:  statusFailed,
+			wantReason:  "Failed to back up table",
+			wantClass:   errorClassPermission,
+			wantObjects: []string{stale},
+			wantHeld:    []string{stale},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, c := newTestBackend(t)
+			tt.opts.MaxAttempts = 1
+			b := newTestRun(t, tt.opts)
+			if tt.prefetch {
+				b.prefetched = prefetchMetadata(context.Background(), c.tables, "p", []string{"sales"}, map[string][]string{"sales": {tt.table}}, 1, 1, false)
+			}
+			if tt.setup != nil {
+				tt.setup(f)
+			}
+			result := b.backupDatasetTable(context.Background(), c, bucket, "p", today, "", "sales", tt.table)
+			if result.Status != tt.wantStatus {
+				t.Errorf("status = %s (%s), want %s", result.Status, result.Reason, tt.wantStatus)
+			}
+			if !strings.Contains(result.Reason, tt.wantReason) {
+				t.Errorf("reason = %q, want it to contain %q", result.Reason, tt.wantReason)
+			}
+			if result.ErrorClass != tt.wantClass {
+				t.Errorf("error class = %q, want %q", result.ErrorClass, tt.wantClass)
+			}
+			if got := objectNames(f, bucket); !reflect.DeepEqual(got, tt.wantObjects) {
+				t.Errorf("objects = %v, want %v", got, tt.wantObjects)
+			}
+			if got := heldObjectNames(f, bucket); !reflect.DeepEqual(got, tt.wantHeld) {
+				t.Errorf("held objects = %v, want %v", got, tt.wantHeld)
+			}
+		})
+	}
+}
+
+func TestBackupDatasetTableSimulatedFailure(t *testing.T) {
+	f, c := newTestBackend(t)
+	b := newTestRun(t, Options{MaxAttempts: 3})
+	b.simulateFailureRate = 1
+	result := b.backupDatasetTable(context.Background(), c, "bucket", "p", "2024-05-02", "", "sales", "orders")
+	if result.Status != statusFailed || !result.Simulated || result.ErrorClass != errorClassTransient {
+		t.Errorf("result = %s, simulated %t, class %q, want a simulated %s failure", result.Status, result.Simulated, result.ErrorClass, errorClassTransient)
+	}
+	// The failure isn't retried.
+	if len(result.Attempts) != 1 {
+		t.Errorf("%d attempts, want 1", len(result.Attempts))
+	}
+	if want := []string{"p/2024-05-02/sales/orders.schema.json", "p/2024-05-02/sales/orders/000000000000.avro"}; !reflect.DeepEqual(objectNames(f, "bucket"), want) {
+		t.Errorf("objects = %v, want %v", objectNames(f, "bucket"), want)
+	}
+}
+
+// heldObjectNames returns the names of a bucket's objects under a temporary
+// hold in the fake backend, in order.
+func heldObjectNames(f *fakeBackend, bucket string) []string {
+	var held []string
+	for _, name := range objectNames(f, bucket) {
+		f.mu.Lock()
+		if f.objects[bucket][name].attrs.TemporaryHold {
+			held = append(held, name)
+		}
+		f.mu.Unlock()
+	}
+	return held
+}
+
+func TestVerifyExportedFiles(t *testing.T) {
+	started := time.Now()
+	status := func(counts ...int64) *bigquery.JobStatus {
+		return &bigquery.JobStatus{Statistics: &bigquery.JobStatistics{
+			StartTime: started,
+			Details:   &bigquery.ExtractStatistics{DestinationURIFileCounts: counts},
+		}}
+	}
+	earlier := &storage.ObjectAttrs{Name: "earlier", Size: 1, Created: started.Add(-time.Hour)}
+	first := &storage.ObjectAttrs{Name: "first", Size: 1, Created: started}
+	second := &storage.ObjectAttrs{Name: "second", Size: 1, Created: started.Add(time.Second)}
+	empty := &storage.ObjectAttrs{Name: "empty", Created: started}
+	tests := []struct {
+		name    string
+		status  *bigquery.JobStatus
+		objects []*storage.ObjectAttrs
+		want    []*storage.ObjectAttrs
+		wantErr bool
+	}{
+		{"all files", status(2), []*storage.ObjectAttrs{first, second}, []*storage.ObjectAttrs{first, second}, false},
+		{"counts of several uris", status(1, 1), []*storage.ObjectAttrs{first, second}, []*storage.ObjectAttrs{first, second}, false},
+		{"earlier files are left out", status(1), []*storage.ObjectAttrs{earlier, first}, []*storage.ObjectAttrs{first}, false},
+		{"missing file", status(2), []*storage.ObjectAttrs{first}, nil, true},
+		{"empty file", status(1), []*storage.ObjectAttrs{empty}, nil, true},
+		{"no statistics", &bigquery.JobStatus{}, []*storage.ObjectAttrs{earlier}, []*storage.ObjectAttrs{earlier}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifyExportedFiles(tt.status, tt.objects)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyExportedFiles() error = %v, want error %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("verifyExportedFiles() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListProjectDatasets(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         Options
+		fail         bool
+		wantDatasets []string
+		wantExcluded []excludedDataset
+		wantFailures []string
+	}{
+		{name: "all", wantDatasets: []string{"sales", "analytics"}},
+		{name: "scoped", opts: Options{DatasetID: "sales"}, wantDatasets: []string{"sales"}},
+		{name: "location", opts: Options{Locations: []string{"eu"}}, wantDatasets: []string{"analytics"}, wantExcluded: []excludedDataset{{DatasetID: "sales", Location: "US"}}},
+		{name: "scoped out of location", opts: Options{DatasetID: "sales", Locations: []string{"eu"}}, wantExcluded: []excludedDataset{{DatasetID: "sales", Location: "US"}}},
+		{name: "unknown location is kept", opts: Options{DatasetID: "missing", Locations: []string{"eu"}}, wantDatasets: []string{"missing"}},
+		{name: "scoped listing is not needed", opts: Options{DatasetID: "sales"}, fail: true, wantDatasets: []string{"sales"}},
+		{name: "listing fails", fail: true, wantFailures: []string{"*"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, c := newTestBackend(t)
+			if tt.fail {
+				f.fail(http.MethodGet, "/projects/p/datasets", http.StatusForbidden, "accessDenied")
+			}
+			b := newTestRun(t, tt.opts)
+			datasets, excluded, failures := b.listProjectDatasets(context.Background(), c.tables.(datasetLister), "p")
+			if !reflect.DeepEqual(datasets, tt.wantDatasets) {
+				t.Errorf("datasets = %v, want %v", datasets, tt.wantDatasets)
+			}
+			if !reflect.DeepEqual(excluded, tt.wantExcluded) {
+				t.Errorf("excluded = %v, want %v", excluded, tt.wantExcluded)
+			}
+			if got := failedDatasets(failures); !reflect.DeepEqual(got, tt.wantFailures) {
+				t.Errorf("failures = %v, want %v", got, tt.wantFailures)
+			}
+		})
+	}
+}
+
+func TestListDatasetTables(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         Options
+		fail         string
+		wantDatasets []string
+		wantTables   map[string][]string
+		wantFailures []string
+	}{
+		{
+			name:         "all",
+			wantDatasets: []string{"sales", "analytics"},
+			wantTables:   map[string][]string{"sales": {"customers", "orders", "products"}, "analytics": {"events", "sessions"}},
+		},
+		{
+			name:         "scoped",
+			opts:         Options{DatasetID: "sales", TableID: "orders"},
+			wantDatasets: []string{"sales", "analytics"},
+			wantTables:   map[string][]string{"sales": {"orders"}, "analytics": {"orders"}},
+		},
+		{
+			name:         "listing fails",
+			fail:         "sales",
+			wantDatasets: []string{"analytics"},
+			wantTables:   map[string][]string{"analytics": {"events", "sessions"}},
+			wantFailures: []string{"sales"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, c := newTestBackend(t)
+			if tt.fail != "" {
+				f.fail(http.MethodGet, "/projects/p/datasets/"+tt.fail+"/tables", http.StatusForbidden, "accessDenied")
+			}
+			b := newTestRun(t, tt.opts)
+			datasets, tables, failures := b.listDatasetTables(context.Background(), c.tables.(datasetLister), []string{"sales", "analytics"})
+			if !reflect.DeepEqual(datasets, tt.wantDatasets) {
+				t.Errorf("datasets = %v, want %v", datasets, tt.wantDatasets)
+			}
+			if !reflect.DeepEqual(tables, tt.wantTables) {
+				t.Errorf("tables = %v, want %v", tables, tt.wantTables)
+			}
+			if got := failedDatasets(failures); !reflect.DeepEqual(got, tt.wantFailures) {
+				t.Errorf("failures = %v, want %v", got, tt.wantFailures)
+			}
+		})
+	}
+}
+
+// failedDatasets returns the datasets of listing failures, which fail every
+// table of the dataset.
+func failedDatasets(failures []tableResult) []string {
+	var datasets []string
+	for _, f := range failures {
+		if f.Status != statusFailed || f.TableID != "*" {
+			return []string{"unexpected " + f.DatasetID + "." + f.TableID}
+		}
+		datasets = append(datasets, f.DatasetID)
+	}
+	return datasets
+}
+
+func TestNewManifestComplete(t *testing.T) {
+	succeeded := tableResult{Status: statusSuccess}
+	failed := tableResult{Status: statusFailed}
+	simulated := tableResult{Status: statusFailed, Simulated: true}
+	skipped := tableResult{Status: statusSkipped}
+	tests := []struct {
+		name   string
+		tables []tableResult
+		want   bool
+	}{
+		{"succeeded", []tableResult{succeeded, skipped}, true},
+		{"simulated failure", []tableResult{succeeded, simulated}, true},
+		{"failed", []tableResult{succeeded, failed}, false},
+		{"nothing backed up", []tableResult{skipped}, false},
+		{"empty", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry := catalogEntry{Finished: time.Now(), Tables: tt.tables}
+			m := newManifest(entry)
+			if m.Complete != tt.want || isCompleteBackup(entry) != tt.want {
+				t.Errorf("manifest complete %t, isCompleteBackup() %t, want %t", m.Complete, isCompleteBackup(entry), tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteManifest(t *testing.T) {
+	const (
+		bucket = "bucket"
+		marker = "p/2024-05-01/" + manifestFileName
+	)
+	tests := []struct {
+		name      string
+		kmsStatus int
+		wantErr   bool
+		want      []string
+	}{
+		{"unsigned", 0, false, []string{marker}},
+		{"signed", http.StatusOK, false, []string{marker, marker + signatureSuffix}},
+		// The marker isn't left behind unsigned.
+		{"signing failed", http.StatusServiceUnavailable, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, c := newTestBackend(t)
+			ctx := context.Background()
+			var signer *manifestSigner
+			if tt.kmsStatus != 0 {
+				kms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(tt.kmsStatus)
+					w.Write([]byte(`{"signature": "c2ln"}`))
+				}))
+				defer kms.Close()
+				service, err := cloudkms.NewService(ctx, option.WithEndpoint(kms.URL), option.WithoutAuthentication())
+				if err != nil {
+					t.Fatal(err)
+				}
+				signer = &manifestSigner{kms: service, keyVersion: "key", algorithm: "EC_SIGN_P256_SHA256"}
+			}
+			m := newManifest(catalogEntry{ProjectID: "p", Date: "2024-05-01", Finished: time.Now()})
+			_, err := writeManifest(ctx, c.objects, signer, bucket, m, false)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("writeManifest() = %v, want error %t", err, tt.wantErr)
+			}
+			if got := objectNames(f, bucket); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("writeManifest() wrote %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanupOldBackups(t *testing.T) {
+	const bucket = "bucket"
+	now := time.Now()
+	old := now.AddDate(0, 0, -40)
+	oldDate, today := old.Format("2006-01-02"), now.Format("2006-01-02")
+	tests := []struct {
+		name            string
+		strictRetention bool
+		// failDelete is an object whose deletion is denied.
+		failDelete string
+		// cursor is where an earlier cleanup stopped.
+		cursor string
+		want   []string
+	}{
+		{
+			name: "expired",
+			want: []string{
+				"p/" + oldDate + "/sales/locked/000000000000.avro",
+				"p/" + today + "/sales/orders/000000000000.avro",
+				"p/recent.txt",
+			},
+		},
+		{
+			name:            "strict retention",
+			strictRetention: true,
+			want: []string{
+				"p/" + oldDate + "/sales/locked/000000000000.avro",
+				"p/" + today + "/sales/orders/000000000000.avro",
+				"p/old.txt",
+				"p/recent.txt",
+			},
+		},
+		{
+			name:       "delete fails",
+			failDelete: "p/old.txt",
+			want: []string{
+				"p/" + oldDate + "/sales/locked/000000000000.avro",
+				"p/" + today + "/sales/orders/000000000000.avro",
+				"p/old.txt",
+				"p/recent.txt",
+			},
+		},
+		{
+			name:   "resumed",
+			cursor: "p/" + oldDate + "/sales/orders/000000000000.avro",
+			want: []string{
+				"p/" + oldDate + "/sales/locked/000000000000.avro",
+				"p/" + oldDate + "/sales/orders/000000000000.avro",
+				"p/" + today + "/sales/orders/000000000000.avro",
+				"p/recent.txt",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, c := newTestBackend(t)
+			if tt.failDelete != "" {
+				f.fail(http.MethodDelete, "/b/"+bucket+"/o/"+tt.failDelete, http.StatusForbidden, "forbidden")
+			}
+			putTestObject(f, bucket, "p/"+oldDate+"/sales/orders/000000000000.avro", old, raw.Object{})
+			putTestObject(f, bucket, "p/"+oldDate+"/sales/locked/000000000000.avro", old, raw.Object{TemporaryHold: true})
+			putTestObject(f, bucket, "p/"+today+"/sales/orders/000000000000.avro", now, raw.Object{})
+			putTestObject(f, bucket, "p/old.txt", old, raw.Object{})
+			putTestObject(f, bucket, "p/recent.txt", now, raw.Object{})
+			putTestObject(f, bucket, "other/"+oldDate+"/sales/orders/000000000000.avro", old, raw.Object{})
+
+			b := newTestRun(t, Options{StrictRetention: tt.strictRetention, StateDir: t.TempDir()})
+			b.saveCleanupCursor(bucket, "p", tt.cursor)
+			b.cleanupOldBackups(context.Background(), c.objects, bucket, "p", 30)
+			want := append([]string{"other/" + oldDate + "/sales/orders/000000000000.avro"}, tt.want...)
+			if got := objectNames(f, bucket); !reflect.DeepEqual(got, want) {
+				t.Errorf("objects = %v, want %v", got, want)
+			}
+			// Cleanup went through every object.
+			if cursor := b.readCleanupCursor(bucket, "p"); cursor != "" {
+				t.Errorf("cursor = %q, want it cleared", cursor)
+			}
+		})
+	}
+}
+
+func TestCleanupLeftoverTempTables(t *testing.T) {
+	f, c := newTestBackend(t)
+	f.mu.Lock()
+	f.seedProject("p")
+	for tableID, created := range map[string]time.Time{"orders_temp_old": time.Now().AddDate(0, 0, -2), "orders_temp_new": time.Now()} {
+		f.tables["p/sales/"+tableID] = &bq.Table{
+			TableReference: &bq.TableReference{ProjectId: "p", DatasetId: "sales", TableId: tableID},
+			Type:           "TABLE",
+			Labels:         map[string]string{tempTableLabel: "true"},
+			CreationTime:   created.UnixMilli(),
+		}
+	}
+	f.mu.Unlock()
+
+	ctx := context.Background()
+	cleanupLeftoverTempTables(ctx, c.bq, "p", []string{"sales"}, 24*time.Hour)
+	tables, err := c.tables.(datasetLister).Tables(ctx, "sales")
+	if want := []string{"customers", "orders", "orders_temp_new", "products"}; err != nil || !reflect.DeepEqual(tables, want) {
+		t.Errorf("tables = %v, %v, want %v", tables, err, want)
+	}
+}
+
+func TestIsLeftoverTempTable(t *testing.T) {
+	created := time.Unix(1700000000, 0)
+	cutoff := created.Add(time.Hour)
+	tests := []struct {
+		name    string
+		tableID string
+		meta    bigquery.TableMetadata
+		want    bool
+	}{
+		{"labelled", "events_abc", bigquery.TableMetadata{Type: bigquery.RegularTable, CreationTime: created, Labels: map[string]string{tempTableLabel: "true"}}, true},
+		{"labelled but recent", "events_abc", bigquery.TableMetadata{Type: bigquery.RegularTable, CreationTime: cutoff, Labels: map[string]string{tempTableLabel: "true"}}, false},
+		{"legacy name", "events_temp_1700000000", bigquery.TableMetadata{Type: bigquery.RegularTable, CreationTime: created}, true},
+		{"legacy name created much later", "events_temp_1600000000", bigquery.TableMetadata{Type: bigquery.RegularTable, CreationTime: created}, false},
+		{"view", "events_temp_1700000000", bigquery.TableMetadata{Type: bigquery.ViewTable, CreationTime: created}, false},
+		{"unrelated", "events", bigquery.TableMetadata{Type: bigquery.RegularTable, CreationTime: created}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isLeftoverTempTable(tt.tableID, &tt.meta, cutoff); got != tt.want {
+				t.Errorf("isLeftoverTempTable(%q) = %t, want %t", tt.tableID, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package bqbackup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// backupTableInfo is what diff-backups compares of one table's backup.
+type backupTableInfo struct {
+	Bytes   int64
+	Rows    uint64
+	HasRows bool
+	// Columns maps top-level column names to their Avro type, and is nil
+	// for backups in another format.
+	Columns map[string]string
+}
+
+type backupDiff struct {
+	Added         []string
+	Removed       []string
+	SizeChanged   []string
+	SchemaChanged []string
+}
+
+func runDiffBackups(args []string) {
+	fs := flag.NewFlagSet("diff-backups", flag.ExitOnError)
+	bucketName := fs.String("bucket", "", "GCS bucket name")
+	projectID := fs.String("project", "", "Project ID the backups were taken from")
+	datasetID := fs.String("dataset", "", "Dataset to compare")
+	from := fs.String("from", "", "Date of the earlier backup (YYYY-MM-DD)")
+	to := fs.String("to", "", "Date of the later backup (YYYY-MM-DD)")
+	sizeChange := fs.Float64("size-change", 0, "Report tables whose exported size changed by more than this percentage")
+	fs.Parse(args)
+
+	if *bucketName == "" || *projectID == "" || *datasetID == "" || *from == "" || *to == "" {
+		fmt.Println("Usage: bq-backup diff-backups --bucket=BUCKET_NAME --project=PROJECT_ID --dataset=DATASET --from=YYYY-MM-DD --to=YYYY-MM-DD [--size-change=PERCENT]")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		fmt.Printf("Failed to create Storage client: %v\n", err)
+		os.Exit(1)
+	}
+	defer storageClient.Close()
+
+	before, err := readBackupTables(ctx, storageClient, *bucketName, *projectID, *from, *datasetID)
+	if err != nil {
+		fmt.Printf("Failed to read backup of %s: %v\n", *from, err)
+		os.Exit(1)
+	}
+	after, err := readBackupTables(ctx, storageClient, *bucketName, *projectID, *to, *datasetID)
+	if err != nil {
+		fmt.Printf("Failed to read backup of %s: %v\n", *to, err)
+		os.Exit(1)
+	}
+	if len(before) == 0 && len(after) == 0 {
+		fmt.Printf("No backups of %s found for %s or %s\n", *datasetID, *from, *to)
+		os.Exit(1)
+	}
+
+	d := diffBackupTables(before, after, *sizeChange)
+	fmt.Printf("Backup diff %s.%s %s -> %s\n", *projectID, *datasetID, *from, *to)
+	sections := []struct {
+		title string
+		lines []string
+	}{
+		{"New tables", d.Added},
+		{"Removed tables", d.Removed},
+		{"Schema changes", d.SchemaChanged},
+		{"Size changes", d.SizeChanged},
+	}
+	changed := false
+	for _, section := range sections {
+		if len(section.lines) == 0 {
+			continue
+		}
+		changed = true
+		fmt.Printf("* %s (%d):\n  %s\n", section.title, len(section.lines), strings.Join(section.lines, "\n  "))
+	}
+	if !changed {
+		fmt.Println("* no changes")
+	}
+}
+
+// readBackupTables reads the size and schema of every table in a dataset's
+// backup, and row counts from the run's manifest where there is one.
+func readBackupTables(ctx context.Context, storageClient *storage.Client, bucketName, projectID, date, datasetID string) (map[string]backupTableInfo, error) {
+	tableIDs, err := listBackupTables(ctx, storageClient, bucketName, projectID, date, datasetID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make(map[string]uint64)
+	manifest, err := readManifest(ctx, storageClient, bucketName, backupPath(projectID, date)+"/"+manifestFileName)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	for _, t := range manifest.TableResults {
+		if t.DatasetID == datasetID && t.Status == statusSuccess {
+			rows[t.TableID] = t.NumRows
+		}
+	}
+
+	index, err := readBundleIndex(ctx, storageClient, bucketName, projectID, date, datasetID)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make(map[string]backupTableInfo, len(tableIDs))
+	for _, tableID := range tableIDs {
+		objects, err := listObjects(ctx, gcsStore{storageClient}, bucketName, backupPath(projectID, date, datasetID, tableID)+"/")
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files of %s: %w", tableID, err)
+		}
+		info := backupTableInfo{}
+		info.Rows, info.HasRows = rows[tableID]
+		if len(objects) == 0 {
+			// The schema of archived tables is not compared.
+			if files, size := index.size(tableID); files > 0 {
+				info.Bytes = size
+				tables[tableID] = info
+			}
+			continue
+		}
+		for _, attrs := range objects {
+			info.Bytes += attrs.Size
+		}
+
+		sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+		if f, _ := fileFormat(objects[0].Name); f == avroFormat {
+			if info.Columns, err = readAvroColumns(ctx, storageClient, bucketName, objects[0].Name); err != nil {
+				return nil, fmt.Errorf("failed to read schema of %s: %w", tableID, err)
+			}
+		}
+		tables[tableID] = info
+	}
+	return tables, nil
+}
+
+func diffBackupTables(before, after map[string]backupTableInfo, sizeChangePercent float64) backupDiff {
+	var d backupDiff
+	for tableID, cur := range after {
+		prev, ok := before[tableID]
+		if !ok {
+			d.Added = append(d.Added, fmt.Sprintf("%s (%s)", tableID, formatBytes(cur.Bytes)))
+			continue
+		}
+
+		if prev.Columns != nil && cur.Columns != nil {
+			if changes := diffColumns(prev.Columns, cur.Columns); len(changes) > 0 {
+				d.SchemaChanged = append(d.SchemaChanged, fmt.Sprintf("%s: %s", tableID, strings.Join(changes, ", ")))
+			}
+		}
+
+		change := 0.0
+		if prev.Bytes > 0 {
+			change = float64(cur.Bytes-prev.Bytes) / float64(prev.Bytes) * 100
+		}
+		if cur.Bytes != prev.Bytes && (change > sizeChangePercent || change < -sizeChangePercent || prev.Bytes == 0) {
+			line := fmt.Sprintf("%s: %s -> %s (%+.0f%%)", tableID, formatBytes(prev.Bytes), formatBytes(cur.Bytes), change)
+			if prev.HasRows && cur.HasRows {
+				line += fmt.Sprintf(", %d -> %d rows", prev.Rows, cur.Rows)
+			}
+			d.SizeChanged = append(d.SizeChanged, line)
+		}
+	}
+	for tableID, prev := range before {
+		if _, ok := after[tableID]; !ok {
+			d.Removed = append(d.Removed, fmt.Sprintf("%s (%s)", tableID, formatBytes(prev.Bytes)))
+		}
+	}
+
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.SizeChanged)
+	sort.Strings(d.SchemaChanged)
+	return d
+}
+
+// diffColumns describes columns that were added, removed or changed type.
+func diffColumns(before, after map[string]string) []string {
+	var changes []string
+	for name, typ := range after {
+		prev, ok := before[name]
+		switch {
+		case !ok:
+			changes = append(changes, fmt.Sprintf("added %s %s", name, typ))
+		case prev != typ:
+			changes = append(changes, fmt.Sprintf("%s %s -> %s", name, prev, typ))
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			changes = append(changes, "removed "+name)
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+var avroMagic = []byte("Obj\x01")
+
+// readAvroColumns reads the schema from the header of an Avro object container
+// file, without downloading the rest of it.
+func readAvroColumns(ctx context.Context, storageClient *storage.Client, bucketName, name string) (map[string]string, error) {
+	reader, err := storageClient.Bucket(bucketName).Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	schema, err := readAvroSchema(bufio.NewReader(reader))
+	if err != nil {
+		return nil, err
+	}
+	var record struct {
+		Fields []struct {
+			Name string          `json:"name"`
+			Type json.RawMessage `json:"type"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal(schema, &record); err != nil {
+		return nil, fmt.Errorf("invalid Avro schema: %w", err)
+	}
+
+	columns := make(map[string]string, len(record.Fields))
+	for _, field := range record.Fields {
+		var typ bytes.Buffer
+		if err := json.Compact(&typ, field.Type); err != nil {
+			return nil, err
+		}
+		columns[field.Name] = typ.String()
+	}
+	return columns, nil
+}
+
+// readAvroSchema returns the avro.schema entry of a container file's header
+// metadata map.
+func readAvroSchema(r *bufio.Reader) ([]byte, error) {
+	magic := make([]byte, len(avroMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, avroMagic) {
+		return nil, errors.New("not an Avro container file")
+	}
+
+	for {
+		count, err := readAvroLong(r)
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			return nil, errors.New("no avro.schema in header")
+		}
+		if count < 0 {
+			// Negative counts are followed by the block's size in bytes.
+			count = -count
+			if _, err := readAvroLong(r); err != nil {
+				return nil, err
+			}
+		}
+		for ; count > 0; count-- {
+			key, err := readAvroBytes(r)
+			if err != nil {
+				return nil, err
+			}
+			value, err := readAvroBytes(r)
+			if err != nil {
+				return nil, err
+			}
+			if string(key) == "avro.schema" {
+				return value, nil
+			}
+		}
+	}
+}
+
+// readAvroLong reads a zig-zag encoded variable-length long.
+func readAvroLong(r *bufio.Reader) (int64, error) {
+	u, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, err
+	}
+	return int64(u>>1) ^ -int64(u&1), nil
+}
+
+func readAvroBytes(r *bufio.Reader) ([]byte, error) {
+	n, err := readAvroLong(r)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > 64<<20 {
+		return nil, fmt.Errorf("invalid Avro header length %d", n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return b, err
+}
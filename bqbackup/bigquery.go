@@ -0,0 +1,70 @@
+package bqbackup
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// datasetLister is the part of BigQuery a project's datasets and tables are
+// listed through.
+type datasetLister interface {
+	// Datasets and Tables return what was listed before any error.
+	Datasets(ctx context.Context) ([]string, error)
+	Tables(ctx context.Context, datasetID string) ([]string, error)
+	DatasetMetadata(ctx context.Context, datasetID string) (*bigquery.DatasetMetadata, error)
+}
+
+type metadataReader interface {
+	TableMetadata(ctx context.Context, datasetID, tableID string) (*bigquery.TableMetadata, error)
+}
+
+// tableExporter is the part of BigQuery a regular table is backed up
+// through.
+type tableExporter interface {
+	metadataReader
+	// Extract runs a job extracting a table, which may have a partition
+	// decorator, into dst and waits for it. Errors of a job that ran carry
+	// its ID.
+	Extract(ctx context.Context, datasetID, tableID string, dst *bigquery.GCSReference) (*bigquery.JobStatus, error)
+}
+
+// bigQueryProject implements the interfaces over BigQuery with a client of
+// the project.
+type bigQueryProject struct {
+	client *bigquery.Client
+}
+
+func (p bigQueryProject) Datasets(ctx context.Context) ([]string, error) {
+	return listDatasets(ctx, p.client)
+}
+
+func (p bigQueryProject) Tables(ctx context.Context, datasetID string) ([]string, error) {
+	return listTables(ctx, p.client.Dataset(datasetID))
+}
+
+func (p bigQueryProject) DatasetMetadata(ctx context.Context, datasetID string) (*bigquery.DatasetMetadata, error) {
+	return p.client.Dataset(datasetID).Metadata(ctx)
+}
+
+func (p bigQueryProject) TableMetadata(ctx context.Context, datasetID, tableID string) (*bigquery.TableMetadata, error) {
+	return p.client.Dataset(datasetID).Table(tableID).Metadata(ctx)
+}
+
+func (p bigQueryProject) Extract(ctx context.Context, datasetID, tableID string, dst *bigquery.GCSReference) (*bigquery.JobStatus, error) {
+	job, err := p.client.Dataset(datasetID).Table(tableID).ExtractorTo(dst).Run(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start extraction job: %w", err)
+	}
+
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return nil, withJob(job, fmt.Errorf("failed to wait for extraction job: %w", err))
+	}
+
+	if err := status.Err(); err != nil {
+		return nil, withJob(job, fmt.Errorf("extraction job failed: %w", err))
+	}
+	return status, nil
+}
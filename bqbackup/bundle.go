@@ -0,0 +1,229 @@
+package bqbackup
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	bundleFileName      = "_tiny_tables.zip"
+	bundleIndexFileName = "_tiny_tables.json"
+)
+
+// bundleIndex lists the tables in a dataset's archive and their files, so a
+// table's files can be found without opening the archive.
+type bundleIndex struct {
+	Archive string                   `json:"archive"`
+	Tables  map[string][]bundledFile `json:"tables"`
+}
+
+type bundledFile struct {
+	// Name is the file's object name relative to the dataset directory,
+	// e.g. TABLE/000000000000.avro, which is also its name in the archive.
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+func bundlePath(projectID, date, datasetID string) string {
+	return backupPath(projectID, date, datasetID) + "/" + bundleFileName
+}
+
+func bundleIndexPath(projectID, date, datasetID string) string {
+	return backupPath(projectID, date, datasetID) + "/" + bundleIndexFileName
+}
+
+// readBundleIndex reads a dataset's archive index; datasets without an
+// archive have an empty one.
+func readBundleIndex(ctx context.Context, storageClient *storage.Client, bucketName, projectID, date, datasetID string) (bundleIndex, error) {
+	var index bundleIndex
+	err := readJSONObject(ctx, gcsStore{storageClient}, bucketName, bundleIndexPath(projectID, date, datasetID), &index)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return bundleIndex{}, fmt.Errorf("failed to read archive index: %w", err)
+	}
+	return index, nil
+}
+
+// bundleTables moves the exported files of tables into the dataset's
+// archive and deletes them. Tables archived by an earlier run of the same day
+// that are not in tables are carried over, so a table that failed this time
+// keeps its earlier backup, as it does outside of an archive.
+func bundleTables(ctx context.Context, storageClient *storage.Client, bucketName, projectID, date, datasetID string, tables []string) error {
+	dir := backupPath(projectID, date, datasetID) + "/"
+	previous, err := readBundleIndex(ctx, storageClient, bucketName, projectID, date, datasetID)
+	if err != nil {
+		return err
+	}
+
+	index := bundleIndex{Archive: bundleFileName, Tables: make(map[string][]bundledFile)}
+	var bundled []*storage.ObjectAttrs
+	// Cancelling the writer's context discards the archive written so far.
+	writerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer := storageClient.Bucket(bucketName).Object(bundlePath(projectID, date, datasetID)).NewWriter(writerCtx)
+	writer.ContentType = "application/zip"
+	archive := zip.NewWriter(writer)
+	fail := func(err error) error {
+		cancel()
+		writer.Close()
+		return err
+	}
+
+	for _, tableID := range tables {
+		objects, err := listObjects(ctx, gcsStore{storageClient}, bucketName, dir+pathSegment(tableID)+"/")
+		if err != nil {
+			return fail(fmt.Errorf("failed to list files of %s: %w", tableID, err))
+		}
+		for _, attrs := range objects {
+			name := strings.TrimPrefix(attrs.Name, dir)
+			if err := addToArchive(ctx, archive, storageClient.Bucket(bucketName).Object(attrs.Name).Generation(attrs.Generation), name, attrs); err != nil {
+				return fail(fmt.Errorf("failed to archive %s: %w", attrs.Name, err))
+			}
+			index.Tables[tableID] = append(index.Tables[tableID], bundledFile{Name: name, Size: attrs.Size})
+		}
+		bundled = append(bundled, objects...)
+	}
+
+	if len(previous.Tables) > 0 {
+		earlier, err := openBundle(ctx, storageClient, bucketName, projectID, date, datasetID)
+		if err != nil {
+			return fail(err)
+		}
+		for tableID, files := range previous.Tables {
+			if _, ok := index.Tables[tableID]; ok {
+				continue
+			}
+			for _, f := range files {
+				file, ok := earlier[f.Name]
+				if !ok {
+					return fail(fmt.Errorf("%s is missing from the earlier archive", f.Name))
+				}
+				if err := archive.Copy(file); err != nil {
+					return fail(fmt.Errorf("failed to carry over %s: %w", f.Name, err))
+				}
+			}
+			index.Tables[tableID] = files
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return fail(err)
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := writeJSONObject(ctx, gcsStore{storageClient}, bucketName, bundleIndexPath(projectID, date, datasetID), index); err != nil {
+		return err
+	}
+
+	for _, attrs := range bundled {
+		if err := storageClient.Bucket(bucketName).Object(attrs.Name).Generation(attrs.Generation).Delete(ctx); err != nil {
+			fmt.Printf("Failed to delete archived file %s: %v\n", attrs.Name, err)
+		}
+	}
+	return nil
+}
+
+func addToArchive(ctx context.Context, archive *zip.Writer, object *storage.ObjectHandle, name string, attrs *storage.ObjectAttrs) error {
+	reader, err := object.NewReader(ctx)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	w, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: attrs.Created})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+// openBundle reads the directory of a dataset's archive, by file name.
+// Files are read from the archive with ranged reads when they are opened.
+func openBundle(ctx context.Context, storageClient *storage.Client, bucketName, projectID, date, datasetID string) (map[string]*zip.File, error) {
+	object := storageClient.Bucket(bucketName).Object(bundlePath(projectID, date, datasetID))
+	attrs, err := object.Attrs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	archive, err := zip.NewReader(objectReaderAt{ctx: ctx, object: object.Generation(attrs.Generation)}, attrs.Size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	files := make(map[string]*zip.File, len(archive.File))
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+	return files, nil
+}
+
+// objectReaderAt reads ranges of an object.
+type objectReaderAt struct {
+	ctx    context.Context
+	object *storage.ObjectHandle
+}
+
+func (r objectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	reader, err := r.object.NewRangeReader(r.ctx, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	n, err := io.ReadFull(reader, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// archivedFiles returns the files of a table in the dataset's archive, in
+// the order of the index, or nil if the table isn't archived.
+func archivedFiles(ctx context.Context, storageClient *storage.Client, bucketName, projectID, date, datasetID, tableID string) ([]*zip.File, error) {
+	index, err := readBundleIndex(ctx, storageClient, bucketName, projectID, date, datasetID)
+	if err != nil {
+		return nil, err
+	}
+	files, ok := index.Tables[tableID]
+	if !ok {
+		return nil, nil
+	}
+	archive, err := openBundle(ctx, storageClient, bucketName, projectID, date, datasetID)
+	if err != nil {
+		return nil, err
+	}
+
+	var archived []*zip.File
+	for _, f := range files {
+		file, ok := archive[f.Name]
+		if !ok {
+			return nil, fmt.Errorf("%s is missing from the archive", f.Name)
+		}
+		archived = append(archived, file)
+	}
+	return archived, nil
+}
+
+// tableIDs returns the IDs of the tables in a dataset's archive.
+func (index bundleIndex) tableIDs() []string {
+	tables := make([]string, 0, len(index.Tables))
+	for tableID := range index.Tables {
+		tables = append(tables, tableID)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// size returns the number and total size of a table's archived files.
+func (index bundleIndex) size(tableID string) (int, int64) {
+	var size int64
+	for _, f := range index.Tables[tableID] {
+		size += f.Size
+	}
+	return len(index.Tables[tableID]), size
+}
@@ -0,0 +1,193 @@
+package bqbackup
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const catalogFileName = "catalog.jsonl"
+
+// catalogEntry records the outcome of one project's backup run. Entries are
+// appended to the catalog file as JSON Lines, one per project per run. Restore
+// rehearsals are recorded with Kind set to "rehearsal", and backups narrowed
+// to a dataset or table with Kind set to "adhoc", so readers that expect a
+// backup of the whole project skip them.
+type catalogEntry struct {
+	// SchemaVersion is catalogVersion for entries written by this build.
+	SchemaVersion int `json:"schema_version"`
+
+	RunID     string        `json:"run_id"`
+	Kind      string        `json:"kind,omitempty"`
+	Date      string        `json:"date"`
+	ProjectID string        `json:"project_id"`
+	Bucket    string        `json:"bucket,omitempty"`
+	Tenant    string        `json:"tenant,omitempty"`
+	Tags      []string      `json:"tags,omitempty"`
+	Started   time.Time     `json:"started"`
+	Finished  time.Time     `json:"finished"`
+	Tables    []tableResult `json:"tables"`
+	// Excluded are the datasets left out by --locations.
+	Excluded []string `json:"excluded_datasets,omitempty"`
+	// ConfigFingerprint and Identity are those of the run's provenance.
+	ConfigFingerprint string `json:"config_fingerprint,omitempty"`
+	Identity          string `json:"identity,omitempty"`
+	// Scope is what an adhoc backup was narrowed to.
+	Scope *backupScope `json:"scope,omitempty"`
+	// TimedOut marks the entry of a project still being backed up when
+	// --run-timeout ended the run. Its tables are those finished by then.
+	TimedOut bool `json:"timed_out,omitempty"`
+}
+
+const catalogKindAdhoc = "adhoc"
+
+// isBackup reports whether the entry records a backup, of the whole project
+// or adhoc.
+func (e catalogEntry) isBackup() bool {
+	return e.Kind == "" || e.Kind == catalogKindAdhoc
+}
+
+type tableResult struct {
+	DatasetID string `json:"dataset_id"`
+	TableID   string `json:"table_id"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+	// ErrorClass classifies failures, see classifyError.
+	ErrorClass string    `json:"error_class,omitempty"`
+	NumBytes   int64     `json:"num_bytes"`
+	NumRows    uint64    `json:"num_rows"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	MBPerSec   float64   `json:"mb_per_sec"`
+	BaseTable  string    `json:"base_table,omitempty"`
+	// SchemaChanges describes how the schema changed since the previous
+	// backup.
+	SchemaChanges []string `json:"schema_changes,omitempty"`
+
+	ExportedBytes int64 `json:"exported_bytes"`
+	ExportedFiles int   `json:"exported_files"`
+	// Readback is the outcome of the read-back probe, if it ran.
+	Readback *readbackResult `json:"readback,omitempty"`
+
+	// JobID and JobLocation identify the BigQuery job of a failed table's
+	// last attempt, if it got as far as starting one.
+	JobID       string `json:"job_id,omitempty"`
+	JobLocation string `json:"job_location,omitempty"`
+	// Attempts are the failed attempts at exporting the table, in order.
+	Attempts []failedAttempt `json:"attempts,omitempty"`
+	// Simulated marks a failure injected by --simulate-failures. The
+	// table was backed up as usual.
+	Simulated bool `json:"simulated,omitempty"`
+}
+
+// failed reports whether the table really failed, rather than with a
+// simulated failure.
+func (r tableResult) failed() bool {
+	return r.Status == statusFailed && !r.Simulated
+}
+
+func (r tableResult) duration() time.Duration {
+	return r.Finished.Sub(r.Started)
+}
+
+// statusLogEntry is a table outcome as written to JSON status logs.
+type statusLogEntry struct {
+	Date      string `json:"date"`
+	ProjectID string `json:"project_id"`
+	tableResult
+}
+
+func appendCatalogEntry(dir string, entry catalogEntry) error {
+	if dir == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, catalogFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entry.SchemaVersion = catalogVersion
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+func readCatalog(dir string) ([]catalogEntry, error) {
+	if dir == "" {
+		return nil, errors.New("no state directory configured")
+	}
+
+	file, err := os.Open(filepath.Join(dir, catalogFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []catalogEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		// Entries of older schema versions are upgraded as they are read.
+		line, _, err := migrateDocument(scanner.Bytes(), catalogVersion, catalogMigrations)
+		if err != nil {
+			return nil, err
+		}
+		var entry catalogEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (e catalogEntry) hasTag(tag string) bool {
+	for _, t := range e.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// latestTaggedEntry returns the most recent backup of projectID tagged with tag.
+func latestTaggedEntry(entries []catalogEntry, projectID, tag string) (catalogEntry, bool) {
+	var latest catalogEntry
+	found := false
+	for _, entry := range entries {
+		if !entry.isBackup() || entry.ProjectID != projectID || !entry.hasTag(tag) {
+			continue
+		}
+		if !found || entry.Started.After(latest.Started) {
+			latest, found = entry, true
+		}
+	}
+	return latest, found
+}
+
+// latestCatalogEntries returns the most recent entry per project for the given date.
+func latestCatalogEntries(entries []catalogEntry, date string) map[string]catalogEntry {
+	latest := make(map[string]catalogEntry)
+	for _, entry := range entries {
+		if entry.Kind != "" || entry.Date != date {
+			continue
+		}
+		if prev, ok := latest[entry.ProjectID]; !ok || entry.Started.After(prev.Started) {
+			latest[entry.ProjectID] = entry
+		}
+	}
+	return latest
+}
@@ -0,0 +1,37 @@
+package bqbackup
+
+import (
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+
+	"google.golang.org/api/googleapi"
+)
+
+// errSimulatedFailure looks like a transient BigQuery error, so simulated
+// failures are classified and reported like real ones.
+var errSimulatedFailure = &googleapi.Error{Code: http.StatusServiceUnavailable, Message: "simulated failure (--simulate-failures)"}
+
+// simulateFailure reports whether the current table should fail, for a run
+// that fails a fraction rate of its tables on purpose, with the hidden
+// --simulate-failures flag, to rehearse alerting and escalation.
+func simulateFailure(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+// hideFlags leaves flags out of the usage message of fs.
+func hideFlags(fs *flag.FlagSet, names ...string) {
+	fs.Usage = func() {
+		visible := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+		visible.SetOutput(fs.Output())
+		fs.VisitAll(func(f *flag.Flag) {
+			if !slices.Contains(names, f.Name) {
+				visible.Var(f.Value, f.Name, f.Usage)
+			}
+		})
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+		visible.PrintDefaults()
+	}
+}
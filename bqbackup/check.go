@@ -0,0 +1,110 @@
+package bqbackup
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+func runCheck(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	projectFile := fs.String("f", defaultProjectFile, "File containing list of project IDs")
+	projectList := fs.String("projects", "", "Comma-separated list of project IDs (instead of -f)")
+	maxAge := fs.Int("max-age", 26, "Maximum age in hours of the latest complete backup")
+	webhook := fs.String("webhook", "", "Discord webhook URL")
+	workspaceWebhook := fs.String("workspace", "", "Google Workspace Chat webhook URL")
+	stateDir := fs.String("state-dir", defaultStateDir, "Directory containing the catalog")
+	fs.Parse(args)
+
+	projects, err := resolveProjects(fs, *projectFile, *projectList)
+	if err != nil {
+		fmt.Printf("Failed to read projects: %v\n", err)
+		os.Exit(1)
+	}
+
+	entries, err := readCatalog(*stateDir)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Failed to read catalog: %v\n", err)
+		os.Exit(1)
+	}
+
+	now := time.Now()
+	cutoff := now.Add(-time.Duration(*maxAge) * time.Hour)
+	var stale []string
+	for _, projectID := range projects {
+		var lastComplete, lastRun *catalogEntry
+		for i := range entries {
+			entry := &entries[i]
+			if entry.Kind != "" || entry.ProjectID != projectID {
+				continue
+			}
+			if lastRun == nil || entry.Finished.After(lastRun.Finished) {
+				lastRun = entry
+			}
+			if isCompleteBackup(*entry) && (lastComplete == nil || entry.Finished.After(lastComplete.Finished)) {
+				lastComplete = entry
+			}
+		}
+
+		switch {
+		case lastComplete == nil && lastRun == nil:
+			stale = append(stale, fmt.Sprintf("%s: no backup recorded", projectID))
+		case lastComplete == nil:
+			stale = append(stale, fmt.Sprintf("%s: no complete backup, last run %s had %d failed tables",
+				projectID, lastRun.Finished.Format(time.RFC3339), countFailed(*lastRun)))
+		case lastComplete.Finished.Before(cutoff):
+			stale = append(stale, fmt.Sprintf("%s: last complete backup %s (%.0fh ago)",
+				projectID, lastComplete.Finished.Format(time.RFC3339), now.Sub(lastComplete.Finished).Hours()))
+		default:
+			fmt.Printf("OK %s: last complete backup %s\n", projectID, lastComplete.Finished.Format(time.RFC3339))
+		}
+	}
+
+	if len(stale) == 0 {
+		return
+	}
+
+	message := fmt.Sprintf("Stale BigQuery backups (no complete backup within %dh):\n", *maxAge)
+	for _, line := range stale {
+		message += fmt.Sprintf("* %s\n", line)
+	}
+	fmt.Print(message)
+
+	if *workspaceWebhook != "" {
+		sendWorkspaceMessage(context.Background(), *workspaceWebhook, message)
+	}
+	if *webhook != "" {
+		sendDiscordMessage(context.Background(), *webhook, "BigQuery Backup Check", message)
+	}
+	os.Exit(1)
+}
+
+// isCompleteBackup reports whether a run finished without failures and backed
+// up at least one table. A run whose listing failed, or whose scope was
+// empty, backed up nothing and doesn't count, nor does one that timed out.
+// Simulated failures were backed up as usual.
+func isCompleteBackup(entry catalogEntry) bool {
+	if entry.Finished.IsZero() || entry.TimedOut {
+		return false
+	}
+	succeeded := false
+	for _, t := range entry.Tables {
+		if t.failed() {
+			return false
+		}
+		succeeded = succeeded || t.Status == statusSuccess || t.Simulated
+	}
+	return succeeded
+}
+
+func countFailed(entry catalogEntry) int {
+	failed := 0
+	for _, t := range entry.Tables {
+		if t.Status == statusFailed {
+			failed++
+		}
+	}
+	return failed
+}
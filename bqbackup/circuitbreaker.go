@@ -0,0 +1,76 @@
+package bqbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// errCircuitOpen is the cause of the cancelled context of a project whose
+// circuit breaker tripped.
+var errCircuitOpen = errors.New("too many consecutive table failures")
+
+// circuitBreaker counts a project's consecutive table failures and cancels
+// the project once they reach the limit (0 disables). When credentials
+// expired or the bucket is gone every table is bound to fail, and grinding
+// through thousands of doomed jobs only delays the alert. Skipped tables don't break a run of
+// failures. A nil *circuitBreaker never trips.
+type circuitBreaker struct {
+	limit  int
+	cancel context.CancelCauseFunc
+
+	mu          sync.Mutex
+	consecutive int
+	lastReason  string
+	open        bool
+}
+
+func newCircuitBreaker(limit int, cancel context.CancelCauseFunc) *circuitBreaker {
+	if limit <= 0 {
+		return nil
+	}
+	return &circuitBreaker{limit: limit, cancel: cancel}
+}
+
+// record counts a table's outcome and trips the breaker on the limit'th
+// failure in a row.
+func (b *circuitBreaker) record(result tableResult) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Tables in flight when the breaker tripped fail as they are cancelled.
+	if b.open {
+		return
+	}
+	switch result.Status {
+	case statusFailed:
+		b.consecutive++
+		b.lastReason = result.Reason
+	case statusSuccess:
+		b.consecutive = 0
+	}
+	if b.consecutive >= b.limit {
+		b.open = true
+		b.cancel(errCircuitOpen)
+	}
+}
+
+// tripped reports whether the project was abandoned.
+func (b *circuitBreaker) tripped() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
+
+// note describes why the project was abandoned, for its notifications.
+func (b *circuitBreaker) note(notAttempted int) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return fmt.Sprintf("Project aborted after %d consecutive table failures, %d tables were not attempted. Last error: %s", b.consecutive, notAttempted, b.lastReason)
+}
@@ -0,0 +1,124 @@
+package bqbackup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	cleanupCursorFileName = "cleanup_cursor.json"
+	// cleanupCursorInterval is how many objects cleanup goes through between
+	// saving its cursor.
+	cleanupCursorInterval = 1000
+	// cleanupMaxRetries is how many rate limit or transient errors in a row
+	// cleanup waits out before it stops and leaves the rest to the next run.
+	cleanupMaxRetries = 8
+	cleanupMaxDelay   = time.Minute
+)
+
+// cleanupCursorKey identifies a project's cleanup in the cursor file.
+func cleanupCursorKey(bucketName, projectID string) string {
+	return bucketName + "/" + projectID
+}
+
+// readCleanupCursor returns the last object an interrupted cleanup of the
+// project went through, or "" to start from the beginning.
+func (b *backupRun) readCleanupCursor(bucketName, projectID string) string {
+	b.cursorMu.Lock()
+	defer b.cursorMu.Unlock()
+	cursors, err := readCleanupCursors(b.stateDir)
+	if err != nil {
+		fmt.Printf("Failed to read cleanup cursor, starting cleanup from the beginning: %v\n", err)
+	}
+	return cursors[cleanupCursorKey(bucketName, projectID)]
+}
+
+// saveCleanupCursor records how far cleanup of the project got; "" clears
+// the cursor once cleanup went through every object.
+func (b *backupRun) saveCleanupCursor(bucketName, projectID, name string) {
+	if b.stateDir == "" {
+		return
+	}
+	b.cursorMu.Lock()
+	defer b.cursorMu.Unlock()
+	cursors, err := readCleanupCursors(b.stateDir)
+	if err != nil {
+		fmt.Printf("Failed to read cleanup cursor: %v\n", err)
+		return
+	}
+	key := cleanupCursorKey(bucketName, projectID)
+	if cursors[key] == name {
+		return
+	}
+	if name == "" {
+		delete(cursors, key)
+	} else {
+		cursors[key] = name
+	}
+
+	data, err := json.MarshalIndent(cursors, "", "  ")
+	if err != nil {
+		fmt.Printf("Failed to save cleanup cursor: %v\n", err)
+		return
+	}
+	path := filepath.Join(b.stateDir, cleanupCursorFileName)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		fmt.Printf("Failed to save cleanup cursor: %v\n", err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		fmt.Printf("Failed to save cleanup cursor: %v\n", err)
+	}
+}
+
+func readCleanupCursors(stateDir string) (map[string]string, error) {
+	cursors := make(map[string]string)
+	if stateDir == "" {
+		return cursors, nil
+	}
+	data, err := os.ReadFile(filepath.Join(stateDir, cleanupCursorFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return cursors, nil
+	}
+	if err != nil {
+		return cursors, err
+	}
+	if err := json.Unmarshal(data, &cursors); err != nil {
+		return make(map[string]string), err
+	}
+	return cursors, nil
+}
+
+// cleanupBackoff waits out rate limits (429) and transient errors (5xx)
+// during cleanup, doubling the delay each time.
+type cleanupBackoff struct {
+	retries int
+}
+
+// wait sleeps before the next attempt after err, and reports false if err is
+// not worth retrying or too many attempts in a row failed.
+func (b *cleanupBackoff) wait(ctx context.Context, what string, err error) bool {
+	class := classifyError(err)
+	if (class != errorClassQuota && class != errorClassTransient) || b.retries >= cleanupMaxRetries {
+		return false
+	}
+	delay := min(time.Second<<b.retries, cleanupMaxDelay)
+	b.retries++
+	fmt.Printf("%s failed (%s, attempt %d of %d), retrying in %s: %v\n", what, class, b.retries, cleanupMaxRetries, delay, err)
+	select {
+	case <-time.After(delay):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// reset is called after every successful call.
+func (b *cleanupBackoff) reset() {
+	b.retries = 0
+}
@@ -0,0 +1,131 @@
+package bqbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/bigqueryconnection/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+const connectionsFileName = "connections.json"
+
+// connectionLocations are the locations connections are listed in besides
+// those of the backed up datasets, as a project's connections needn't be
+// where its datasets are. The Connection API has no way to list the
+// locations a project uses.
+var connectionLocations = []string{
+	"us", "eu",
+	"us-central1", "us-east1", "us-east4", "us-east5", "us-south1", "us-west1", "us-west2", "us-west3", "us-west4",
+	"northamerica-northeast1", "northamerica-northeast2", "southamerica-east1", "southamerica-west1",
+	"europe-central2", "europe-north1", "europe-southwest1", "europe-west1", "europe-west2", "europe-west3",
+	"europe-west4", "europe-west6", "europe-west8", "europe-west9", "europe-west10", "europe-west12",
+	"asia-east1", "asia-east2", "asia-northeast1", "asia-northeast2", "asia-northeast3", "asia-south1",
+	"asia-south2", "asia-southeast1", "asia-southeast2", "australia-southeast1", "australia-southeast2",
+	"me-central1", "me-central2", "me-west1", "africa-south1",
+	"aws-us-east-1", "aws-us-west-2", "aws-ap-northeast-2", "aws-eu-west-1", "azure-eastus2",
+}
+
+// connectionInventory is the connections.json of a project's backup.
+type connectionInventory struct {
+	Locations   []string                         `json:"locations"`
+	Connections []*bigqueryconnection.Connection `json:"connections"`
+}
+
+// writeConnections lists the project's connections, such as Cloud SQL,
+// Spanner, Cloud Resource and Omni (AWS, Azure) connections, in each of
+// connectionLocations and each location that has one of datasets, and writes
+// them without secrets to PROJECT/DATE/connections.json. Locations the
+// project can't use are left out of the inventory.
+func writeConnections(ctx context.Context, client *bigquery.Client, storageClient *storage.Client, bucketName, projectID, date string, datasets []string, opts ...option.ClientOption) error {
+	service, err := bigqueryconnection.NewService(ctx, opts...)
+	if err != nil {
+		return err
+	}
+
+	var inventory connectionInventory
+	for _, location := range mergeLocations(connectionLocations, datasetLocations(ctx, client, datasets)) {
+		parent := fmt.Sprintf("projects/%s/locations/%s", projectID, location)
+		var found []*bigqueryconnection.Connection
+		err := service.Projects.Locations.Connections.List(parent).Pages(ctx, func(resp *bigqueryconnection.ListConnectionsResponse) error {
+			found = append(found, resp.Connections...)
+			return nil
+		})
+		if isUnavailableLocation(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to list connections in %s: %w", location, err)
+		}
+		for _, c := range found {
+			redactConnection(c)
+		}
+		inventory.Locations = append(inventory.Locations, location)
+		inventory.Connections = append(inventory.Connections, found...)
+	}
+
+	return writeJSONObject(ctx, gcsStore{storageClient}, bucketName, backupPath(projectID, date)+"/"+connectionsFileName, inventory)
+}
+
+// datasetLocations returns the lowercased locations of datasets, as the
+// Connection API names them.
+func datasetLocations(ctx context.Context, client *bigquery.Client, datasets []string) []string {
+	seen := make(map[string]bool)
+	var locations []string
+	for _, datasetID := range datasets {
+		meta, err := client.Dataset(datasetID).Metadata(ctx)
+		if err != nil {
+			fmt.Printf("Failed to get location of dataset %s, its connections may be missed: %v\n", datasetID, err)
+			continue
+		}
+		location := strings.ToLower(meta.Location)
+		if !seen[location] {
+			seen[location] = true
+			locations = append(locations, location)
+		}
+	}
+	sort.Strings(locations)
+	return locations
+}
+
+// mergeLocations returns the sorted union of location lists.
+func mergeLocations(lists ...[]string) []string {
+	seen := make(map[string]bool)
+	var locations []string
+	for _, list := range lists {
+		for _, location := range list {
+			if !seen[location] {
+				seen[location] = true
+				locations = append(locations, location)
+			}
+		}
+	}
+	sort.Strings(locations)
+	return locations
+}
+
+// isUnavailableLocation reports whether listing connections failed because
+// the location doesn't exist or isn't enabled for the project.
+func isUnavailableLocation(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && (apiErr.Code == http.StatusBadRequest || apiErr.Code == http.StatusNotFound)
+}
+
+// redactConnection clears the passwords of a connection. The API doesn't
+// return them, but nothing that looks like a secret should end up in a
+// backup either.
+func redactConnection(c *bigqueryconnection.Connection) {
+	if c.CloudSql != nil && c.CloudSql.Credential != nil {
+		c.CloudSql.Credential.Password = ""
+	}
+	if c.Configuration != nil && c.Configuration.Authentication != nil && c.Configuration.Authentication.UsernamePassword != nil {
+		c.Configuration.Authentication.UsernamePassword.Password = nil
+	}
+}
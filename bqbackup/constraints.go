@@ -0,0 +1,152 @@
+package bqbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+)
+
+const constraintsFileSuffix = ".constraints.json"
+
+// tableConstraints are a table's declared primary and foreign keys, written
+// next to its schema for tables that have any.
+type tableConstraints struct {
+	PrimaryKey  []string     `json:"primary_key,omitempty"`
+	ForeignKeys []foreignKey `json:"foreign_keys,omitempty"`
+}
+
+type foreignKey struct {
+	Name              string            `json:"name,omitempty"`
+	ReferencedProject string            `json:"referenced_project"`
+	ReferencedDataset string            `json:"referenced_dataset"`
+	ReferencedTable   string            `json:"referenced_table"`
+	Columns           []columnReference `json:"columns"`
+}
+
+type columnReference struct {
+	Referencing string `json:"referencing"`
+	Referenced  string `json:"referenced"`
+}
+
+func constraintsPath(projectID, date, datasetID, tableID string) string {
+	return backupPath(projectID, date, datasetID, tableID) + constraintsFileSuffix
+}
+
+func newTableConstraints(tc *bigquery.TableConstraints) tableConstraints {
+	var c tableConstraints
+	if tc.PrimaryKey != nil {
+		c.PrimaryKey = tc.PrimaryKey.Columns
+	}
+	for _, fk := range tc.ForeignKeys {
+		key := foreignKey{Name: fk.Name}
+		if fk.ReferencedTable != nil {
+			key.ReferencedProject = fk.ReferencedTable.ProjectID
+			key.ReferencedDataset = fk.ReferencedTable.DatasetID
+			key.ReferencedTable = fk.ReferencedTable.TableID
+		}
+		for _, ref := range fk.ColumnReferences {
+			key.Columns = append(key.Columns, columnReference{Referencing: ref.ReferencingColumn, Referenced: ref.ReferencedColumn})
+		}
+		c.ForeignKeys = append(c.ForeignKeys, key)
+	}
+	return c
+}
+
+// writeTableConstraints writes a table's primary and foreign keys, if it has
+// any.
+func writeTableConstraints(ctx context.Context, store objectStore, bucketName, projectID, date, datasetID, tableID string, tc *bigquery.TableConstraints) error {
+	if tc == nil || (tc.PrimaryKey == nil && len(tc.ForeignKeys) == 0) {
+		return nil
+	}
+	return writeJSONObject(ctx, store, bucketName, constraintsPath(projectID, date, datasetID, tableID), newTableConstraints(tc))
+}
+
+// restoreConstraints reapplies the keys recorded in a backup to the restored
+// tables of dataset and returns the number of tables that failed. Primary
+// keys are set on every table first, as foreign keys refer to them. Foreign
+// keys to tables of the backed up dataset are pointed at the restored tables,
+// and left out if the referenced table is in neither tables nor dataset.
+func restoreConstraints(ctx context.Context, dataset *bigquery.Dataset, storageClient *storage.Client, bucketName, projectID, date, datasetID string, tables []string) int {
+	inTarget := make(map[string]bool, len(tables))
+	for _, t := range tables {
+		inTarget[t] = true
+	}
+	targetHas := func(t string) bool {
+		if has, ok := inTarget[t]; ok {
+			return has
+		}
+		_, err := dataset.Table(t).Metadata(ctx)
+		inTarget[t] = err == nil
+		return inTarget[t]
+	}
+
+	constraints := make(map[string]tableConstraints)
+	for _, t := range tables {
+		var c tableConstraints
+		err := readJSONObject(ctx, gcsStore{storageClient}, bucketName, constraintsPath(projectID, date, datasetID, t), &c)
+		if errors.Is(err, storage.ErrObjectNotExist) {
+			continue
+		}
+		if err != nil {
+			fmt.Printf("Failed to read keys of %s: %v\n", t, err)
+			continue
+		}
+		constraints[t] = c
+	}
+
+	failed := make(map[string]bool)
+	for _, withForeignKeys := range []bool{false, true} {
+		for _, t := range tables {
+			c, ok := constraints[t]
+			if !ok || failed[t] || (withForeignKeys && len(c.ForeignKeys) == 0) {
+				continue
+			}
+			tc := &bigquery.TableConstraints{}
+			if len(c.PrimaryKey) > 0 {
+				tc.PrimaryKey = &bigquery.PrimaryKey{Columns: c.PrimaryKey}
+			}
+			if withForeignKeys {
+				for _, fk := range c.ForeignKeys {
+					if fk.ReferencedProject == projectID && fk.ReferencedDataset == datasetID && !targetHas(fk.ReferencedTable) {
+						fmt.Printf("Skipping foreign key %s of %s.%s, %s.%s was not restored\n", fk.Name, dataset.DatasetID, t, dataset.DatasetID, fk.ReferencedTable)
+						continue
+					}
+					tc.ForeignKeys = append(tc.ForeignKeys, restoredForeignKey(dataset, projectID, datasetID, fk))
+				}
+				if len(tc.ForeignKeys) == 0 {
+					if tc.PrimaryKey != nil {
+						fmt.Printf("Restored keys of %s.%s\n", dataset.DatasetID, t)
+					}
+					continue
+				}
+			} else if tc.PrimaryKey == nil {
+				continue
+			}
+
+			if _, err := dataset.Table(t).Update(ctx, bigquery.TableMetadataToUpdate{TableConstraints: tc}, ""); err != nil {
+				fmt.Printf("Failed to restore keys of %s.%s: %v\n", dataset.DatasetID, t, err)
+				failed[t] = true
+				continue
+			}
+			if withForeignKeys || len(c.ForeignKeys) == 0 {
+				fmt.Printf("Restored keys of %s.%s\n", dataset.DatasetID, t)
+			}
+		}
+	}
+	return len(failed)
+}
+
+func restoredForeignKey(dataset *bigquery.Dataset, projectID, datasetID string, fk foreignKey) *bigquery.ForeignKey {
+	referenced := &bigquery.Table{ProjectID: fk.ReferencedProject, DatasetID: fk.ReferencedDataset, TableID: fk.ReferencedTable}
+	if fk.ReferencedProject == projectID && fk.ReferencedDataset == datasetID {
+		referenced = dataset.Table(fk.ReferencedTable)
+	}
+	key := &bigquery.ForeignKey{Name: fk.Name, ReferencedTable: referenced}
+	for _, ref := range fk.Columns {
+		key.ColumnReferences = append(key.ColumnReferences, &bigquery.ColumnReference{ReferencingColumn: ref.Referencing, ReferencedColumn: ref.Referenced})
+	}
+	return key
+}
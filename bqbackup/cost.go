@@ -0,0 +1,171 @@
+package bqbackup
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+const bytesPerGB = 1024 * 1024 * 1024
+
+// pricingTable holds the prices used to estimate what backups cost per month.
+// The defaults are GCS list prices in USD; --pricing overrides any of them.
+type pricingTable struct {
+	Currency string `json:"currency"`
+	// StorageGBMonth is the price per GB-month by GCS storage class.
+	StorageGBMonth map[string]float64 `json:"storage_gb_month"`
+	// TransferGB is the price per GB exported from a dataset to a bucket in
+	// another location.
+	TransferGB float64 `json:"transfer_gb"`
+	// BackupsPerMonth is how often each dataset is exported per month, used
+	// to project transfer from the size of its latest backup.
+	BackupsPerMonth int `json:"backups_per_month"`
+}
+
+var defaultPricing = pricingTable{
+	Currency: "USD",
+	StorageGBMonth: map[string]float64{
+		"STANDARD": 0.020,
+		"NEARLINE": 0.010,
+		"COLDLINE": 0.004,
+		"ARCHIVE":  0.0012,
+	},
+	TransferGB:      0.02,
+	BackupsPerMonth: 30,
+}
+
+// readPricing reads a pricing table from path on top of the defaults.
+func readPricing(path string) (pricingTable, error) {
+	pricing := defaultPricing
+	pricing.StorageGBMonth = make(map[string]float64)
+	for class, price := range defaultPricing.StorageGBMonth {
+		pricing.StorageGBMonth[class] = price
+	}
+	if path == "" {
+		return pricing, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return pricing, err
+	}
+	var overrides pricingTable
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return pricing, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if overrides.Currency != "" {
+		pricing.Currency = overrides.Currency
+	}
+	for class, price := range overrides.StorageGBMonth {
+		pricing.StorageGBMonth[strings.ToUpper(class)] = price
+	}
+	if overrides.TransferGB > 0 {
+		pricing.TransferGB = overrides.TransferGB
+	}
+	if overrides.BackupsPerMonth > 0 {
+		pricing.BackupsPerMonth = overrides.BackupsPerMonth
+	}
+	return pricing, nil
+}
+
+// datasetCost is the estimated monthly cost of one dataset's backups.
+type datasetCost struct {
+	ProjectID string
+	DatasetID string
+	Location  string
+	Bytes     int64
+	Storage   float64
+	Transfer  float64
+}
+
+func (c datasetCost) total() float64 {
+	return c.Storage + c.Transfer
+}
+
+// estimateCosts prices the storage of each dataset's backups by storage class,
+// plus the transfer of a month of exports when the dataset lives in another
+// location than the bucket. The dataset location is taken from the dataset.json
+// of its latest backup.
+func estimateCosts(ctx context.Context, storageClient *storage.Client, bucketName, bucketLocation string, u *projectUsage, pricing pricingTable) []datasetCost {
+	var costs []datasetCost
+	for _, datasetID := range sortedKeys(u.Datasets) {
+		c := datasetCost{ProjectID: u.ProjectID, DatasetID: datasetID, Bytes: u.Datasets[datasetID]}
+		for class, size := range u.DatasetClasses[datasetID] {
+			price, ok := pricing.StorageGBMonth[class]
+			if !ok {
+				price = pricing.StorageGBMonth["STANDARD"]
+			}
+			c.Storage += float64(size) / bytesPerGB * price
+		}
+
+		var settings datasetSettings
+		path := datasetMetadataPath(u.ProjectID, u.DatasetLatestDate[datasetID], datasetID)
+		if err := readJSONObject(ctx, gcsStore{storageClient}, bucketName, path, &settings); err != nil {
+			fmt.Printf("Failed to read location of dataset %s, transfer not estimated: %v\n", datasetID, err)
+		}
+		c.Location = settings.Location
+		if c.Location != "" && !sameLocation(c.Location, bucketLocation) {
+			monthly := float64(u.DatasetLatest[datasetID]) * float64(pricing.BackupsPerMonth)
+			c.Transfer = monthly / bytesPerGB * pricing.TransferGB
+		}
+		costs = append(costs, c)
+	}
+	return costs
+}
+
+// sameLocation reports whether exporting from a dataset in datasetLocation to
+// a bucket in bucketLocation stays within one location. A region counts as
+// part of the US and EU multi-regions.
+func sameLocation(datasetLocation, bucketLocation string) bool {
+	d, b := strings.ToLower(datasetLocation), strings.ToLower(bucketLocation)
+	switch {
+	case d == b:
+		return true
+	case b == "us":
+		return strings.HasPrefix(d, "us-")
+	case b == "eu":
+		return strings.HasPrefix(d, "europe-")
+	}
+	return false
+}
+
+func formatCosts(costs []datasetCost, pricing pricingTable) string {
+	var storageCost, transferCost float64
+	for _, c := range costs {
+		storageCost += c.Storage
+		transferCost += c.Transfer
+	}
+	report := fmt.Sprintf("* estimated monthly cost: %.2f %s (storage %.2f, transfer %.2f)\n",
+		storageCost+transferCost, pricing.Currency, storageCost, transferCost)
+	for _, c := range costs {
+		report += fmt.Sprintf("  %s: %.2f", c.DatasetID, c.total())
+		if c.Transfer > 0 {
+			report += fmt.Sprintf(" (storage %.2f, transfer %.2f from %s)", c.Storage, c.Transfer, c.Location)
+		}
+		report += "\n"
+	}
+	return report
+}
+
+// writeCostCSV writes one row per dataset for chargeback.
+func writeCostCSV(path string, costs []datasetCost, pricing pricingTable) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"project", "dataset", "location", "bytes", "storage_cost", "transfer_cost", "total_cost", "currency"})
+	for _, c := range costs {
+		writer.Write([]string{c.ProjectID, c.DatasetID, c.Location, fmt.Sprint(c.Bytes),
+			fmt.Sprintf("%.4f", c.Storage), fmt.Sprintf("%.4f", c.Transfer), fmt.Sprintf("%.4f", c.total()), pricing.Currency})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,88 @@
+package bqbackup
+
+import (
+	"fmt"
+	"sort"
+)
+
+// coverageGapLines caps the "Not covered" section of the summary, so an
+// allowlist that leaves out most tables doesn't flood the channel.
+const coverageGapLines = 10
+
+// excludedDataset is a dataset the run left out because of its location.
+type excludedDataset struct {
+	DatasetID string
+	Location  string
+	// New is set if the project's previous run did not exclude it, which
+	// usually means it was just created.
+	New bool
+}
+
+// markNewExclusions marks the excluded datasets that the project's latest
+// earlier run in the catalog did not exclude. Without an earlier run none
+// are marked.
+func markNewExclusions(stateDir string, excluded []excludedDataset, projectID string) []excludedDataset {
+	if len(excluded) == 0 {
+		return nil
+	}
+	entries, err := readCatalog(stateDir)
+	if err != nil {
+		return excluded
+	}
+	var previous *catalogEntry
+	for i, entry := range entries {
+		if entry.Kind != "" || entry.ProjectID != projectID {
+			continue
+		}
+		if previous == nil || entry.Started.After(previous.Started) {
+			previous = &entries[i]
+		}
+	}
+	if previous == nil {
+		return excluded
+	}
+
+	known := make(map[string]bool, len(previous.Excluded))
+	for _, datasetID := range previous.Excluded {
+		known[datasetID] = true
+	}
+	for i := range excluded {
+		excluded[i].New = !known[excluded[i].DatasetID]
+	}
+	return excluded
+}
+
+func datasetIDs(excluded []excludedDataset) []string {
+	var ids []string
+	for _, d := range excluded {
+		ids = append(ids, d.DatasetID)
+	}
+	return ids
+}
+
+// formatCoverageGaps lists what a project's run did not back up: datasets
+// outside --locations, new ones first, and skipped tables.
+func formatCoverageGaps(excluded []excludedDataset, results []tableResult) []string {
+	sorted := append([]excludedDataset(nil), excluded...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].New && !sorted[j].New })
+
+	var lines []string
+	for _, d := range sorted {
+		line := fmt.Sprintf("* %s - dataset in %s, outside --locations", d.DatasetID, d.Location)
+		if d.New {
+			line += " (new)"
+		}
+		lines = append(lines, line)
+	}
+	for _, r := range results {
+		if r.Status == statusSkipped {
+			lines = append(lines, fmt.Sprintf("* %s.%s - %s", r.DatasetID, r.TableID, r.Reason))
+		}
+	}
+
+	if len(lines) > coverageGapLines {
+		more := len(lines) - coverageGapLines + 1
+		lines = append(lines[:coverageGapLines-1], fmt.Sprintf("* and %d more", more))
+	}
+	return lines
+}
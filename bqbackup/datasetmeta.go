@@ -0,0 +1,100 @@
+package bqbackup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+)
+
+const datasetMetadataFileName = "dataset.json"
+
+// datasetSettings are the dataset-level defaults captured with each backup
+// and reapplied when a restore has to create the dataset.
+type datasetSettings struct {
+	DatasetID                    string            `json:"dataset_id"`
+	FriendlyName                 string            `json:"friendly_name,omitempty"`
+	Description                  string            `json:"description,omitempty"`
+	Location                     string            `json:"location,omitempty"`
+	DefaultTableExpirationMs     int64             `json:"default_table_expiration_ms,omitempty"`
+	DefaultPartitionExpirationMs int64             `json:"default_partition_expiration_ms,omitempty"`
+	DefaultCollation             string            `json:"default_collation,omitempty"`
+	KMSKeyName                   string            `json:"kms_key_name,omitempty"`
+	MaxTimeTravelHours           int64             `json:"max_time_travel_hours,omitempty"`
+	StorageBillingModel          string            `json:"storage_billing_model,omitempty"`
+	Labels                       map[string]string `json:"labels,omitempty"`
+}
+
+func newDatasetSettings(datasetID string, meta *bigquery.DatasetMetadata) datasetSettings {
+	settings := datasetSettings{
+		DatasetID:                    datasetID,
+		FriendlyName:                 meta.Name,
+		Description:                  meta.Description,
+		Location:                     meta.Location,
+		DefaultTableExpirationMs:     meta.DefaultTableExpiration.Milliseconds(),
+		DefaultPartitionExpirationMs: meta.DefaultPartitionExpiration.Milliseconds(),
+		DefaultCollation:             meta.DefaultCollation,
+		MaxTimeTravelHours:           int64(meta.MaxTimeTravel / time.Hour),
+		StorageBillingModel:          meta.StorageBillingModel,
+		Labels:                       meta.Labels,
+	}
+	if meta.DefaultEncryptionConfig != nil {
+		settings.KMSKeyName = meta.DefaultEncryptionConfig.KMSKeyName
+	}
+	return settings
+}
+
+func (s datasetSettings) metadata() *bigquery.DatasetMetadata {
+	meta := &bigquery.DatasetMetadata{
+		Name:                       s.FriendlyName,
+		Description:                s.Description,
+		Location:                   s.Location,
+		DefaultTableExpiration:     time.Duration(s.DefaultTableExpirationMs) * time.Millisecond,
+		DefaultPartitionExpiration: time.Duration(s.DefaultPartitionExpirationMs) * time.Millisecond,
+		DefaultCollation:           s.DefaultCollation,
+		MaxTimeTravel:              time.Duration(s.MaxTimeTravelHours) * time.Hour,
+		StorageBillingModel:        s.StorageBillingModel,
+		Labels:                     s.Labels,
+	}
+	if s.KMSKeyName != "" {
+		meta.DefaultEncryptionConfig = &bigquery.EncryptionConfig{KMSKeyName: s.KMSKeyName}
+	}
+	return meta
+}
+
+func datasetMetadataPath(projectID, date, datasetID string) string {
+	return backupPath(projectID, date, datasetID) + "/" + datasetMetadataFileName
+}
+
+func writeDatasetMetadata(ctx context.Context, dataset *bigquery.Dataset, store objectStore, bucketName, projectID, date string) error {
+	meta, err := dataset.Metadata(ctx)
+	if err != nil {
+		return err
+	}
+	settings := newDatasetSettings(dataset.DatasetID, meta)
+	return writeJSONObject(ctx, store, bucketName, datasetMetadataPath(projectID, date, dataset.DatasetID), settings)
+}
+
+// ensureDataset creates target from the backed up dataset settings if it does
+// not exist yet.
+func ensureDataset(ctx context.Context, target *bigquery.Dataset, storageClient *storage.Client, bucketName, projectID, date, datasetID string) error {
+	_, err := target.Metadata(ctx)
+	if err == nil {
+		return nil
+	}
+	if !isNotFound(err) {
+		return err
+	}
+
+	var settings datasetSettings
+	if err := readJSONObject(ctx, gcsStore{storageClient}, bucketName, datasetMetadataPath(projectID, date, datasetID), &settings); err != nil {
+		return fmt.Errorf("failed to read dataset settings: %w", err)
+	}
+	if err := target.Create(ctx, settings.metadata()); err != nil {
+		return fmt.Errorf("failed to create dataset: %w", err)
+	}
+	fmt.Printf("Created dataset %s with the settings of %s from %s\n", target.DatasetID, datasetID, date)
+	return nil
+}
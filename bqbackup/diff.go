@@ -0,0 +1,159 @@
+package bqbackup
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type runDiff struct {
+	ProjectID     string
+	Appeared      []string
+	Disappeared   []string
+	SizeChanged   []string
+	NewlyFailing  []string
+	MissingBefore bool
+	MissingAfter  bool
+}
+
+func runDiffRuns(args []string) {
+	fs := flag.NewFlagSet("diff-runs", flag.ExitOnError)
+	to := fs.String("to", time.Now().Format("2006-01-02"), "Date of the run to compare (YYYY-MM-DD)")
+	from := fs.String("from", "", "Date of the run to compare against (defaults to the day before --to)")
+	sizeChange := fs.Float64("size-change", 50, "Report tables whose size changed by more than this percentage")
+	webhook := fs.String("webhook", "", "Discord webhook URL")
+	workspaceWebhook := fs.String("workspace", "", "Google Workspace Chat webhook URL")
+	stateDir := fs.String("state-dir", defaultStateDir, "Directory containing the catalog")
+	fs.Parse(args)
+
+	toDate, err := time.Parse("2006-01-02", *to)
+	if err != nil {
+		fmt.Printf("Invalid --to date: %v\n", err)
+		os.Exit(1)
+	}
+	if *from == "" {
+		*from = toDate.AddDate(0, 0, -1).Format("2006-01-02")
+	}
+
+	entries, err := readCatalog(*stateDir)
+	if err != nil {
+		fmt.Printf("Failed to read catalog: %v\n", err)
+		os.Exit(1)
+	}
+
+	before := latestCatalogEntries(entries, *from)
+	after := latestCatalogEntries(entries, *to)
+
+	var projects []string
+	seen := make(map[string]bool)
+	for _, m := range []map[string]catalogEntry{before, after} {
+		for projectID := range m {
+			if !seen[projectID] {
+				seen[projectID] = true
+				projects = append(projects, projectID)
+			}
+		}
+	}
+	sort.Strings(projects)
+
+	if len(projects) == 0 {
+		fmt.Printf("No catalog entries found for %s or %s\n", *from, *to)
+		return
+	}
+
+	report := fmt.Sprintf("Backup run diff %s -> %s\n", *from, *to)
+	for _, projectID := range projects {
+		prev, okPrev := before[projectID]
+		cur, okCur := after[projectID]
+		d := runDiff{MissingBefore: !okPrev, MissingAfter: !okCur}
+		if okPrev && okCur {
+			d = diffCatalogEntries(prev, cur, *sizeChange)
+		}
+		d.ProjectID = projectID
+		report += formatRunDiff(d)
+	}
+
+	fmt.Print(report)
+
+	if *workspaceWebhook != "" {
+		sendWorkspaceMessage(context.Background(), *workspaceWebhook, report)
+	}
+	if *webhook != "" {
+		sendDiscordMessage(context.Background(), *webhook, "BigQuery Backup Run Diff", report)
+	}
+}
+
+func diffCatalogEntries(prev, cur catalogEntry, sizeChangePercent float64) runDiff {
+	var d runDiff
+
+	prevTables := make(map[string]tableResult)
+	for _, t := range prev.Tables {
+		prevTables[t.DatasetID+"."+t.TableID] = t
+	}
+	curTables := make(map[string]tableResult)
+	for _, t := range cur.Tables {
+		curTables[t.DatasetID+"."+t.TableID] = t
+	}
+
+	for name, t := range curTables {
+		p, ok := prevTables[name]
+		if !ok {
+			d.Appeared = append(d.Appeared, name)
+			continue
+		}
+		if t.Status == statusFailed && p.Status != statusFailed {
+			d.NewlyFailing = append(d.NewlyFailing, fmt.Sprintf("%s: [%s] %s", name, t.ErrorClass, t.Reason))
+		}
+		if p.NumBytes > 0 {
+			change := float64(t.NumBytes-p.NumBytes) / float64(p.NumBytes) * 100
+			if change > sizeChangePercent || change < -sizeChangePercent {
+				d.SizeChanged = append(d.SizeChanged, fmt.Sprintf("%s: %d -> %d bytes (%+.0f%%)", name, p.NumBytes, t.NumBytes, change))
+			}
+		}
+	}
+	for name := range prevTables {
+		if _, ok := curTables[name]; !ok {
+			d.Disappeared = append(d.Disappeared, name)
+		}
+	}
+
+	sort.Strings(d.Appeared)
+	sort.Strings(d.Disappeared)
+	sort.Strings(d.SizeChanged)
+	sort.Strings(d.NewlyFailing)
+	return d
+}
+
+func formatRunDiff(d runDiff) string {
+	report := fmt.Sprintf("\nProject : %s\n", d.ProjectID)
+	if d.MissingBefore {
+		return report + "* no earlier run to compare against\n"
+	}
+	if d.MissingAfter {
+		return report + "* no run found for the compared date\n"
+	}
+	if len(d.Appeared)+len(d.Disappeared)+len(d.SizeChanged)+len(d.NewlyFailing) == 0 {
+		return report + "* no changes\n"
+	}
+
+	sections := []struct {
+		title string
+		lines []string
+	}{
+		{"Newly failing", d.NewlyFailing},
+		{"New tables", d.Appeared},
+		{"Disappeared tables", d.Disappeared},
+		{"Size changes", d.SizeChanged},
+	}
+	for _, section := range sections {
+		if len(section.lines) == 0 {
+			continue
+		}
+		report += fmt.Sprintf("* %s (%d):\n  %s\n", section.title, len(section.lines), strings.Join(section.lines, "\n  "))
+	}
+	return report
+}
@@ -0,0 +1,156 @@
+package bqbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+// Failure classes recorded with failed tables.
+const (
+	errorClassPermission = "permission"
+	errorClassQuota      = "quota"
+	errorClassNotFound   = "not-found"
+	errorClassSchema     = "schema-incompatible"
+	errorClassTimeout    = "timeout"
+	errorClassTransient  = "transient"
+	errorClassValidation = "validation"
+	errorClassUnknown    = "unknown"
+)
+
+// errExportVerification is returned when the files of an export don't match
+// what the extract job reported.
+var errExportVerification = errors.New("export verification failed")
+
+func classifyError(err error) string {
+	if err == nil {
+		return ""
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errorClassTimeout
+	}
+	if errors.Is(err, errExportVerification) {
+		return errorClassValidation
+	}
+
+	var bqErr *bigquery.Error
+	if errors.As(err, &bqErr) {
+		if class := classifyReason(bqErr.Reason, bqErr.Message); class != "" {
+			return class
+		}
+	}
+
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		for _, item := range apiErr.Errors {
+			if class := classifyReason(item.Reason, item.Message); class != "" {
+				return class
+			}
+		}
+		switch {
+		case apiErr.Code == http.StatusForbidden || apiErr.Code == http.StatusUnauthorized:
+			return errorClassPermission
+		case apiErr.Code == http.StatusNotFound:
+			return errorClassNotFound
+		case apiErr.Code == http.StatusTooManyRequests:
+			return errorClassQuota
+		case apiErr.Code >= 500:
+			return errorClassTransient
+		}
+	}
+
+	return errorClassUnknown
+}
+
+func classifyReason(reason, message string) string {
+	switch reason {
+	case "accessDenied", "forbidden", "authError":
+		return errorClassPermission
+	case "quotaExceeded", "rateLimitExceeded", "resourcesExceeded":
+		return errorClassQuota
+	case "notFound":
+		return errorClassNotFound
+	case "timeout", "stopped":
+		return errorClassTimeout
+	case "backendError", "internalError", "jobBackendError", "jobInternalError":
+		return errorClassTransient
+	case "invalid", "invalidQuery":
+		lower := strings.ToLower(message)
+		if strings.Contains(lower, "schema") || strings.Contains(lower, "incompatible") || strings.Contains(lower, "unsupported") {
+			return errorClassSchema
+		}
+	}
+	return ""
+}
+
+const defaultMaxAttempts = 3
+
+func isTransient(err error) bool {
+	return classifyError(err) == errorClassTransient
+}
+
+// retryTransient runs fn until it succeeds, fails with a non-transient error
+// or it was tried attempts times, backing off between attempts.
+func retryTransient(ctx context.Context, attempts int, what string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= attempts || !isTransient(err) {
+			return err
+		}
+		delay := time.Duration(1<<(attempt-1)) * 10 * time.Second
+		fmt.Printf("%s failed with a transient error (attempt %d of %d), retrying in %s: %v\n", what, attempt, attempts, delay, err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// fail marks the result as failed, recording the error and its class.
+func (r *tableResult) fail(reason string, err error) {
+	r.Status = statusFailed
+	r.Reason = fmt.Sprintf("%s: %v", reason, err)
+	r.ErrorClass = classifyError(err)
+	var jobErr *jobError
+	if errors.As(err, &jobErr) {
+		r.JobID, r.JobLocation = jobErr.jobID, jobErr.location
+	}
+}
+
+// formatFailureClasses summarises failures by class, most frequent first.
+func formatFailureClasses(results []tableResult) string {
+	counts := make(map[string]int)
+	for _, r := range results {
+		if r.Status == statusFailed {
+			counts[r.ErrorClass]++
+		}
+	}
+	if len(counts) == 0 {
+		return ""
+	}
+
+	classes := make([]string, 0, len(counts))
+	for class := range counts {
+		classes = append(classes, class)
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		if counts[classes[i]] != counts[classes[j]] {
+			return counts[classes[i]] > counts[classes[j]]
+		}
+		return classes[i] < classes[j]
+	})
+
+	parts := make([]string, 0, len(classes))
+	for _, class := range classes {
+		parts = append(parts, fmt.Sprintf("%s %d", class, counts[class]))
+	}
+	return strings.Join(parts, ", ")
+}
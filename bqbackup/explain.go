@@ -0,0 +1,320 @@
+package bqbackup
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+)
+
+// explainRecentRuns is how many of the table's runs explain-failure lists.
+const explainRecentRuns = 5
+
+// jobError is the error of a BigQuery job, carrying the job's reference so
+// the job can be looked up when the failure is investigated.
+type jobError struct {
+	jobID    string
+	location string
+	err      error
+}
+
+func (e *jobError) Error() string { return e.err.Error() }
+func (e *jobError) Unwrap() error { return e.err }
+
+// withJob attaches job to err, if there is an error.
+func withJob(job *bigquery.Job, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &jobError{jobID: job.ID(), location: job.Location(), err: err}
+}
+
+// failedAttempt is one failed attempt at exporting a table.
+type failedAttempt struct {
+	Time       time.Time `json:"time"`
+	Error      string    `json:"error"`
+	ErrorClass string    `json:"error_class"`
+	JobID      string    `json:"job_id,omitempty"`
+}
+
+// recordAttempt adds a failed attempt to the table's history.
+func (r *tableResult) recordAttempt(err error) {
+	attempt := failedAttempt{Time: time.Now(), Error: err.Error(), ErrorClass: classifyError(err)}
+	var jobErr *jobError
+	if errors.As(err, &jobErr) {
+		attempt.JobID = jobErr.jobID
+	}
+	r.Attempts = append(r.Attempts, attempt)
+}
+
+// errorClassHints suggest where to look for each class of failure.
+var errorClassHints = map[string]string{
+	errorClassPermission: "The run's identity lacks access to the table, its dataset or the bucket. Check its IAM roles.",
+	errorClassQuota:      "A BigQuery or Cloud Storage quota ran out. Retry later, or run fewer jobs at once, e.g. with --autotune-workers.",
+	errorClassNotFound:   "The table, its dataset or the bucket was deleted or renamed while the run was going.",
+	errorClassSchema:     "The table can't be exported in its format. Export it in another one with a rule under exports in the config.",
+	errorClassTimeout:    "A job ran past its deadline, such as --materialize-timeout, or the run was shut down.",
+	errorClassTransient:  "A backend error persisted through every retry. It usually passes by the next run.",
+	errorClassValidation: "The exported files or the read-back row count didn't match what BigQuery reported.",
+	errorClassUnknown:    "The error could not be classified, the details below are all there is.",
+}
+
+// runExplainFailure pulls together everything known about a table's failure
+// in a run: the recorded error and its class, each failed attempt, the
+// BigQuery job as it is now, the run's manifest and files, and how the table
+// fared in the project's other runs.
+func runExplainFailure(args []string) {
+	fs := flag.NewFlagSet("explain-failure", flag.ExitOnError)
+	run := fs.String("run", "", "Run ID, as printed by list")
+	table := fs.String("table", "", "Failed table, as DATASET.TABLE")
+	projectID := fs.String("project", "", "Project of the table (needed if the run backed up several projects with the table, or isn't in the catalog)")
+	bucketName := fs.String("bucket", "", "GCS bucket of the backup, to look at its manifest and files and at runs missing from the catalog")
+	stateDir := fs.String("state-dir", defaultStateDir, "Directory containing the catalog")
+	fs.Parse(args)
+
+	datasetID, tableID, ok := strings.Cut(*table, ".")
+	if *run == "" || !ok {
+		fmt.Println("Usage: bq-backup explain-failure --run=RUN_ID --table=DATASET.TABLE [--project=PROJECT_ID] [--bucket=BUCKET_NAME]")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	var storageClient *storage.Client
+	if *bucketName != "" {
+		var err error
+		if storageClient, err = storage.NewClient(ctx); err != nil {
+			fmt.Printf("Failed to create Storage client: %v\n", err)
+			os.Exit(1)
+		}
+		defer storageClient.Close()
+	}
+
+	entries, err := readCatalog(*stateDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("Failed to read catalog: %v\n", err)
+	}
+	var runs []catalogEntry
+	for _, entry := range entries {
+		if entry.isBackup() && entry.RunID == *run && (*projectID == "" || entry.ProjectID == *projectID) && hasTableResult(entry.Tables, datasetID, tableID) {
+			runs = append(runs, entry)
+		}
+	}
+	if len(runs) == 0 && storageClient != nil && *projectID != "" {
+		entry, err := runFromManifests(ctx, storageClient, *bucketName, *projectID, *run)
+		if err != nil {
+			fmt.Printf("Failed to read the manifests of run %s: %v\n", *run, err)
+			os.Exit(1)
+		}
+		if entry != nil && hasTableResult(entry.Tables, datasetID, tableID) {
+			fmt.Println("Run not in the catalog, read from its manifest")
+			runs = append(runs, *entry)
+		}
+	}
+	switch {
+	case len(runs) == 0:
+		fmt.Printf("No result of %s in run %s, check the run ID with list\n", *table, *run)
+		os.Exit(1)
+	case len(runs) > 1:
+		fmt.Printf("Run %s backed up %s in several projects, pick one with --project\n", *run, *table)
+		os.Exit(1)
+	}
+	entry := runs[0]
+	var result tableResult
+	for _, r := range entry.Tables {
+		if r.DatasetID == datasetID && r.TableID == tableID {
+			result = r
+		}
+	}
+
+	fmt.Printf("Table   : %s.%s.%s\n", entry.ProjectID, datasetID, tableID)
+	fmt.Printf("Run     : %s, %s, started %s\n", entry.RunID, entry.Date, entry.Started.Format(time.RFC3339))
+	if entry.Identity != "" {
+		fmt.Printf("Identity: %s\n", entry.Identity)
+	}
+	fmt.Printf("Status  : %s %s\n", result.Status, result.Reason)
+	if result.Status != statusFailed {
+		fmt.Println("The table did not fail in this run")
+	} else {
+		fmt.Printf("Class   : %s\n", result.ErrorClass)
+		if hint := errorClassHints[result.ErrorClass]; hint != "" {
+			fmt.Printf("          %s\n", hint)
+		}
+	}
+
+	if len(result.Attempts) > 0 {
+		fmt.Printf("\nFailed attempts (%d):\n", len(result.Attempts))
+		for i, a := range result.Attempts {
+			line := fmt.Sprintf("* %d. %s [%s] %s", i+1, a.Time.Format(time.RFC3339), a.ErrorClass, a.Error)
+			if a.JobID != "" {
+				line += " (job " + a.JobID + ")"
+			}
+			fmt.Println(line)
+		}
+	}
+
+	if result.JobID != "" {
+		fmt.Printf("\nJob %s in %s:\n", result.JobID, result.JobLocation)
+		for _, line := range describeJob(ctx, entry.ProjectID, result.JobID, result.JobLocation) {
+			fmt.Println(line)
+		}
+	}
+
+	if storageClient != nil {
+		fmt.Println("\nBucket:")
+		for _, line := range describeBackedUpTable(ctx, storageClient, *bucketName, entry, datasetID, tableID) {
+			fmt.Println(line)
+		}
+	}
+
+	fmt.Printf("\nRecent runs of %s:\n", *table)
+	for _, line := range recentTableResults(entries, entry.ProjectID, datasetID, tableID) {
+		fmt.Println(line)
+	}
+}
+
+func hasTableResult(results []tableResult, datasetID, tableID string) bool {
+	for _, r := range results {
+		if r.DatasetID == datasetID && r.TableID == tableID {
+			return true
+		}
+	}
+	return false
+}
+
+// runFromManifests finds a run that isn't in the catalog by its manifest. Run
+// IDs start with the UTC date, and backups are stored under the local one,
+// which may be a day off.
+func runFromManifests(ctx context.Context, storageClient *storage.Client, bucketName, projectID, run string) (*catalogEntry, error) {
+	started, err := time.Parse("20060102", strings.SplitN(run, "t", 2)[0])
+	if err != nil {
+		return nil, nil
+	}
+	for _, day := range []time.Time{started, started.AddDate(0, 0, -1), started.AddDate(0, 0, 1)} {
+		m, err := findManifest(ctx, storageClient, bucketName, projectID, day.Format("2006-01-02"), run)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			entry := catalogEntry{RunID: m.RunID, Date: m.Date, ProjectID: m.ProjectID, Started: m.Started, Finished: m.Finished, Tables: m.TableResults}
+			if m.Provenance != nil {
+				entry.Identity = m.Provenance.Identity
+			}
+			return &entry, nil
+		}
+	}
+	return nil, nil
+}
+
+// findManifest returns the manifest of a run on date, or nil if it has none.
+func findManifest(ctx context.Context, storageClient *storage.Client, bucketName, projectID, date, run string) (*backupManifest, error) {
+	names, err := listManifests(ctx, storageClient, bucketName, backupPath(projectID, date)+"/")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		m, err := readManifest(ctx, storageClient, bucketName, name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if m.RunID == run {
+			return &m, nil
+		}
+	}
+	return nil, nil
+}
+
+// describeJob fetches a BigQuery job as it is now.
+func describeJob(ctx context.Context, projectID, jobID, location string) []string {
+	client, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		return []string{fmt.Sprintf("* Failed to create BigQuery client: %v", err)}
+	}
+	defer client.Close()
+
+	job, err := client.JobFromIDLocation(ctx, jobID, location)
+	if err != nil {
+		return []string{fmt.Sprintf("* Failed to look up the job: %v", err)}
+	}
+	status := job.LastStatus()
+	lines := []string{fmt.Sprintf("* Started by %s", job.Email())}
+	if stats := status.Statistics; stats != nil {
+		line := fmt.Sprintf("* Created %s", stats.CreationTime.Format(time.RFC3339))
+		if !stats.StartTime.IsZero() && !stats.EndTime.IsZero() {
+			line += fmt.Sprintf(", ran %s", stats.EndTime.Sub(stats.StartTime).Round(time.Second))
+		}
+		lines = append(lines, line)
+	}
+	if status.Err() != nil {
+		lines = append(lines, fmt.Sprintf("* Error: %v", status.Err()))
+	}
+	for _, e := range status.Errors {
+		lines = append(lines, fmt.Sprintf("* %s at %s: %s", e.Reason, e.Location, e.Message))
+	}
+	return lines
+}
+
+// describeBackedUpTable describes the run's manifest and the table's files in
+// the bucket.
+func describeBackedUpTable(ctx context.Context, storageClient *storage.Client, bucketName string, entry catalogEntry, datasetID, tableID string) []string {
+	var lines []string
+	m, err := findManifest(ctx, storageClient, bucketName, entry.ProjectID, entry.Date, entry.RunID)
+	switch {
+	case err != nil:
+		lines = append(lines, fmt.Sprintf("* Failed to read the manifests of %s: %v", entry.Date, err))
+	case m == nil:
+		lines = append(lines, "* The run has no manifest, it was interrupted or aborted before it completed")
+	default:
+		lines = append(lines, fmt.Sprintf("* Manifest: complete %t, %d tables, %d succeeded, %d failed, %d skipped", m.Complete, m.Tables, m.Succeeded, m.Failed, m.Skipped))
+		for _, r := range m.TableResults {
+			if r.DatasetID == datasetID && r.TableID == tableID {
+				lines = append(lines, fmt.Sprintf("* Manifest entry: %s %s", r.Status, r.Reason))
+			}
+		}
+	}
+
+	objects, err := listObjects(ctx, gcsStore{storageClient}, bucketName, backupPath(entry.ProjectID, entry.Date, datasetID, tableID)+"/")
+	if err != nil {
+		return append(lines, fmt.Sprintf("* Failed to list the table's files: %v", err))
+	}
+	var size int64
+	for _, attrs := range objects {
+		size += attrs.Size
+	}
+	if len(objects) == 0 {
+		return append(lines, fmt.Sprintf("* No files of the table under %s", backupPath(entry.ProjectID, entry.Date, datasetID, tableID)))
+	}
+	// Another run on the same day may have written them.
+	return append(lines, fmt.Sprintf("* %d files of the table (%s) under %s", len(objects), formatBytes(size), backupPath(entry.ProjectID, entry.Date, datasetID, tableID)))
+}
+
+// recentTableResults lists the table's results in the project's latest runs
+// in the catalog, to tell a one-off from a persistent failure.
+func recentTableResults(entries []catalogEntry, projectID, datasetID, tableID string) []string {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Started.After(entries[j].Started) })
+	var lines []string
+	for _, entry := range entries {
+		if !entry.isBackup() || entry.ProjectID != projectID {
+			continue
+		}
+		for _, r := range entry.Tables {
+			if r.DatasetID == datasetID && r.TableID == tableID {
+				lines = append(lines, fmt.Sprintf("* %s %s run %s %s", r.Status, entry.Date, entry.RunID, r.Reason))
+			}
+		}
+		if len(lines) == explainRecentRuns {
+			break
+		}
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "* none in the catalog")
+	}
+	return lines
+}
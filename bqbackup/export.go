@@ -0,0 +1,342 @@
+package bqbackup
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// exportFormat is a file format tables can be exported in.
+type exportFormat struct {
+	name      string
+	format    bigquery.DataFormat
+	extension string
+}
+
+var (
+	avroFormat    = exportFormat{name: "avro", format: bigquery.Avro, extension: "avro"}
+	parquetFormat = exportFormat{name: "parquet", format: bigquery.Parquet, extension: "parquet"}
+)
+
+var exportFormats = []exportFormat{avroFormat, parquetFormat}
+
+func parseExportFormat(name string) (exportFormat, error) {
+	for _, f := range exportFormats {
+		if f.name == name {
+			return f, nil
+		}
+	}
+	return exportFormat{}, fmt.Errorf("%q, expected avro or parquet", name)
+}
+
+// ExportRule overrides the format and compression of the tables it matches,
+// e.g. Parquet for datasets read by analytics engines while raw data stays
+// in Avro. Project, Dataset and Table are path.Match patterns, and an empty
+// pattern matches everything. The first matching rule applies.
+type ExportRule struct {
+	Project string `json:"project,omitempty"`
+	Dataset string `json:"dataset,omitempty"`
+	Table   string `json:"table,omitempty"`
+	// Format is avro or parquet, and defaults to --format.
+	Format string `json:"format,omitempty"`
+	// Compression is none (the default), deflate or snappy for Avro, and
+	// none, snappy, gzip or zstd for Parquet.
+	Compression string `json:"compression,omitempty"`
+}
+
+// exportSettings is how a table is exported.
+type exportSettings struct {
+	format      exportFormat
+	compression bigquery.Compression
+}
+
+// exportCompressions are the compressions extract jobs support per format.
+var exportCompressions = map[exportFormat][]bigquery.Compression{
+	avroFormat:    {bigquery.None, bigquery.Deflate, bigquery.Snappy},
+	parquetFormat: {bigquery.None, bigquery.Snappy, bigquery.Gzip, "ZSTD"},
+}
+
+type exportRule struct {
+	project, dataset, table string
+	settings                exportSettings
+}
+
+// compileExportRules checks rules and fills in defaultFormat where they don't
+// set a format.
+func compileExportRules(rules []ExportRule, defaultFormat exportFormat) ([]exportRule, error) {
+	compiled := make([]exportRule, 0, len(rules))
+	for i, r := range rules {
+		for _, pattern := range []string{r.Project, r.Dataset, r.Table} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("export rule %d: bad pattern %q", i+1, pattern)
+			}
+		}
+		settings := exportSettings{format: defaultFormat, compression: bigquery.None}
+		if r.Format != "" {
+			f, err := parseExportFormat(r.Format)
+			if err != nil {
+				return nil, fmt.Errorf("export rule %d: format %w", i+1, err)
+			}
+			settings.format = f
+		}
+		if r.Compression != "" {
+			settings.compression = bigquery.Compression(strings.ToUpper(r.Compression))
+			if !slices.Contains(exportCompressions[settings.format], settings.compression) {
+				return nil, fmt.Errorf("export rule %d: %s files can't be compressed with %s", i+1, settings.format.name, r.Compression)
+			}
+		}
+		compiled = append(compiled, exportRule{project: r.Project, dataset: r.Dataset, table: r.Table, settings: settings})
+	}
+	return compiled, nil
+}
+
+// tableExportSettings returns the settings of the first export rule matching
+// the table, or the run's format without compression.
+func (b *backupRun) tableExportSettings(projectID, datasetID, tableID string) exportSettings {
+	for _, r := range b.exportRules {
+		if matchPattern(r.project, projectID) && matchPattern(r.dataset, datasetID) && matchPattern(r.table, tableID) {
+			return r.settings
+		}
+	}
+	return exportSettings{format: b.format, compression: bigquery.None}
+}
+
+func matchPattern(pattern, name string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// fileFormat returns the format of an exported file by its extension.
+func fileFormat(name string) (exportFormat, bool) {
+	for _, f := range exportFormats {
+		if path.Ext(name) == "."+f.extension {
+			return f, true
+		}
+	}
+	return exportFormat{}, false
+}
+
+// exportFiles extracts a table into files under dir, whose names start with
+// name, and returns the files of this export, verified against what the
+// extract job reports.
+func exportFiles(ctx context.Context, tables tableExporter, datasetID, tableID string, settings exportSettings, store objectStore, bucketName, dir, name string) ([]*storage.ObjectAttrs, error) {
+	gcsRef := bigquery.NewGCSReference(fmt.Sprintf("gs://%s/%s/%s*.%s", bucketName, dir, name, settings.format.extension))
+	gcsRef.DestinationFormat = settings.format.format
+	if settings.compression != bigquery.None {
+		gcsRef.Compression = settings.compression
+	}
+
+	status, err := tables.Extract(ctx, datasetID, tableID, gcsRef)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := listObjects(ctx, store, bucketName, dir+"/"+name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list exported files: %w", err)
+	}
+	return verifyExportedFiles(status, objects)
+}
+
+// isHivePartitioned reports whether a table is exported one partition per
+// directory, so engines reading the backup in place can prune partitions.
+func (b *backupRun) isHivePartitioned(meta *bigquery.TableMetadata) bool {
+	return b.hivePartitions && meta.Type == bigquery.RegularTable && (meta.TimePartitioning != nil || meta.RangePartitioning != nil)
+}
+
+// exportPartitions exports each partition of table into a hive-style
+// directory under the table's backup directory, e.g. TABLE/dt=2024-01-01/.
+// The rows of the NULL and unpartitioned partitions, which hold NULL and
+// out-of-range partition values, go into the default partition directory.
+// Rows still in the streaming buffer are not exported, as with a plain
+// export.
+func exportPartitions(ctx context.Context, c projectClients, datasetID, tableID string, meta *bigquery.TableMetadata, settings exportSettings, bucketName, basePath string) ([]*storage.ObjectAttrs, error) {
+	partitions, err := listPartitions(ctx, c.bq, c.bq.Dataset(datasetID).Table(tableID))
+	if err != nil {
+		return nil, err
+	}
+
+	key := hivePartitionKey(meta)
+	var objects []*storage.ObjectAttrs
+	for _, partition := range partitions {
+		value, err := hivePartitionValue(meta, partition)
+		if err != nil {
+			return nil, err
+		}
+		// The NULL and unpartitioned partitions share the default partition
+		// directory, so the files of the latter are told apart by name.
+		name := ""
+		if partition == unpartitionedPartition {
+			name = "unpartitioned-"
+		}
+		exported, err := exportFiles(ctx, c.tables, datasetID, tableID+"$"+partition, settings, c.objects, bucketName, basePath+"/"+key+"="+value, name)
+		if err != nil {
+			return nil, fmt.Errorf("partition %s: %w", partition, err)
+		}
+		objects = append(objects, exported...)
+	}
+	return objects, nil
+}
+
+// listPartitions returns the IDs of a table's partitions, leaving out the
+// streaming buffer, which can't be exported.
+func listPartitions(ctx context.Context, client *bigquery.Client, table *bigquery.Table) ([]string, error) {
+	query := client.Query(fmt.Sprintf("SELECT partition_id FROM %s.INFORMATION_SCHEMA.PARTITIONS WHERE table_name = @table AND partition_id IS NOT NULL AND partition_id != '__STREAMING_UNPARTITIONED__' ORDER BY partition_id",
+		quoteIdentifier(table.ProjectID, table.DatasetID)))
+	query.Parameters = []bigquery.QueryParameter{{Name: "table", Value: table.TableID}}
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list partitions: %w", err)
+	}
+
+	var partitions []string
+	for {
+		var row struct {
+			PartitionID string `bigquery:"partition_id"`
+		}
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list partitions: %w", err)
+		}
+		partitions = append(partitions, row.PartitionID)
+	}
+	return partitions, nil
+}
+
+// hivePartitionKey names the partition directories after the partition
+// column, or dt for ingestion-time partitioned tables.
+func hivePartitionKey(meta *bigquery.TableMetadata) string {
+	switch {
+	case meta.TimePartitioning != nil && meta.TimePartitioning.Field != "":
+		return meta.TimePartitioning.Field
+	case meta.RangePartitioning != nil:
+		return meta.RangePartitioning.Field
+	}
+	return "dt"
+}
+
+// partitionIDLayouts map the partition IDs of each time partitioning type to
+// the layout of their directory name.
+var partitionIDLayouts = map[bigquery.TimePartitioningType][2]string{
+	bigquery.HourPartitioningType:  {"2006010215", "2006-01-02T15"},
+	bigquery.DayPartitioningType:   {"20060102", "2006-01-02"},
+	bigquery.MonthPartitioningType: {"200601", "2006-01"},
+	bigquery.YearPartitioningType:  {"2006", "2006"},
+}
+
+// hiveDefaultPartition is the directory Hive and Spark use for NULL partition
+// values.
+const hiveDefaultPartition = "__HIVE_DEFAULT_PARTITION__"
+
+// Partition IDs of the rows with a NULL partition value, and of the rows
+// with a value outside the partitioning range, which for integer range
+// partitioned tables also holds NULL values.
+const (
+	nullPartition          = "__NULL__"
+	unpartitionedPartition = "__UNPARTITIONED__"
+)
+
+// hivePartitionValue returns the directory value of a partition: a date for
+// time partitions and the range start for integer range partitions.
+func hivePartitionValue(meta *bigquery.TableMetadata, partitionID string) (string, error) {
+	if partitionID == nullPartition || partitionID == unpartitionedPartition {
+		return hiveDefaultPartition, nil
+	}
+	if meta.TimePartitioning == nil {
+		return partitionID, nil
+	}
+
+	typ := meta.TimePartitioning.Type
+	if typ == "" {
+		typ = bigquery.DayPartitioningType
+	}
+	layouts, ok := partitionIDLayouts[typ]
+	if !ok {
+		return "", fmt.Errorf("unsupported partitioning type %s", typ)
+	}
+	t, err := time.Parse(layouts[0], strings.TrimSpace(partitionID))
+	if err != nil {
+		return "", fmt.Errorf("unexpected partition ID %q: %w", partitionID, err)
+	}
+	return t.Format(layouts[1]), nil
+}
+
+// tableSource is where a table's backup files are read from.
+type tableSource struct {
+	// uri's wildcard also matches the files in hive partition directories.
+	// For an archived table it is the archive's.
+	uri    string
+	format exportFormat
+	// archived are the files of a table in the dataset's tiny table
+	// archive. They are loaded straight from the archive, so reading a
+	// backup never writes to the bucket.
+	archived []*zip.File
+}
+
+func (s tableSource) String() string {
+	return s.uri
+}
+
+// backupSource returns where a table's backup files are and their format,
+// which is taken from the extension of the first file.
+func backupSource(ctx context.Context, storageClient *storage.Client, bucketName, projectID, date, datasetID, tableID string) (tableSource, error) {
+	prefix := backupPath(projectID, date, datasetID, tableID) + "/"
+	f, ok, err := firstFileFormat(ctx, storageClient, bucketName, prefix)
+	if err != nil {
+		return tableSource{}, err
+	}
+	if !ok {
+		archived, err := archivedFiles(ctx, storageClient, bucketName, projectID, date, datasetID, tableID)
+		if err != nil {
+			return tableSource{}, err
+		}
+		if len(archived) > 0 {
+			if f, ok = fileFormat(archived[0].Name); !ok {
+				f = avroFormat
+			}
+			return tableSource{uri: fmt.Sprintf("gs://%s/%s", bucketName, bundlePath(projectID, date, datasetID)), format: f, archived: archived}, nil
+		}
+	}
+	return tableSource{uri: fmt.Sprintf("gs://%s/%s*.%s", bucketName, prefix, f.extension), format: f}, nil
+}
+
+// externalSource returns the URI external tables can read a table's backup
+// from. They can't read from an archive.
+func (s tableSource) externalSource() (string, error) {
+	if len(s.archived) > 0 {
+		return "", fmt.Errorf("its files are in the tiny table archive %s, which external tables can't read", s.uri)
+	}
+	return s.uri, nil
+}
+
+// firstFileFormat returns the format of the first exported file under
+// prefix, or Avro if there is none.
+func firstFileFormat(ctx context.Context, storageClient *storage.Client, bucketName, prefix string) (exportFormat, bool, error) {
+	it := storageClient.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return avroFormat, false, nil
+		}
+		if err != nil {
+			return exportFormat{}, false, err
+		}
+		if f, ok := fileFormat(attrs.Name); ok {
+			return f, true, nil
+		}
+	}
+}
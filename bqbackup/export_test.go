@@ -0,0 +1,64 @@
+package bqbackup
+
+import (
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestCompileExportRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    ExportRule
+		want    exportSettings
+		wantErr string
+	}{
+		{"default format", ExportRule{Dataset: "raw"}, exportSettings{format: avroFormat, compression: bigquery.None}, ""},
+		{"format", ExportRule{Format: "parquet"}, exportSettings{format: parquetFormat, compression: bigquery.None}, ""},
+		{"compression", ExportRule{Format: "parquet", Compression: "zstd"}, exportSettings{format: parquetFormat, compression: "ZSTD"}, ""},
+		{"unsupported compression", ExportRule{Compression: "gzip"}, exportSettings{}, "avro files can't be compressed with gzip"},
+		{"bad format", ExportRule{Format: "csv"}, exportSettings{}, "export rule 1: format"},
+		{"bad pattern", ExportRule{Table: "["}, exportSettings{}, `bad pattern "["`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := compileExportRules([]ExportRule{tt.rule}, avroFormat)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("compileExportRules() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rules[0].settings != tt.want {
+				t.Errorf("settings = %+v, want %+v", rules[0].settings, tt.want)
+			}
+		})
+	}
+}
+
+func TestTableExportSettings(t *testing.T) {
+	b := newTestRun(t, Options{
+		Format: "avro",
+		ExportRules: []ExportRule{
+			{Project: "prod-*", Dataset: "raw", Format: "parquet"},
+			{Table: "events_*", Compression: "snappy"},
+		},
+	})
+	tests := []struct {
+		project, dataset, table string
+		want                    exportSettings
+	}{
+		{"prod-eu", "raw", "events_2024", exportSettings{format: parquetFormat, compression: bigquery.None}},
+		{"dev", "raw", "events_2024", exportSettings{format: avroFormat, compression: bigquery.Snappy}},
+		{"dev", "raw", "orders", exportSettings{format: avroFormat, compression: bigquery.None}},
+	}
+	for _, tt := range tests {
+		if got := b.tableExportSettings(tt.project, tt.dataset, tt.table); got != tt.want {
+			t.Errorf("tableExportSettings(%s, %s, %s) = %+v, want %+v", tt.project, tt.dataset, tt.table, got, tt.want)
+		}
+	}
+}
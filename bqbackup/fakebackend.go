@@ -0,0 +1,604 @@
+package bqbackup
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bq "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/option"
+	raw "google.golang.org/api/storage/v1"
+)
+
+// fakeBackend emulates the parts of the BigQuery and Cloud Storage JSON APIs
+// a backup uses, so a run can be rehearsed, or tested, without touching GCP.
+// Every project has the datasets in fakeDatasets; extract jobs write a small
+// Avro file per table into the in-memory bucket.
+type fakeBackend struct {
+	server   *http.Server
+	endpoint string
+
+	mu         sync.Mutex
+	tables     map[string]*bq.Table // project/dataset/table
+	objects    map[string]map[string]*fakeObject
+	jobs       map[string]*bq.Job // project/job
+	uploads    map[string]*fakeUpload
+	generation int64
+	// failures are the errors requests fail with, keyed by method and path
+	// prefix, e.g. "GET /projects/p/datasets".
+	failures map[string]*fakeFailure
+}
+
+type fakeFailure struct {
+	code   int
+	reason string
+}
+
+type fakeObject struct {
+	attrs *raw.Object
+	data  []byte
+}
+
+type fakeUpload struct {
+	bucket string
+	attrs  *raw.Object
+	data   []byte
+}
+
+// fakeDatasets are the datasets every project has in the fake backend, with
+// their location and tables.
+var fakeDatasets = []struct {
+	DatasetID string
+	Location  string
+	Tables    []string
+}{
+	{"sales", "US", []string{"orders", "customers", "products"}},
+	{"analytics", "EU", []string{"events", "sessions"}},
+}
+
+var fakeSchema = &bq.TableSchema{Fields: []*bq.TableFieldSchema{
+	{Name: "id", Type: "INTEGER", Mode: "REQUIRED"},
+	{Name: "name", Type: "STRING", Mode: "NULLABLE"},
+	{Name: "amount", Type: "NUMERIC", Mode: "NULLABLE"},
+	{Name: "created", Type: "TIMESTAMP", Mode: "NULLABLE"},
+}}
+
+// startFakeBackend serves a fake backend on a local port.
+func startFakeBackend() (*fakeBackend, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	f := &fakeBackend{
+		endpoint: "http://" + listener.Addr().String() + "/",
+		tables:   make(map[string]*bq.Table),
+		objects:  make(map[string]map[string]*fakeObject),
+		jobs:     make(map[string]*bq.Job),
+		uploads:  make(map[string]*fakeUpload),
+		failures: make(map[string]*fakeFailure),
+	}
+	f.server = &http.Server{Handler: f}
+	go f.server.Serve(listener)
+	return f, nil
+}
+
+func (f *fakeBackend) close() {
+	f.server.Close()
+}
+
+// clientOptions point BigQuery and Storage clients at the fake backend.
+func (f *fakeBackend) clientOptions() []option.ClientOption {
+	return []option.ClientOption{option.WithEndpoint(f.endpoint), option.WithoutAuthentication()}
+}
+
+// fail makes the requests with method whose path starts with path fail with
+// code and reason, for tests.
+func (f *fakeBackend) fail(method, path string, code int, reason string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[method+" "+path] = &fakeFailure{code: code, reason: reason}
+}
+
+// summary describes what was written to the fake backend's buckets.
+func (f *fakeBackend) summary() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var lines []string
+	for bucket, objects := range f.objects {
+		var size int64
+		for _, o := range objects {
+			size += int64(len(o.data))
+		}
+		lines = append(lines, fmt.Sprintf("gs://%s: %d objects, %s", bucket, len(objects), formatBytes(size)))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func (f *fakeBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	for i, s := range segments {
+		if unescaped, err := url.PathUnescape(s); err == nil {
+			segments[i] = unescaped
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, failure := range f.failures {
+		if method, path, _ := strings.Cut(key, " "); r.Method == method && strings.HasPrefix(r.URL.Path, path) {
+			fakeError(w, failure.code, failure.reason, fmt.Sprintf("%s failed on purpose", key))
+			return
+		}
+	}
+	switch {
+	case segments[0] == "projects":
+		f.serveBigQuery(w, r, segments[1:])
+	case segments[0] == "b":
+		f.serveStorage(w, r, segments[1:])
+	case segments[0] == "upload":
+		f.serveUpload(w, r)
+	case len(segments) == 2:
+		f.serveDownload(w, r, segments[0], segments[1])
+	default:
+		fakeError(w, http.StatusNotFound, "notFound", "Not found: "+r.URL.Path)
+	}
+}
+
+func fakeError(w http.ResponseWriter, code int, reason, message string) {
+	writeFakeJSON(w, code, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+			"errors":  []map[string]string{{"reason": reason, "message": message}},
+		},
+	})
+}
+
+func writeFakeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// seedProject creates the fakeDatasets of a project the first time it is
+// used.
+func (f *fakeBackend) seedProject(projectID string) {
+	for _, t := range f.tables {
+		if t.TableReference.ProjectId == projectID {
+			return
+		}
+	}
+	for _, d := range fakeDatasets {
+		for i, tableID := range d.Tables {
+			rows := uint64(1000 * (i + 1))
+			f.tables[projectID+"/"+d.DatasetID+"/"+tableID] = &bq.Table{
+				TableReference: &bq.TableReference{ProjectId: projectID, DatasetId: d.DatasetID, TableId: tableID},
+				Type:           "TABLE",
+				Location:       d.Location,
+				Schema:         fakeSchema,
+				NumRows:        rows,
+				NumBytes:       int64(rows) * 64,
+				CreationTime:   time.Now().AddDate(0, 0, -30).UnixMilli(),
+			}
+		}
+	}
+}
+
+func fakeDatasetLocation(datasetID string) (string, bool) {
+	for _, d := range fakeDatasets {
+		if d.DatasetID == datasetID {
+			return d.Location, true
+		}
+	}
+	return "", false
+}
+
+func (f *fakeBackend) serveBigQuery(w http.ResponseWriter, r *http.Request, segments []string) {
+	projectID := segments[0]
+	f.seedProject(projectID)
+	segments = segments[1:]
+
+	switch {
+	case len(segments) == 1 && segments[0] == "datasets":
+		var list bq.DatasetList
+		for _, d := range fakeDatasets {
+			list.Datasets = append(list.Datasets, &bq.DatasetListDatasets{
+				DatasetReference: &bq.DatasetReference{ProjectId: projectID, DatasetId: d.DatasetID},
+				Location:         d.Location,
+			})
+		}
+		writeFakeJSON(w, http.StatusOK, list)
+
+	case len(segments) == 2 && segments[0] == "datasets":
+		location, ok := fakeDatasetLocation(segments[1])
+		if !ok {
+			fakeError(w, http.StatusNotFound, "notFound", "Not found: Dataset "+segments[1])
+			return
+		}
+		writeFakeJSON(w, http.StatusOK, bq.Dataset{
+			DatasetReference: &bq.DatasetReference{ProjectId: projectID, DatasetId: segments[1]},
+			Location:         location,
+		})
+
+	case len(segments) == 3 && segments[0] == "datasets" && segments[2] == "tables":
+		if _, ok := fakeDatasetLocation(segments[1]); !ok {
+			fakeError(w, http.StatusNotFound, "notFound", "Not found: Dataset "+segments[1])
+			return
+		}
+		var list bq.TableList
+		for _, t := range f.sortedTables(projectID, segments[1]) {
+			list.Tables = append(list.Tables, &bq.TableListTables{TableReference: t.TableReference, Type: t.Type})
+		}
+		writeFakeJSON(w, http.StatusOK, list)
+
+	case len(segments) == 4 && segments[0] == "datasets" && segments[2] == "tables":
+		key := projectID + "/" + segments[1] + "/" + segments[3]
+		t, ok := f.tables[key]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "notFound", "Not found: Table "+segments[3])
+			return
+		}
+		if r.Method == http.MethodDelete {
+			delete(f.tables, key)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeFakeJSON(w, http.StatusOK, t)
+
+	case len(segments) == 1 && segments[0] == "jobs" && r.Method == http.MethodPost:
+		var job bq.Job
+		if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+			fakeError(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+		if job.JobReference == nil {
+			job.JobReference = &bq.JobReference{ProjectId: projectID, JobId: randomHex(8)}
+		}
+		f.runJob(&job)
+		f.jobs[projectID+"/"+job.JobReference.JobId] = &job
+		writeFakeJSON(w, http.StatusOK, job)
+
+	case len(segments) >= 2 && segments[0] == "jobs":
+		job, ok := f.jobs[projectID+"/"+segments[1]]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "notFound", "Not found: Job "+segments[1])
+			return
+		}
+		if len(segments) == 3 && segments[2] == "cancel" {
+			writeFakeJSON(w, http.StatusOK, bq.JobCancelResponse{Job: job})
+			return
+		}
+		writeFakeJSON(w, http.StatusOK, job)
+
+	case len(segments) >= 1 && segments[0] == "queries":
+		// Queries run instantly and return no rows.
+		jobID := randomHex(8)
+		if len(segments) == 2 {
+			jobID = segments[1]
+		}
+		writeFakeJSON(w, http.StatusOK, bq.QueryResponse{
+			JobReference: &bq.JobReference{ProjectId: projectID, JobId: jobID},
+			JobComplete:  true,
+			Schema:       &bq.TableSchema{},
+			TotalRows:    0,
+		})
+
+	default:
+		fakeError(w, http.StatusNotFound, "notFound", "Not found: "+r.URL.Path)
+	}
+}
+
+func (f *fakeBackend) sortedTables(projectID, datasetID string) []*bq.Table {
+	var tables []*bq.Table
+	for _, t := range f.tables {
+		if t.TableReference.ProjectId == projectID && t.TableReference.DatasetId == datasetID {
+			tables = append(tables, t)
+		}
+	}
+	sort.Slice(tables, func(i, j int) bool { return tables[i].TableReference.TableId < tables[j].TableReference.TableId })
+	return tables
+}
+
+// runJob completes a job as soon as it is inserted. Extract jobs write one
+// file per table; other jobs do nothing.
+func (f *fakeBackend) runJob(job *bq.Job) {
+	started := time.Now()
+	job.Status = &bq.JobStatus{State: "DONE"}
+	job.Statistics = &bq.JobStatistics{StartTime: started.UnixMilli(), CreationTime: started.UnixMilli()}
+
+	switch {
+	case job.Configuration != nil && job.Configuration.Extract != nil:
+		extract := job.Configuration.Extract
+		src := extract.SourceTable
+		table, ok := f.tables[src.ProjectId+"/"+src.DatasetId+"/"+src.TableId]
+		if !ok {
+			job.Status.ErrorResult = &bq.ErrorProto{Reason: "notFound", Message: "Not found: Table " + src.TableId}
+			break
+		}
+		var counts []int64
+		for _, uri := range extract.DestinationUris {
+			bucket, name, _ := strings.Cut(strings.TrimPrefix(uri, "gs://"), "/")
+			name = strings.Replace(name, "*", "000000000000", 1)
+			if object, ok := f.objects[bucket][name]; ok && object.attrs.TemporaryHold {
+				job.Status.ErrorResult = &bq.ErrorProto{Reason: "accessDenied", Message: "Object " + name + " is under active Temporary hold"}
+				job.Statistics.EndTime = time.Now().UnixMilli()
+				return
+			}
+			f.putObject(bucket, &raw.Object{Name: name, ContentType: "application/octet-stream"}, fakeAvroFile(table.Schema))
+			counts = append(counts, 1)
+		}
+		job.Statistics.Extract = &bq.JobStatistics4{DestinationUriFileCounts: counts}
+	case job.Configuration != nil && job.Configuration.Query != nil:
+		job.Statistics.Query = &bq.JobStatistics2{}
+	}
+	job.Statistics.EndTime = time.Now().UnixMilli()
+}
+
+// fakeAvroFile returns an Avro container file with the table's schema and no
+// rows.
+func fakeAvroFile(schema *bq.TableSchema) []byte {
+	type field struct {
+		Name string      `json:"name"`
+		Type interface{} `json:"type"`
+	}
+	record := struct {
+		Type   string  `json:"type"`
+		Name   string  `json:"name"`
+		Fields []field `json:"fields"`
+	}{Type: "record", Name: "Root"}
+	for _, f := range schema.Fields {
+		typ := "string"
+		switch f.Type {
+		case "INTEGER", "INT64":
+			typ = "long"
+		case "FLOAT", "FLOAT64":
+			typ = "double"
+		case "BOOLEAN", "BOOL":
+			typ = "boolean"
+		}
+		if f.Mode == "REQUIRED" {
+			record.Fields = append(record.Fields, field{f.Name, typ})
+		} else {
+			record.Fields = append(record.Fields, field{f.Name, []string{"null", typ}})
+		}
+	}
+	schemaJSON, _ := json.Marshal(record)
+
+	var buf bytes.Buffer
+	buf.Write(avroMagic)
+	writeLong := func(n int64) {
+		buf.Write(binary.AppendUvarint(nil, uint64((n<<1)^(n>>63))))
+	}
+	writeBytes := func(b []byte) {
+		writeLong(int64(len(b)))
+		buf.Write(b)
+	}
+	writeLong(2)
+	writeBytes([]byte("avro.schema"))
+	writeBytes(schemaJSON)
+	writeBytes([]byte("avro.codec"))
+	writeBytes([]byte("null"))
+	writeLong(0)
+	buf.WriteString(randomHex(8)) // 16 byte sync marker
+	return buf.Bytes()
+}
+
+func (f *fakeBackend) putObject(bucket string, attrs *raw.Object, data []byte) *raw.Object {
+	if f.objects[bucket] == nil {
+		f.objects[bucket] = make(map[string]*fakeObject)
+	}
+	f.generation++
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.Checksum(data, crc32cTable))
+	sum := md5.Sum(data)
+
+	attrs.Bucket = bucket
+	attrs.Size = uint64(len(data))
+	attrs.Generation = f.generation
+	attrs.Metageneration = 1
+	attrs.Crc32c = base64.StdEncoding.EncodeToString(crc)
+	attrs.Md5Hash = base64.StdEncoding.EncodeToString(sum[:])
+	attrs.TimeCreated = now
+	attrs.Updated = now
+	attrs.StorageClass = "STANDARD"
+	f.objects[bucket][attrs.Name] = &fakeObject{attrs: attrs, data: data}
+	return attrs
+}
+
+func (f *fakeBackend) serveStorage(w http.ResponseWriter, r *http.Request, segments []string) {
+	bucket := segments[0]
+	switch {
+	case len(segments) == 1:
+		writeFakeJSON(w, http.StatusOK, raw.Bucket{Name: bucket, Location: "US", StorageClass: "STANDARD"})
+
+	case len(segments) == 2 && segments[1] == "o":
+		f.listObjects(w, r, bucket)
+
+	case len(segments) == 3 && segments[1] == "o":
+		object, ok := f.objects[bucket][segments[2]]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "notFound", "No such object: "+bucket+"/"+segments[2])
+			return
+		}
+		switch r.Method {
+		case http.MethodDelete:
+			if object.attrs.TemporaryHold {
+				fakeError(w, http.StatusForbidden, "forbidden", "Object "+segments[2]+" is under active Temporary hold and cannot be deleted, overwritten or archived until hold is removed.")
+				return
+			}
+			delete(f.objects[bucket], segments[2])
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodPatch, http.MethodPut:
+			var update raw.Object
+			if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+				fakeError(w, http.StatusBadRequest, "invalid", err.Error())
+				return
+			}
+			object.attrs.TemporaryHold = update.TemporaryHold
+			object.attrs.Metageneration++
+			writeFakeJSON(w, http.StatusOK, object.attrs)
+		default:
+			if r.URL.Query().Get("alt") == "media" {
+				w.Write(object.data)
+				return
+			}
+			writeFakeJSON(w, http.StatusOK, object.attrs)
+		}
+
+	default:
+		fakeError(w, http.StatusNotFound, "notFound", "Not found: "+r.URL.Path)
+	}
+}
+
+func (f *fakeBackend) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	prefix := r.URL.Query().Get("prefix")
+	delimiter := r.URL.Query().Get("delimiter")
+	startOffset := r.URL.Query().Get("startOffset")
+	var list raw.Objects
+	prefixes := make(map[string]bool)
+	for name, object := range f.objects[bucket] {
+		if !strings.HasPrefix(name, prefix) || name < startOffset {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				prefixes[name[:len(prefix)+i+len(delimiter)]] = true
+				continue
+			}
+		}
+		list.Items = append(list.Items, object.attrs)
+	}
+	for p := range prefixes {
+		list.Prefixes = append(list.Prefixes, p)
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+	sort.Strings(list.Prefixes)
+	writeFakeJSON(w, http.StatusOK, list)
+}
+
+// serveUpload handles multipart uploads, and resumable ones for files larger
+// than the client's chunk size.
+func (f *fakeBackend) serveUpload(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if id := query.Get("upload_id"); id != "" {
+		upload, ok := f.uploads[id]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "notFound", "No such upload")
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			fakeError(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+		upload.data = append(upload.data, data...)
+		// Content-Range is "bytes first-last/total", with * for a total that
+		// isn't known yet.
+		contentRange := r.Header.Get("Content-Range")
+		total := contentRange[strings.LastIndex(contentRange, "/")+1:]
+		if total == "*" || total != strconv.Itoa(len(upload.data)) {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(upload.data)-1))
+			w.WriteHeader(http.StatusPermanentRedirect)
+			return
+		}
+		delete(f.uploads, id)
+		writeFakeJSON(w, http.StatusOK, f.putObject(upload.bucket, upload.attrs, upload.data))
+		return
+	}
+
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	// upload/storage/v1/b/BUCKET/o
+	if len(segments) < 5 {
+		fakeError(w, http.StatusNotFound, "notFound", "Not found: "+r.URL.Path)
+		return
+	}
+	bucket := segments[4]
+
+	attrs := &raw.Object{Name: query.Get("name")}
+	switch query.Get("uploadType") {
+	case "resumable":
+		if err := json.NewDecoder(r.Body).Decode(attrs); err != nil && err != io.EOF {
+			fakeError(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+		id := randomHex(8)
+		f.uploads[id] = &fakeUpload{bucket: bucket, attrs: attrs}
+		w.Header().Set("Location", fmt.Sprintf("%supload/storage/v1/b/%s/o?uploadType=resumable&upload_id=%s", f.endpoint, url.PathEscape(bucket), id))
+		w.WriteHeader(http.StatusOK)
+
+	case "multipart":
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			fakeError(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+		reader := multipart.NewReader(r.Body, params["boundary"])
+		part, err := reader.NextPart()
+		if err == nil {
+			err = json.NewDecoder(part).Decode(attrs)
+		}
+		if err == nil {
+			part, err = reader.NextPart()
+		}
+		var data []byte
+		if err == nil {
+			data, err = io.ReadAll(part)
+		}
+		if err != nil {
+			fakeError(w, http.StatusBadRequest, "invalid", err.Error())
+			return
+		}
+		writeFakeJSON(w, http.StatusOK, f.putObject(bucket, attrs, data))
+
+	default:
+		data, _ := io.ReadAll(r.Body)
+		writeFakeJSON(w, http.StatusOK, f.putObject(bucket, attrs, data))
+	}
+}
+
+// serveDownload serves reads, which the Storage client makes through the XML
+// API.
+func (f *fakeBackend) serveDownload(w http.ResponseWriter, r *http.Request, bucket, name string) {
+	object, ok := f.objects[bucket][name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-Goog-Generation", strconv.FormatInt(object.attrs.Generation, 10))
+	w.Header().Set("X-Goog-Metageneration", strconv.FormatInt(object.attrs.Metageneration, 10))
+	w.Header().Set("Content-Type", object.attrs.ContentType)
+
+	data := object.data
+	var start, end int64
+	if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); err == nil || start > 0 {
+		if err != nil || end >= int64(len(data)) {
+			end = int64(len(data)) - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[start : end+1])
+		return
+	}
+	w.Header().Set("X-Goog-Hash", "crc32c="+object.attrs.Crc32c)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
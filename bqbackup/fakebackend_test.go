@@ -0,0 +1,161 @@
+package bqbackup
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	raw "google.golang.org/api/storage/v1"
+)
+
+// newTestBackend starts a fake backend and returns it with clients of project
+// p pointed at it.
+func newTestBackend(t *testing.T) (*fakeBackend, projectClients) {
+	t.Helper()
+	f, err := startFakeBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.close)
+
+	ctx := context.Background()
+	bqClient, err := bigquery.NewClient(ctx, "p", f.clientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bqClient.Close() })
+	storageClient, err := storage.NewClient(ctx, f.clientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storageClient.Close() })
+	return f, projectClients{bq: bqClient, gcs: storageClient, tables: bigQueryProject{bqClient}, objects: gcsStore{storageClient}}
+}
+
+// putTestObject adds an object created at created to the fake backend.
+func putTestObject(f *fakeBackend, bucket, name string, created time.Time, attrs raw.Object) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	attrs.Name = name
+	f.putObject(bucket, &attrs, []byte(name)).TimeCreated = created.UTC().Format(time.RFC3339Nano)
+}
+
+// objectNames returns the names of a bucket's objects in the fake backend, in
+// order.
+func objectNames(f *fakeBackend, bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var names []string
+	for name := range f.objects[bucket] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestGCSStoreList(t *testing.T) {
+	f, c := newTestBackend(t)
+	for _, name := range []string{"p/2024-05-01/a/t/0.avro", "p/2024-05-02/a/t/0.avro", "p/undated.txt", "q/2024-05-01/a/t/0.avro"} {
+		putTestObject(f, "bucket", name, time.Now(), raw.Object{})
+	}
+	tests := []struct {
+		name  string
+		query storage.Query
+		want  []string
+	}{
+		{"prefix", storage.Query{Prefix: "p/"}, []string{"p/2024-05-01/a/t/0.avro", "p/2024-05-02/a/t/0.avro", "p/undated.txt"}},
+		// As in GCS, a page lists its objects before its prefixes.
+		{"delimiter", storage.Query{Prefix: "p/", Delimiter: "/"}, []string{"p/undated.txt", "p/2024-05-01/", "p/2024-05-02/"}},
+		{"start offset", storage.Query{Prefix: "p/", StartOffset: "p/2024-05-02/a/t/0.avro"}, []string{"p/2024-05-02/a/t/0.avro", "p/undated.txt"}},
+		{"none", storage.Query{Prefix: "r/"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			err := c.objects.List(context.Background(), "bucket", &tt.query, func(attrs *storage.ObjectAttrs) error {
+				got = append(got, attrs.Name+attrs.Prefix)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("List() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGCSStoreReadWriteDelete(t *testing.T) {
+	_, c := newTestBackend(t)
+	ctx := context.Background()
+	if _, err := c.objects.Read(ctx, "bucket", "missing"); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("Read() of a missing object = %v, want %v", err, storage.ErrObjectNotExist)
+	}
+	if err := c.objects.Write(ctx, "bucket", "o", []byte(`{"a":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.objects.Read(ctx, "bucket", "o"); err != nil || string(data) != `{"a":1}` {
+		t.Errorf("Read() = %q, %v", data, err)
+	}
+	if err := c.objects.Delete(ctx, "bucket", "o", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.objects.Delete(ctx, "bucket", "o", 0); !errors.Is(err, storage.ErrObjectNotExist) {
+		t.Errorf("Delete() of a deleted object = %v, want %v", err, storage.ErrObjectNotExist)
+	}
+}
+
+func TestBigQueryProject(t *testing.T) {
+	f, c := newTestBackend(t)
+	lister := c.tables.(datasetLister)
+	ctx := context.Background()
+
+	datasets, err := lister.Datasets(ctx)
+	if err != nil || !reflect.DeepEqual(datasets, []string{"sales", "analytics"}) {
+		t.Errorf("Datasets() = %v, %v", datasets, err)
+	}
+	tests := []struct {
+		datasetID string
+		want      []string
+		wantErr   bool
+	}{
+		{"sales", []string{"customers", "orders", "products"}, false},
+		{"analytics", []string{"events", "sessions"}, false},
+		{"missing", nil, true},
+	}
+	for _, tt := range tests {
+		tables, err := lister.Tables(ctx, tt.datasetID)
+		if !reflect.DeepEqual(tables, tt.want) || (err != nil) != tt.wantErr {
+			t.Errorf("Tables(%s) = %v, %v, want %v", tt.datasetID, tables, err, tt.want)
+		}
+	}
+	if meta, err := lister.DatasetMetadata(ctx, "analytics"); err != nil || meta.Location != "EU" {
+		t.Errorf("DatasetMetadata() = %v, %v, want location EU", meta, err)
+	}
+
+	dst := bigquery.NewGCSReference("gs://bucket/p/2024-05-01/sales/orders/*.avro")
+	dst.DestinationFormat = bigquery.Avro
+	status, err := c.tables.Extract(ctx, "sales", "orders", dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := status.Statistics.Details.(*bigquery.ExtractStatistics).DestinationURIFileCounts
+	if want := []string{"p/2024-05-01/sales/orders/000000000000.avro"}; !reflect.DeepEqual(objectNames(f, "bucket"), want) || !reflect.DeepEqual(counts, []int64{1}) {
+		t.Errorf("Extract() wrote %v and reported %v, want %v", objectNames(f, "bucket"), counts, want)
+	}
+	if _, err := c.tables.Extract(ctx, "sales", "missing", dst); err == nil {
+		t.Error("Extract() of a missing table succeeded")
+	}
+
+	f.fail(http.MethodGet, "/projects/p/datasets", http.StatusForbidden, "accessDenied")
+	if _, err := lister.Datasets(ctx); classifyError(err) != errorClassPermission {
+		t.Errorf("Datasets() with access denied = %v, want a %s error", err, errorClassPermission)
+	}
+}
@@ -0,0 +1,127 @@
+package bqbackup
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// objectStore is the part of Cloud Storage backups are written, read, listed
+// and cleaned up through. gcsStore implements it with a Storage client.
+type objectStore interface {
+	// List calls fn with each object matching q in name order, or with each
+	// prefix when q has a delimiter, and stops at the first error of either.
+	List(ctx context.Context, bucketName string, q *storage.Query, fn func(*storage.ObjectAttrs) error) error
+	// Read returns storage.ErrObjectNotExist for a missing object.
+	Read(ctx context.Context, bucketName, name string) ([]byte, error)
+	Write(ctx context.Context, bucketName, name string, data []byte) error
+	// Delete deletes a generation of an object, or the live object if
+	// generation is 0.
+	Delete(ctx context.Context, bucketName, name string, generation int64) error
+}
+
+type gcsStore struct {
+	client *storage.Client
+}
+
+func (s gcsStore) List(ctx context.Context, bucketName string, q *storage.Query, fn func(*storage.ObjectAttrs) error) error {
+	it := s.client.Bucket(bucketName).Objects(ctx, q)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(attrs); err != nil {
+			return err
+		}
+	}
+}
+
+func (s gcsStore) Read(ctx context.Context, bucketName, name string) ([]byte, error) {
+	reader, err := s.client.Bucket(bucketName).Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func (s gcsStore) Write(ctx context.Context, bucketName, name string, data []byte) error {
+	writer := s.client.Bucket(bucketName).Object(name).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return err
+	}
+	return writer.Close()
+}
+
+func (s gcsStore) Delete(ctx context.Context, bucketName, name string, generation int64) error {
+	object := s.client.Bucket(bucketName).Object(name)
+	if generation != 0 {
+		object = object.Generation(generation)
+	}
+	return object.Delete(ctx)
+}
+
+func listObjects(ctx context.Context, store objectStore, bucketName, prefix string) ([]*storage.ObjectAttrs, error) {
+	var objects []*storage.ObjectAttrs
+	err := store.List(ctx, bucketName, &storage.Query{Prefix: prefix}, func(attrs *storage.ObjectAttrs) error {
+		objects = append(objects, attrs)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// holdObjects places, or with hold false releases, the temporary hold of
+// objects.
+func holdObjects(ctx context.Context, storageClient *storage.Client, bucketName string, objects []*storage.ObjectAttrs, hold bool) error {
+	bucket := storageClient.Bucket(bucketName)
+	for _, attrs := range objects {
+		if _, err := bucket.Object(attrs.Name).Update(ctx, storage.ObjectAttrsToUpdate{TemporaryHold: hold}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// holdPrefix places, or with hold false releases, the temporary hold of the
+// objects under prefix that don't have it set that way yet.
+func holdPrefix(ctx context.Context, storageClient *storage.Client, store objectStore, bucketName, prefix string, hold bool) error {
+	objects, err := listObjects(ctx, store, bucketName, prefix)
+	if err != nil {
+		return err
+	}
+	var changed []*storage.ObjectAttrs
+	for _, attrs := range objects {
+		if attrs.TemporaryHold != hold {
+			changed = append(changed, attrs)
+		}
+	}
+	return holdObjects(ctx, storageClient, bucketName, changed, hold)
+}
+
+func writeJSONObject(ctx context.Context, store objectStore, bucketName, name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.Write(ctx, bucketName, name, data)
+}
+
+func readJSONObject(ctx context.Context, store objectStore, bucketName, name string, v interface{}) error {
+	data, err := store.Read(ctx, bucketName, name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,53 @@
+package bqbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// sendGrafanaAnnotation pushes a region annotation covering a project's run
+// to the Grafana at baseURL, authenticating with token unless it is empty,
+// so backups show up on dashboards.
+func sendGrafanaAnnotation(baseURL, token string, entry catalogEntry) {
+	failed := countFailed(entry)
+	tags := []string{"bq-backup", entry.ProjectID}
+	if failed > 0 {
+		tags = append(tags, "failed")
+	}
+
+	annotation := map[string]interface{}{
+		"time":    entry.Started.UnixMilli(),
+		"timeEnd": entry.Finished.UnixMilli(),
+		"tags":    tags,
+		"text":    fmt.Sprintf("BigQuery backup %s for project %s: %d tables, %d failed", entry.RunID, entry.ProjectID, len(entry.Tables), failed),
+	}
+	annotationJSON, err := json.Marshal(annotation)
+	if err != nil {
+		fmt.Printf("Failed to marshal Grafana annotation: %v\n", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(baseURL, "/")+"/api/annotations", bytes.NewBuffer(annotationJSON))
+	if err != nil {
+		fmt.Printf("Failed to create Grafana request: %v\n", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Printf("Failed to send Grafana annotation: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Failed to send Grafana annotation, received status code: %d\n", resp.StatusCode)
+	}
+}
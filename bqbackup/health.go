@@ -0,0 +1,32 @@
+package bqbackup
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// startHealthServer serves /healthz, which reports the process is alive,
+// /readyz, which reports whether the clients of the run whose tracker status
+// holds are initialised and the run is not over, and /status, its progress
+// as in status.json.
+func startHealthServer(addr string, status *atomic.Pointer[statusTracker]) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/status", serveStatus(status))
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !status.Load().isReady() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			fmt.Printf("Failed to serve health endpoints on %s: %v\n", addr, err)
+		}
+	}()
+}
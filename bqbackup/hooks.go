@@ -0,0 +1,150 @@
+package bqbackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// postRunHookTimeout bounds the post-run hooks of a project. They run even
+// once the run is shutting down, so a hook that undoes what its pre-run hook
+// did always gets the chance to.
+const postRunHookTimeout = 5 * time.Minute
+
+// Hook events. A run here is one project's backup.
+const (
+	HookPreRun    = "pre-run"
+	HookPostRun   = "post-run"
+	HookPreTable  = "pre-table"
+	HookPostTable = "post-table"
+)
+
+var hookEvents = []string{HookPreRun, HookPostRun, HookPreTable, HookPostTable}
+
+// HookEvent describes the point of a backup a hook is called at.
+type HookEvent struct {
+	Event     string `json:"event"`
+	RunID     string `json:"run_id"`
+	ProjectID string `json:"project_id"`
+	Date      string `json:"date"`
+	// DatasetID and TableID are set for table events.
+	DatasetID string `json:"dataset_id,omitempty"`
+	TableID   string `json:"table_id,omitempty"`
+	// Status and Reason are set for post-table events. Reason is also set
+	// for the post-run events of projects the run ended before finishing.
+	Status string `json:"status,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// Tables and Failed are set for post-run events.
+	Tables int `json:"tables,omitempty"`
+	Failed int `json:"failed,omitempty"`
+}
+
+// Hook is called at each point of a backup. An error from a pre-run hook skips
+// the project and an error from a pre-table hook fails the table, so a hook can
+// for example quiesce writers before a table is exported. Errors from post
+// hooks are only reported.
+type Hook interface {
+	Handle(ctx context.Context, event HookEvent) error
+}
+
+// HookFunc adapts a function to a Hook.
+type HookFunc func(ctx context.Context, event HookEvent) error
+
+func (f HookFunc) Handle(ctx context.Context, event HookEvent) error {
+	return f(ctx, event)
+}
+
+// execHook runs a shell command for one event, with the event as JSON on
+// stdin and its fields in BQ_BACKUP_* environment variables.
+type execHook struct {
+	event   string
+	command string
+}
+
+func (h execHook) Handle(ctx context.Context, event HookEvent) error {
+	if event.Event != h.event {
+		return nil
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.command)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"BQ_BACKUP_EVENT="+event.Event,
+		"BQ_BACKUP_RUN_ID="+event.RunID,
+		"BQ_BACKUP_PROJECT="+event.ProjectID,
+		"BQ_BACKUP_DATE="+event.Date,
+		"BQ_BACKUP_DATASET="+event.DatasetID,
+		"BQ_BACKUP_TABLE="+event.TableID,
+		"BQ_BACKUP_STATUS="+event.Status,
+	)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook %q: %w", h.event, h.command, err)
+	}
+	return nil
+}
+
+// runPreRunHooks runs the pre-run hooks of a project, and if they succeed
+// owes it its post-run hooks.
+func (b *backupRun) runPreRunHooks(ctx context.Context, event HookEvent) error {
+	if err := b.runHooks(ctx, event); err != nil {
+		return err
+	}
+	b.pendingMu.Lock()
+	defer b.pendingMu.Unlock()
+	event.Event = HookPostRun
+	b.pendingPostRun[event.ProjectID] = event
+	return nil
+}
+
+// runPostRunHooks runs the post-run hooks of a project, even if ctx is
+// cancelled, for at most postRunHookTimeout.
+func (b *backupRun) runPostRunHooks(ctx context.Context, event HookEvent) error {
+	b.pendingMu.Lock()
+	delete(b.pendingPostRun, event.ProjectID)
+	b.pendingMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), postRunHookTimeout)
+	defer cancel()
+	event.Event = HookPostRun
+	return b.runHooks(ctx, event)
+}
+
+// runPendingPostRunHooks runs the post-run hooks still owed to projects the
+// run ended before finishing, giving reason as the event's reason.
+func (b *backupRun) runPendingPostRunHooks(ctx context.Context, reason string) {
+	b.pendingMu.Lock()
+	var events []HookEvent
+	for _, event := range b.pendingPostRun {
+		events = append(events, event)
+	}
+	b.pendingMu.Unlock()
+
+	for _, event := range events {
+		event.Reason = reason
+		if err := b.runPostRunHooks(ctx, event); err != nil {
+			fmt.Printf("Post-run hook failed for project %s: %v\n", event.ProjectID, err)
+		}
+	}
+}
+
+// runHooks calls every hook in order and returns the errors of all of them.
+func (b *backupRun) runHooks(ctx context.Context, event HookEvent) error {
+	var errs []error
+	for _, hook := range b.hooks {
+		if err := hook.Handle(ctx, event); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
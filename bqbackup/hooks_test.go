@@ -0,0 +1,52 @@
+package bqbackup
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestRunHookOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		failPreP1 bool
+		want      []string
+	}{
+		{
+			name: "each project is prepared right before its backup",
+			want: []string{"pre-run p1", "post-run p1", "pre-run p2", "post-run p2"},
+		},
+		{
+			name:      "a failing pre-run hook skips the project",
+			failPreP1: true,
+			want:      []string{"pre-run p1", "pre-run p2", "post-run p2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var got []string
+			hook := HookFunc(func(ctx context.Context, event HookEvent) error {
+				if event.Event != HookPreRun && event.Event != HookPostRun {
+					return nil
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				got = append(got, event.Event+" "+event.ProjectID)
+				if tt.failPreP1 && event.Event == HookPreRun && event.ProjectID == "p1" {
+					return errors.New("writers still busy")
+				}
+				return nil
+			})
+			opts := Options{Projects: []string{"p1", "p2"}, Bucket: "bucket", FakeBackend: true, Hooks: []Hook{hook}}
+			if _, err := NewRunner(opts).Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("hooks = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package bqbackup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// informationSchemaViews are the INFORMATION_SCHEMA views snapshotted per
+// dataset with --information-schema.
+var informationSchemaViews = []string{"TABLES", "COLUMNS", "VIEWS"}
+
+// informationSchemaPath returns where the snapshot of an INFORMATION_SCHEMA
+// view is written. The files are newline-delimited JSON, so they can be
+// queried with an external table.
+func informationSchemaPath(projectID, date, datasetID, view string) string {
+	return fmt.Sprintf("%s/information_schema_%s.jsonl", backupPath(projectID, date, datasetID), strings.ToLower(view))
+}
+
+// writeInformationSchema snapshots the dataset's INFORMATION_SCHEMA views into
+// the backup, as a record of schema evolution that doesn't need a restore.
+func writeInformationSchema(ctx context.Context, client *bigquery.Client, dataset *bigquery.Dataset, storageClient *storage.Client, bucketName, projectID, date string) error {
+	for _, view := range informationSchemaViews {
+		if err := writeInformationSchemaView(ctx, client, dataset, storageClient, bucketName, projectID, date, view); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeInformationSchemaView(ctx context.Context, client *bigquery.Client, dataset *bigquery.Dataset, storageClient *storage.Client, bucketName, projectID, date, view string) error {
+	query := client.Query(fmt.Sprintf("SELECT * FROM %s.INFORMATION_SCHEMA.%s", quoteIdentifier(dataset.ProjectID, dataset.DatasetID), view))
+	it, err := query.Read(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to query INFORMATION_SCHEMA.%s: %w", view, err)
+	}
+
+	// Cancelling the writer's context discards the snapshot written so far,
+	// instead of leaving a truncated one in the backup.
+	writerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	writer := storageClient.Bucket(bucketName).Object(informationSchemaPath(projectID, date, dataset.DatasetID, view)).NewWriter(writerCtx)
+	writer.ContentType = "application/x-ndjson"
+	encoder := json.NewEncoder(writer)
+	for {
+		row := make(map[string]bigquery.Value)
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err == nil {
+			err = encoder.Encode(row)
+		}
+		if err != nil {
+			cancel()
+			writer.Close()
+			return fmt.Errorf("failed to snapshot INFORMATION_SCHEMA.%s: %w", view, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to write INFORMATION_SCHEMA.%s: %w", view, err)
+	}
+	return nil
+}
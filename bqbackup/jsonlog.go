@@ -0,0 +1,78 @@
+package bqbackup
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// jsonStdout routes everything printed to stdout, including the output of
+// hooks, through JSON log records, so that with --k8s stdout is one JSON
+// object per line as log collectors expect. A nil *jsonStdout does nothing.
+type jsonStdout struct {
+	stdout *os.File
+	pipe   *os.File
+	done   chan struct{}
+
+	mu sync.Mutex
+}
+
+// jsonLogRecord is a line printed while stdout is routed through JSON.
+type jsonLogRecord struct {
+	Time     time.Time `json:"time"`
+	Severity string    `json:"severity"`
+	Message  string    `json:"message"`
+}
+
+// startJSONStdout replaces os.Stdout with a pipe whose lines are written to
+// the real stdout as JSON log records.
+func startJSONStdout() (*jsonStdout, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	j := &jsonStdout{stdout: os.Stdout, pipe: w, done: make(chan struct{})}
+	os.Stdout = w
+	go func() {
+		defer close(j.done)
+		defer r.Close()
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				j.writeJSON(jsonLogRecord{Time: time.Now().UTC(), Severity: "INFO", Message: line})
+			}
+		}
+	}()
+	return j, nil
+}
+
+// writeJSON writes v to the real stdout as one line, or to os.Stdout if
+// stdout is not routed.
+func (j *jsonStdout) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if j == nil {
+		_, err = fmt.Fprintln(os.Stdout, string(data))
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = fmt.Fprintln(j.stdout, string(data))
+	return err
+}
+
+// close writes out the lines still in the pipe and restores os.Stdout.
+func (j *jsonStdout) close() {
+	if j == nil {
+		return
+	}
+	os.Stdout = j.stdout
+	j.pipe.Close()
+	<-j.done
+}
@@ -0,0 +1,154 @@
+package bqbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// backupRuns are the runs of a project on one date. A later run replaces the
+// files of the tables it backed up again, so the newest result of each table
+// is the one whose files are in the bucket.
+type backupRuns struct {
+	results map[string]tableResult
+}
+
+func newBackupRuns() *backupRuns {
+	return &backupRuns{results: make(map[string]tableResult)}
+}
+
+// add records the results of a run, which must be added oldest first.
+func (b *backupRuns) add(results []tableResult, datasetID string) {
+	for _, r := range results {
+		if r.DatasetID == datasetID {
+			b.results[r.TableID] = r
+		}
+	}
+}
+
+// covers reports whether the runs backed up the table, or every table of the
+// dataset they attempted if tableID is empty, without a failure.
+func (b *backupRuns) covers(tableID string) bool {
+	if tableID != "" {
+		r, ok := b.results[tableID]
+		return ok && (r.Status == statusSuccess || r.Simulated)
+	}
+	succeeded := false
+	for _, r := range b.results {
+		if r.failed() {
+			return false
+		}
+		succeeded = succeeded || r.Status == statusSuccess || r.Simulated
+	}
+	return succeeded
+}
+
+// latestCompleteBackup returns the date of the newest backup of a dataset, or
+// only of tableID in it, that has no failures and whose files are still in
+// the bucket. Only dates before the before date are considered, unless it is
+// empty. The catalog in stateDir is consulted first; the manifests in the bucket are read
+// when it has no such backup, as on a machine other than the one that ran
+// the backups.
+func latestCompleteBackup(ctx context.Context, stateDir string, storageClient *storage.Client, bucketName, projectID, datasetID, tableID, before string) (string, error) {
+	entries, err := readCatalog(stateDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("Failed to read catalog, looking at the manifests in the bucket: %v\n", err)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Started.Before(entries[j].Started) })
+	byDate := make(map[string]*backupRuns)
+	for _, entry := range entries {
+		if !entry.isBackup() || entry.ProjectID != projectID || entry.Finished.IsZero() || entry.TimedOut {
+			continue
+		}
+		// A backup of one table says nothing about the rest of its dataset.
+		if tableID == "" && entry.Scope != nil && entry.Scope.TableID != "" {
+			continue
+		}
+		// Entries from before the bucket was recorded are checked against
+		// the bucket below.
+		if entry.Bucket != "" && entry.Bucket != bucketName {
+			continue
+		}
+		if before != "" && entry.Date >= before {
+			continue
+		}
+		if byDate[entry.Date] == nil {
+			byDate[entry.Date] = newBackupRuns()
+		}
+		byDate[entry.Date].add(entry.Tables, datasetID)
+	}
+	dates := make([]string, 0, len(byDate))
+	for date := range byDate {
+		dates = append(dates, date)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(dates)))
+	for _, date := range dates {
+		if !byDate[date].covers(tableID) {
+			continue
+		}
+		ok, err := backupInBucket(ctx, storageClient, bucketName, projectID, date, datasetID, tableID)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return date, nil
+		}
+		fmt.Printf("Skipping the backup from %s in the catalog, its files are no longer in the bucket\n", date)
+	}
+
+	prefixes, err := listPrefixes(ctx, storageClient, bucketName, pathSegment(projectID)+"/")
+	if err != nil {
+		return "", err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(prefixes)))
+	for _, prefix := range prefixes {
+		date := parsePathSegment(path.Base(prefix))
+		if _, err := time.Parse("2006-01-02", date); err != nil || before != "" && date >= before {
+			continue
+		}
+		names, err := listManifests(ctx, storageClient, bucketName, prefix)
+		if err != nil {
+			return "", err
+		}
+		var manifests []backupManifest
+		for _, name := range names {
+			m, err := readManifest(ctx, storageClient, bucketName, name)
+			if err != nil {
+				return "", fmt.Errorf("%s: %w", name, err)
+			}
+			manifests = append(manifests, m)
+		}
+		slices.SortStableFunc(manifests, func(a, b backupManifest) int { return a.Started.Compare(b.Started) })
+		runs := newBackupRuns()
+		for _, m := range manifests {
+			if tableID == "" && m.Provenance != nil && m.Provenance.Config.TableID != "" {
+				continue
+			}
+			runs.add(m.TableResults, datasetID)
+		}
+		if runs.covers(tableID) {
+			return date, nil
+		}
+	}
+	return "", nil
+}
+
+// backupInBucket reports whether the files of the dataset, or of tableID in
+// it, backed up on date are still in the bucket.
+func backupInBucket(ctx context.Context, storageClient *storage.Client, bucketName, projectID, date, datasetID, tableID string) (bool, error) {
+	tables, err := listBackupTables(ctx, storageClient, bucketName, projectID, date, datasetID)
+	if err != nil {
+		return false, err
+	}
+	if tableID != "" {
+		return slices.Contains(tables, tableID), nil
+	}
+	return len(tables) > 0, nil
+}
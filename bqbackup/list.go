@@ -0,0 +1,56 @@
+package bqbackup
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// runList prints the backups recorded in the catalog, newest first,
+// optionally narrowed down to a project or a run tag.
+func runList(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	projectID := fs.String("project", "", "Only list backups of this project")
+	tag := fs.String("tag", "", "Only list backups of runs tagged with --run-tag=TAG")
+	stateDir := fs.String("state-dir", defaultStateDir, "Directory containing the catalog")
+	fs.Parse(args)
+
+	entries, err := readCatalog(*stateDir)
+	if err != nil {
+		fmt.Printf("Failed to read catalog: %v\n", err)
+		os.Exit(1)
+	}
+
+	var backups []catalogEntry
+	for _, entry := range entries {
+		if !entry.isBackup() || (*projectID != "" && entry.ProjectID != *projectID) || (*tag != "" && !entry.hasTag(*tag)) {
+			continue
+		}
+		backups = append(backups, entry)
+	}
+	if len(backups) == 0 {
+		fmt.Println("No backups found")
+		return
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Started.After(backups[j].Started) })
+
+	for _, entry := range backups {
+		status := statusSuccess
+		if !isCompleteBackup(entry) {
+			status = statusFailed
+		}
+		line := fmt.Sprintf("%s %s %s run %s: %d tables, %d failed", status, entry.Date, entry.ProjectID, entry.RunID, len(entry.Tables), countFailed(entry))
+		if entry.Scope != nil {
+			line += fmt.Sprintf(" (adhoc backup of %s)", entry.Scope)
+		}
+		if entry.TimedOut {
+			line += " (timed out)"
+		}
+		if len(entry.Tags) > 0 {
+			line += fmt.Sprintf(" [%s]", strings.Join(entry.Tags, ", "))
+		}
+		fmt.Println(line)
+	}
+}
@@ -0,0 +1,143 @@
+package bqbackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const manifestFileName = "_COMPLETE.json"
+
+// backupManifest is written under the project/date prefix once every dataset
+// of a run has finished, so downstream jobs can poll for it.
+type backupManifest struct {
+	// SchemaVersion is manifestVersion for manifests written by this build.
+	SchemaVersion int           `json:"schema_version"`
+	ProjectID     string        `json:"project_id"`
+	Date          string        `json:"date"`
+	RunID         string        `json:"run_id"`
+	Tags          []string      `json:"tags,omitempty"`
+	Started       time.Time     `json:"started"`
+	Finished      time.Time     `json:"finished"`
+	Complete      bool          `json:"complete"`
+	Tables        int           `json:"tables"`
+	Succeeded     int           `json:"succeeded"`
+	Failed        int           `json:"failed"`
+	Skipped       int           `json:"skipped"`
+	ExportedBytes int64         `json:"exported_bytes"`
+	ExportedFiles int           `json:"exported_files"`
+	Datasets      []string      `json:"datasets"`
+	TableResults  []tableResult `json:"table_results"`
+	// Provenance records how the backup was taken.
+	Provenance *runProvenance `json:"provenance,omitempty"`
+}
+
+func newManifest(entry catalogEntry) backupManifest {
+	m := backupManifest{
+		ProjectID:    entry.ProjectID,
+		Date:         entry.Date,
+		RunID:        entry.RunID,
+		Tags:         entry.Tags,
+		Started:      entry.Started,
+		Finished:     entry.Finished,
+		Tables:       len(entry.Tables),
+		TableResults: entry.Tables,
+	}
+	m.SchemaVersion = manifestVersion
+
+	datasets := make(map[string]bool)
+	for _, t := range entry.Tables {
+		switch t.Status {
+		case statusSuccess:
+			m.Succeeded++
+		case statusFailed:
+			m.Failed++
+		case statusSkipped:
+			m.Skipped++
+		}
+		m.ExportedBytes += t.ExportedBytes
+		m.ExportedFiles += t.ExportedFiles
+		if !datasets[t.DatasetID] {
+			datasets[t.DatasetID] = true
+			m.Datasets = append(m.Datasets, t.DatasetID)
+		}
+	}
+	sort.Strings(m.Datasets)
+	m.Complete = isCompleteBackup(entry)
+	return m
+}
+
+// manifestPath returns where the manifest of a run is written. Runs narrowed
+// to a dataset or table pass their run ID, so their manifest gets its own name
+// and doesn't replace the marker of the full project backup.
+func manifestPath(projectID, date, narrowedRunID string) string {
+	if narrowedRunID != "" {
+		return fmt.Sprintf("%s/_COMPLETE_%s.json", backupPath(projectID, date), narrowedRunID)
+	}
+	return backupPath(projectID, date) + "/" + manifestFileName
+}
+
+// writeManifest writes the manifest and, with --kms-key, its signature. The
+// manifest of a narrowed run gets its own name.
+func writeManifest(ctx context.Context, store objectStore, signer *manifestSigner, bucketName string, m backupManifest, narrowed bool) (string, error) {
+	name := manifestPath(m.ProjectID, m.Date, "")
+	if narrowed {
+		name = manifestPath(m.ProjectID, m.Date, m.RunID)
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	// Consumers poll for the manifest, so it is written last, once its
+	// signature is in place.
+	sig, err := signer.sign(ctx, data)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign manifest: %w", err)
+	}
+	if sig != nil {
+		if err := writeJSONObject(ctx, store, bucketName, name+signatureSuffix, sig); err != nil {
+			return "", fmt.Errorf("failed to write manifest signature: %w", err)
+		}
+	}
+	if err := store.Write(ctx, bucketName, name, data); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("gs://%s/%s", bucketName, name), nil
+}
+
+// sendCompletionEvent tells downstream pipelines at webhookURL that a backup
+// has finished and where its manifest is.
+func sendCompletionEvent(webhookURL string, m backupManifest, manifestURL string) {
+	event := map[string]interface{}{
+		"event":        "backup_complete",
+		"project_id":   m.ProjectID,
+		"date":         m.Date,
+		"run_id":       m.RunID,
+		"tags":         m.Tags,
+		"complete":     m.Complete,
+		"tables":       m.Tables,
+		"failed":       m.Failed,
+		"manifest_url": manifestURL,
+	}
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		fmt.Printf("Failed to marshal completion event: %v\n", err)
+		return
+	}
+
+	resp, err := http.Post(webhookURL, "application/json", bytes.NewBuffer(eventJSON))
+	if err != nil {
+		fmt.Printf("Failed to send completion event: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		fmt.Printf("Failed to send completion event, received status code: %d\n", resp.StatusCode)
+	}
+}
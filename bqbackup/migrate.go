@@ -0,0 +1,419 @@
+package bqbackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+// Schema versions of the catalog entries and _COMPLETE.json manifests this
+// build writes. Documents written before versioning are version 0. Bump a
+// version whenever its format changes in a way older readers would misread,
+// and add the migration from the previous version.
+const (
+	catalogVersion  = 1
+	manifestVersion = 1
+)
+
+// migration upgrades a document by one schema version. It works on the
+// decoded JSON, so fields that were since renamed or removed can still be
+// read.
+type migration func(doc map[string]any) error
+
+// catalogMigrations[v] upgrades a catalog entry from version v to v+1.
+var catalogMigrations = []migration{
+	0: classifyLegacyFailures("tables"),
+}
+
+// manifestMigrations[v] upgrades a manifest from version v to v+1.
+var manifestMigrations = []migration{
+	0: classifyLegacyFailures("table_results"),
+}
+
+// errNewerSchema is returned for documents written by a newer bq-backup.
+var errNewerSchema = errors.New("written by a newer version of bq-backup, upgrade it to read this")
+
+// classifyLegacyFailures marks failed tables recorded before failures were
+// classified as unknown, so they are counted under a class like newer ones.
+func classifyLegacyFailures(field string) migration {
+	return func(doc map[string]any) error {
+		tables, _ := doc[field].([]any)
+		for _, t := range tables {
+			table, ok := t.(map[string]any)
+			if !ok {
+				return fmt.Errorf("unexpected table result %v", t)
+			}
+			if class, _ := table["error_class"].(string); table["status"] == statusFailed && class == "" {
+				table["error_class"] = errorClassUnknown
+			}
+		}
+		return nil
+	}
+}
+
+// migrateDocument upgrades the JSON document data to version current and
+// reports whether it had to be changed.
+func migrateDocument(data []byte, current int, migrations []migration) ([]byte, bool, error) {
+	var header struct {
+		SchemaVersion int `json:"schema_version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, false, err
+	}
+	if header.SchemaVersion > current {
+		return nil, false, fmt.Errorf("schema version %d: %w", header.SchemaVersion, errNewerSchema)
+	}
+	if header.SchemaVersion == current {
+		return data, false, nil
+	}
+
+	var doc map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// Keep byte and row counts exact rather than going through float64.
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, false, err
+	}
+	for v := header.SchemaVersion; v < current; v++ {
+		if err := migrations[v](doc); err != nil {
+			return nil, false, fmt.Errorf("failed to migrate from schema version %d: %w", v, err)
+		}
+	}
+	doc["schema_version"] = current
+	migrated, err := json.Marshal(doc)
+	return migrated, true, err
+}
+
+// parseManifest reads a manifest of any schema version.
+func parseManifest(data []byte) (backupManifest, error) {
+	var m backupManifest
+	migrated, _, err := migrateDocument(data, manifestVersion, manifestMigrations)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(migrated, &m)
+	return m, err
+}
+
+// readManifest reads and parses the manifest object name.
+func readManifest(ctx context.Context, storageClient *storage.Client, bucketName, name string) (backupManifest, error) {
+	data, err := gcsStore{storageClient}.Read(ctx, bucketName, name)
+	if err != nil {
+		return backupManifest{}, err
+	}
+	return parseManifest(data)
+}
+
+// runMigrateState upgrades the local catalog and the manifests in a bucket to
+// the schema versions of this build, and moves backups written before IDs
+// were encoded in paths to their encoded paths. Readers upgrade older documents as they
+// read them, so this is only needed to keep the stored metadata readable by
+// tools other than bq-backup.
+func runMigrateState(args []string) {
+	fs := flag.NewFlagSet("migrate-state", flag.ExitOnError)
+	stateDir := fs.String("state-dir", defaultStateDir, "Directory containing the catalog (empty skips it)")
+	bucketName := fs.String("bucket", "", "GCS bucket whose manifests to upgrade (optional)")
+	projectList := fs.String("projects", "", "Comma-separated projects whose manifests to upgrade (defaults to every project in the bucket)")
+	dryRun := fs.Bool("dry-run", false, "Only report what would be upgraded")
+	fs.Parse(args)
+
+	if *stateDir == "" && *bucketName == "" {
+		fmt.Println("Usage: bq-backup migrate-state [--state-dir=DIR] [--bucket=BUCKET_NAME [--projects=PROJECT_IDS]] [--dry-run]")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+
+	failed := false
+	if *stateDir != "" {
+		if err := migrateCatalog(*stateDir, *dryRun); err != nil {
+			fmt.Printf("Failed to migrate catalog: %v\n", err)
+			failed = true
+		}
+	}
+	if *bucketName != "" {
+		ctx := context.Background()
+		storageClient, err := storage.NewClient(ctx)
+		if err != nil {
+			fmt.Printf("Failed to create Storage client: %v\n", err)
+			os.Exit(1)
+		}
+		defer storageClient.Close()
+		if err := migratePaths(ctx, storageClient, *bucketName, splitList(*projectList), *dryRun); err != nil {
+			fmt.Printf("Failed to migrate paths: %v\n", err)
+			failed = true
+		}
+		if err := migrateManifests(ctx, storageClient, *bucketName, splitList(*projectList), *dryRun); err != nil {
+			fmt.Printf("Failed to migrate manifests: %v\n", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// migrateCatalog rewrites the catalog in stateDir with every entry at
+// catalogVersion, keeping the old file as catalog.jsonl.bak.
+func migrateCatalog(stateDir string, dryRun bool) error {
+	file := filepath.Join(stateDir, catalogFileName)
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Printf("No catalog in %s\n", stateDir)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	upgraded := 0
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		migrated, changed, err := migrateDocument(line, catalogVersion, catalogMigrations)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if changed {
+			upgraded++
+		}
+		out.Write(migrated)
+		out.WriteByte('\n')
+	}
+	fmt.Printf("Catalog: %d of %d entries upgraded to schema version %d\n", upgraded, len(lines), catalogVersion)
+	if upgraded == 0 || dryRun {
+		return nil
+	}
+
+	if err := os.WriteFile(file+".bak", data, 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(file+".tmp", out.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// migrateManifests rewrites the manifests of projects, or of every project in
+// the bucket, at manifestVersion. Signed manifests are left alone, as their
+// signature covers the bytes as written; readers upgrade them when reading.
+func migrateManifests(ctx context.Context, storageClient *storage.Client, bucketName string, projects []string, dryRun bool) error {
+	prefixes := make([]string, 0, len(projects))
+	for _, projectID := range projects {
+		prefixes = append(prefixes, pathSegment(projectID)+"/")
+	}
+	if len(prefixes) == 0 {
+		var err error
+		if prefixes, err = listPrefixes(ctx, storageClient, bucketName, ""); err != nil {
+			return err
+		}
+	}
+
+	var total, upgraded, signed int
+	for _, projectPrefix := range prefixes {
+		dates, err := listPrefixes(ctx, storageClient, bucketName, projectPrefix)
+		if err != nil {
+			return err
+		}
+		for _, datePrefix := range dates {
+			names, err := listManifests(ctx, storageClient, bucketName, datePrefix)
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				total++
+				object := storageClient.Bucket(bucketName).Object(name)
+				attrs, err := object.Attrs(ctx)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				data, err := gcsStore{storageClient}.Read(ctx, bucketName, name)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				migrated, changed, err := migrateDocument(data, manifestVersion, manifestMigrations)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				if !changed {
+					continue
+				}
+				if _, err := storageClient.Bucket(bucketName).Object(name + signatureSuffix).Attrs(ctx); err == nil {
+					fmt.Printf("Leaving signed manifest gs://%s/%s at its schema version\n", bucketName, name)
+					signed++
+					continue
+				} else if !errors.Is(err, storage.ErrObjectNotExist) {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				upgraded++
+				if dryRun {
+					fmt.Printf("Would upgrade gs://%s/%s\n", bucketName, name)
+					continue
+				}
+				var indented bytes.Buffer
+				if err := json.Indent(&indented, migrated, "", "  "); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				// Only replace the version that was read.
+				writer := object.If(storage.Conditions{GenerationMatch: attrs.Generation}).NewWriter(ctx)
+				writer.ContentType = "application/json"
+				if _, err := writer.Write(indented.Bytes()); err != nil {
+					writer.Close()
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				if err := writer.Close(); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				fmt.Printf("Upgraded gs://%s/%s\n", bucketName, name)
+			}
+		}
+	}
+	fmt.Printf("Manifests: %d of %d upgraded to schema version %d, %d signed ones left as they are\n", upgraded, total, manifestVersion, signed)
+	return nil
+}
+
+// migratePaths moves the files of projects, or of every project in the
+// bucket, that were written under raw IDs before IDs were percent-encoded in
+// paths to the paths pathSegment gives them, so restore, verify, list and
+// retention find them. Files of IDs that need no encoding are already where
+// they belong. A file whose encoded path is taken is left in place and
+// reported.
+func migratePaths(ctx context.Context, storageClient *storage.Client, bucketName string, projects []string, dryRun bool) error {
+	var prefixes []string
+	for _, projectID := range projects {
+		prefixes = append(prefixes, projectID+"/")
+		if encoded := pathSegment(projectID) + "/"; encoded != projectID+"/" {
+			prefixes = append(prefixes, encoded)
+		}
+	}
+	if len(prefixes) == 0 {
+		var err error
+		if prefixes, err = listPrefixes(ctx, storageClient, bucketName, ""); err != nil {
+			return err
+		}
+	}
+
+	bucket := storageClient.Bucket(bucketName)
+	var moved, conflicts int
+	for _, prefix := range prefixes {
+		objects, err := listObjects(ctx, gcsStore{storageClient}, bucketName, prefix)
+		if err != nil {
+			return err
+		}
+		for _, attrs := range objects {
+			name, ok := encodedBackupPath(attrs.Name)
+			if !ok || name == attrs.Name {
+				continue
+			}
+			if dryRun {
+				fmt.Printf("Would move gs://%s/%s to %s\n", bucketName, attrs.Name, name)
+				moved++
+				continue
+			}
+			_, err := bucket.Object(name).If(storage.Conditions{DoesNotExist: true}).CopierFrom(bucket.Object(attrs.Name)).Run(ctx)
+			var apiErr *googleapi.Error
+			if errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+				fmt.Printf("Leaving gs://%s/%s, %s already exists\n", bucketName, attrs.Name, name)
+				conflicts++
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", attrs.Name, err)
+			}
+			if err := bucket.Object(attrs.Name).If(storage.Conditions{GenerationMatch: attrs.Generation}).Delete(ctx); err != nil {
+				return fmt.Errorf("%s: copied to %s but failed to delete it: %w", attrs.Name, name, err)
+			}
+			moved++
+		}
+	}
+	fmt.Printf("Paths: %d files moved to their encoded paths, %d left in place\n", moved, conflicts)
+	if conflicts > 0 {
+		return fmt.Errorf("%d files could not be moved", conflicts)
+	}
+	return nil
+}
+
+// encodedBackupPath returns the name a backup file written under raw IDs has
+// with its IDs encoded, or false if name is not in the
+// PROJECT/DATE/DATASET/TABLE layout. Encoded names are returned unchanged.
+func encodedBackupPath(name string) (string, bool) {
+	segments := strings.Split(name, "/")
+	if len(segments) < 3 {
+		return "", false
+	}
+	if _, err := time.Parse("2006-01-02", segments[1]); err != nil {
+		return "", false
+	}
+	reencode := func(segment string) string { return pathSegment(parsePathSegment(segment)) }
+	segments[0] = reencode(segments[0])
+	switch {
+	case len(segments) == 3:
+		// A file of the date, e.g. its manifest.
+	case len(segments) == 4:
+		// A file of the dataset; only the schema and keys of its tables are
+		// named after an ID.
+		segments[2] = reencode(segments[2])
+		for _, suffix := range []string{schemaFileSuffix, constraintsFileSuffix} {
+			if tableID, ok := strings.CutSuffix(segments[3], suffix); ok {
+				segments[3] = reencode(tableID) + suffix
+			}
+		}
+	default:
+		segments[2] = reencode(segments[2])
+		segments[3] = reencode(segments[3])
+	}
+	return strings.Join(segments, "/"), true
+}
+
+// listPrefixes returns the "directories" directly under prefix.
+func listPrefixes(ctx context.Context, storageClient *storage.Client, bucketName, prefix string) ([]string, error) {
+	it := storageClient.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: "/"})
+	var prefixes []string
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return prefixes, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if attrs.Prefix != "" {
+			prefixes = append(prefixes, attrs.Prefix)
+		}
+	}
+}
+
+// listManifests returns the manifests directly under a date's prefix,
+// including those of narrowed runs.
+func listManifests(ctx context.Context, storageClient *storage.Client, bucketName, prefix string) ([]string, error) {
+	it := storageClient.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: "/"})
+	var names []string
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		base := path.Base(attrs.Name)
+		if attrs.Prefix == "" && strings.HasPrefix(base, "_COMPLETE") && strings.HasSuffix(base, ".json") {
+			names = append(names, attrs.Name)
+		}
+	}
+}
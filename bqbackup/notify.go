@@ -0,0 +1,355 @@
+package bqbackup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Discord embed descriptions and Google Chat messages are capped at 4096
+	// characters; leave room for the title and continuation markers.
+	maxNotificationLength   = 4000
+	maxNotificationAttempts = 5
+)
+
+// reporter collects the table outcomes of one project's run and sends its
+// notifications. Each project gets its own, so nothing about a run's
+// notifications is shared between goroutines or runs.
+type reporter struct {
+	discordWebhook   string
+	workspaceWebhook string
+	tagIDs           []string
+
+	// note is added to the notifications, e.g. when a run timed out.
+	note string
+	// breaker abandons the project after too many failures in a row.
+	breaker *circuitBreaker
+	// excluded are the project's datasets the run left out.
+	excluded []excludedDataset
+	// replicaFailures are the objects that failed to copy to replicateDir.
+	replicaFailures []string
+	replicateDir    string
+	// readbackSLO is how long read-back probes may take before they are
+	// reported.
+	readbackSLO time.Duration
+	// alerts sends the project's failures while it is still running.
+	alerts *failureAlerts
+
+	mu      sync.Mutex
+	results []tableResult
+}
+
+// snapshot returns a reporter with a copy of the results so far, which can
+// be sent while tables are still finishing.
+func (r *reporter) snapshot() *reporter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &reporter{
+		discordWebhook:   r.discordWebhook,
+		workspaceWebhook: r.workspaceWebhook,
+		tagIDs:           r.tagIDs,
+		excluded:         r.excluded,
+		replicateDir:     r.replicateDir,
+		readbackSLO:      r.readbackSLO,
+		alerts:           r.alerts,
+		results:          append([]tableResult(nil), r.results...),
+	}
+}
+
+func newReporter(discordWebhook, workspaceWebhook string, tagIDs []string) *reporter {
+	return &reporter{discordWebhook: discordWebhook, workspaceWebhook: workspaceWebhook, tagIDs: tagIDs}
+}
+
+// sendNotifications sends the run's summary to every configured channel,
+// giving up once ctx is done.
+func (r *reporter) sendNotifications(ctx context.Context, projectID string) {
+	if r.workspaceWebhook != "" {
+		r.sendWorkspaceNotification(ctx, projectID)
+	}
+	if r.discordWebhook != "" {
+		r.sendDiscordNotification(ctx, projectID)
+	}
+}
+
+func (r *reporter) sendWorkspaceNotification(ctx context.Context, projectID string) {
+	message := "*Backup Daily Big Query " + time.Now().Format("2006-01-02") + "*\n"
+	message += "*| `Dataset` | `Table` | `Status` | `Reason` |*\n"
+	message += "|---------------------------------------------\n"
+	for _, line := range notificationLines(r.results, r.alerts.batches(), workspaceTableLine, workspaceGroupLine) {
+		message += line + "\n"
+	}
+	if classes := formatFailureClasses(r.results); classes != "" {
+		message += fmt.Sprintf("*Failures by class:* %s\n", classes)
+	}
+	if r.note != "" {
+		message += fmt.Sprintf("*%s*\n", r.note)
+	}
+	if changes := formatSchemaChanges(r.results); len(changes) > 0 {
+		message += "*Schema changed*\n"
+		for _, line := range changes {
+			message += line + "\n"
+		}
+	}
+	if slow := formatSlowReadbacks(r.results, r.readbackSLO); len(slow) > 0 {
+		message += fmt.Sprintf("*Read-back over %s*\n", r.readbackSLO)
+		for _, line := range slow {
+			message += line + "\n"
+		}
+	}
+	if gaps := formatCoverageGaps(r.excluded, r.results); len(gaps) > 0 {
+		message += "*Not covered*\n"
+		for _, line := range gaps {
+			message += line + "\n"
+		}
+	}
+	if len(r.replicaFailures) > 0 {
+		message += fmt.Sprintf("*Replication to %s failed for %d objects*\n", r.replicateDir, len(r.replicaFailures))
+		for _, line := range formatReplicaFailures(r.replicaFailures) {
+			message += line + "\n"
+		}
+	}
+	if slowest := formatSlowestTables(r.results, slowestTablesCount); len(slowest) > 0 {
+		message += "*Slowest tables*\n"
+		for _, line := range slowest {
+			message += line + "\n"
+		}
+	}
+	message += fmt.Sprintf("-------------| *Project : %s*\n", projectID)
+
+	sendWorkspaceMessage(ctx, r.workspaceWebhook, message)
+}
+
+func sendWorkspaceMessage(ctx context.Context, webhookURL, message string) {
+	for _, chunk := range splitMessage(message, maxNotificationLength) {
+		workspaceMessage := map[string]string{"text": chunk}
+		workspaceMessageJSON, err := json.Marshal(workspaceMessage)
+		if err != nil {
+			fmt.Printf("Failed to marshal Google Workspace message: %v\n", err)
+			return
+		}
+
+		if err := postWithRateLimit(ctx, webhookURL, workspaceMessageJSON, http.StatusOK); err != nil {
+			fmt.Printf("Failed to send Google Workspace notification: %v\n", err)
+			return
+		}
+	}
+}
+
+func (r *reporter) sendDiscordNotification(ctx context.Context, projectID string) {
+	if len(r.results) == 0 {
+		fmt.Println("No messages to send to Discord.")
+		return
+	}
+
+	message := fmt.Sprintf(time.Now().Format("2006-01-02") + "\n\n")
+	for _, line := range notificationLines(r.results, r.alerts.batches(), discordTableLine, discordGroupLine) {
+		message += fmt.Sprintf("%s\n", line)
+	}
+	if classes := formatFailureClasses(r.results); classes != "" {
+		message += fmt.Sprintf("\n**Failures by class:** %s\n", classes)
+	}
+	if r.note != "" {
+		message += fmt.Sprintf("\n**%s**\n", r.note)
+	}
+	if changes := formatSchemaChanges(r.results); len(changes) > 0 {
+		message += "\n**Schema changed**\n"
+		for _, line := range changes {
+			message += line + "\n"
+		}
+	}
+	if slow := formatSlowReadbacks(r.results, r.readbackSLO); len(slow) > 0 {
+		message += fmt.Sprintf("\n**Read-back over %s**\n", r.readbackSLO)
+		for _, line := range slow {
+			message += line + "\n"
+		}
+	}
+	if gaps := formatCoverageGaps(r.excluded, r.results); len(gaps) > 0 {
+		message += "\n**Not covered**\n"
+		for _, line := range gaps {
+			message += line + "\n"
+		}
+	}
+	if len(r.replicaFailures) > 0 {
+		message += fmt.Sprintf("\n**Replication to %s failed for %d objects**\n", r.replicateDir, len(r.replicaFailures))
+		for _, line := range formatReplicaFailures(r.replicaFailures) {
+			message += line + "\n"
+		}
+	}
+	if slowest := formatSlowestTables(r.results, slowestTablesCount); len(slowest) > 0 {
+		message += "\n**Slowest tables**\n"
+		for _, line := range slowest {
+			message += line + "\n"
+		}
+	}
+	message += fmt.Sprintf("\n\nProject : %s", projectID)
+
+	sendDiscordMessage(ctx, r.discordWebhook, "BigQuery Backup Notification", message)
+}
+
+func sendDiscordMessage(ctx context.Context, webhookURL, title, message string) {
+	chunks := splitMessage(message, maxNotificationLength)
+	for i, chunk := range chunks {
+		chunkTitle := title
+		if len(chunks) > 1 {
+			chunkTitle = fmt.Sprintf("%s (%d/%d)", title, i+1, len(chunks))
+		}
+
+		embed := map[string]interface{}{
+			"title":       chunkTitle,
+			"description": chunk,
+			"color":       16711680, // Red color
+		}
+
+		discordMessage := map[string]interface{}{
+			"content": "",
+			"embeds":  []map[string]interface{}{embed},
+		}
+
+		discordMessageJSON, err := json.Marshal(discordMessage)
+		if err != nil {
+			fmt.Printf("Failed to marshal Discord message: %v\n", err)
+			return
+		}
+
+		if err := postWithRateLimit(ctx, webhookURL, discordMessageJSON, http.StatusNoContent); err != nil {
+			fmt.Printf("Failed to send Discord notification: %v\n", err)
+			return
+		}
+	}
+}
+
+// notificationLines renders one line per table, except that failures alerted
+// together while the project ran are combined into a single line again, so a
+// failing dataset doesn't flood the summary either.
+func notificationLines(results []tableResult, batches [][]tableResult, tableLine func(tableResult) string, groupLine func(datasetID, status string, group []tableResult) string) []string {
+	batchOf := make(map[string]int)
+	for i, batch := range batches {
+		if len(batch) > 1 {
+			for _, r := range batch {
+				batchOf[r.DatasetID+"."+r.TableID] = i + 1
+			}
+		}
+	}
+
+	var lines []string
+	listed := make(map[int]bool)
+	for _, r := range results {
+		i := batchOf[r.DatasetID+"."+r.TableID]
+		if i == 0 {
+			lines = append(lines, tableLine(r))
+			continue
+		}
+		if !listed[i] {
+			listed[i] = true
+			lines = append(lines, groupLine(r.DatasetID, r.Status, batches[i-1]))
+		}
+	}
+	return lines
+}
+
+func notificationReason(r tableResult) string {
+	if r.ErrorClass != "" {
+		return fmt.Sprintf("[%s] %s", r.ErrorClass, logReason(r))
+	}
+	return logReason(r)
+}
+
+func groupSummary(status string, group []tableResult) string {
+	summary := fmt.Sprintf("%d tables", len(group))
+	if status == statusFailed {
+		summary += fmt.Sprintf(" (%s), e.g. %s", formatFailureClasses(group), truncate(group[0].Reason, 200))
+	}
+	return summary
+}
+
+func discordTableLine(r tableResult) string {
+	return fmt.Sprintf("* **%s** (`%s`) - %s > %s", r.DatasetID, r.TableID, r.Status, notificationReason(r))
+}
+
+func discordGroupLine(datasetID, status string, group []tableResult) string {
+	return fmt.Sprintf("* **%s** - %s > %s", datasetID, status, groupSummary(status, group))
+}
+
+func workspaceTableLine(r tableResult) string {
+	return fmt.Sprintf("| `%s` | `%s` | `%s` | `%s` |", r.DatasetID, r.TableID, r.Status, notificationReason(r))
+}
+
+func workspaceGroupLine(datasetID, status string, group []tableResult) string {
+	return fmt.Sprintf("| `%s` | `*` | `%s` | `%s` |", datasetID, status, groupSummary(status, group))
+}
+
+// splitMessage splits message on line boundaries into chunks of at most limit
+// characters.
+func splitMessage(message string, limit int) []string {
+	var chunks []string
+	var current strings.Builder
+	for _, line := range strings.SplitAfter(message, "\n") {
+		if len([]rune(line)) > limit {
+			line = string([]rune(line)[:limit-4]) + "...\n"
+		}
+		if current.Len() > 0 && len([]rune(current.String()))+len([]rune(line)) > limit {
+			chunks = append(chunks, current.String())
+			current.Reset()
+		}
+		current.WriteString(line)
+	}
+	if current.Len() > 0 {
+		chunks = append(chunks, current.String())
+	}
+	return chunks
+}
+
+// postWithRateLimit posts payload, waiting out 429 responses and pausing when
+// the webhook reports its rate limit bucket is exhausted, so queued messages
+// are delivered in order without being dropped. It gives up once ctx is
+// done.
+func postWithRateLimit(ctx context.Context, url string, payload []byte, okStatus int) error {
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < maxNotificationAttempts {
+			select {
+			case <-time.After(retryAfter(resp, time.Duration(attempt)*time.Second)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		if resp.StatusCode != okStatus {
+			return fmt.Errorf("received status code: %d", resp.StatusCode)
+		}
+
+		if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			select {
+			case <-time.After(retryAfter(resp, time.Second)):
+			case <-ctx.Done():
+			}
+		}
+		return nil
+	}
+}
+
+func retryAfter(resp *http.Response, fallback time.Duration) time.Duration {
+	for _, header := range []string{"Retry-After", "X-RateLimit-Reset-After"} {
+		if seconds, err := strconv.ParseFloat(resp.Header.Get(header), 64); err == nil && seconds > 0 {
+			return time.Duration(seconds * float64(time.Second))
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,102 @@
+package bqbackup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// requiresPartitionFilter reports whether queries on the table must filter on
+// its partition column, which makes a plain SELECT * fail.
+func requiresPartitionFilter(meta *bigquery.TableMetadata) bool {
+	if meta.RequirePartitionFilter {
+		return true
+	}
+	if meta.TimePartitioning != nil && meta.TimePartitioning.RequirePartitionFilter {
+		return true
+	}
+	config := meta.ExternalDataConfig
+	return config != nil && config.HivePartitioningOptions != nil && config.HivePartitioningOptions.RequirePartitionFilter
+}
+
+// partitionFilter returns a WHERE clause that selects every partition of the
+// table, including the NULL partition, or "" if the table doesn't require a
+// partition filter. The clause is an explicit range over the partition column
+// so it is accepted as a partition filter.
+func partitionFilter(ctx context.Context, client *bigquery.Client, table *bigquery.Table, meta *bigquery.TableMetadata) (string, error) {
+	if !requiresPartitionFilter(meta) {
+		return "", nil
+	}
+
+	var column, columnType string
+	switch {
+	case meta.TimePartitioning != nil && meta.TimePartitioning.Field == "":
+		column, columnType = "_PARTITIONTIME", "TIMESTAMP"
+	case meta.TimePartitioning != nil:
+		column = meta.TimePartitioning.Field
+	case meta.RangePartitioning != nil:
+		column = meta.RangePartitioning.Field
+	}
+
+	// Hive partition keys of external tables are not in the table metadata,
+	// and INFORMATION_SCHEMA gives the type of every kind of partition column.
+	if columnType == "" {
+		var err error
+		column, columnType, err = partitioningColumn(ctx, client, table, column)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	lowest, ok := partitionRangeStart[columnType]
+	if !ok {
+		return "", fmt.Errorf("unsupported partition column type %s for %s", columnType, column)
+	}
+	quoted := quoteIdentifier(column)
+	if column == "_PARTITIONTIME" {
+		quoted = column
+	}
+	return fmt.Sprintf(" WHERE (%s >= %s OR %s IS NULL)", quoted, lowest, quoted), nil
+}
+
+// partitionRangeStart is the lowest value of each partition column type.
+var partitionRangeStart = map[string]string{
+	"DATE":      "DATE '0001-01-01'",
+	"DATETIME":  "DATETIME '0001-01-01 00:00:00'",
+	"TIMESTAMP": "TIMESTAMP '0001-01-01 00:00:00 UTC'",
+	"INT64":     "-9223372036854775808",
+	"STRING":    "''",
+}
+
+// partitioningColumn looks up the partition column of table, or its type if
+// column is already known.
+func partitioningColumn(ctx context.Context, client *bigquery.Client, table *bigquery.Table, column string) (string, string, error) {
+	query := client.Query(fmt.Sprintf("SELECT column_name, data_type FROM %s.INFORMATION_SCHEMA.COLUMNS WHERE table_name = @table AND is_partitioning_column = 'YES' ORDER BY ordinal_position",
+		quoteIdentifier(table.ProjectID, table.DatasetID)))
+	query.Parameters = []bigquery.QueryParameter{{Name: "table", Value: table.TableID}}
+	it, err := query.Read(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to look up partition column: %w", err)
+	}
+
+	for {
+		var row struct {
+			ColumnName string `bigquery:"column_name"`
+			DataType   string `bigquery:"data_type"`
+		}
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("failed to look up partition column: %w", err)
+		}
+		if column == "" || strings.EqualFold(row.ColumnName, column) {
+			return row.ColumnName, row.DataType, nil
+		}
+	}
+	return "", "", fmt.Errorf("no partition column found for %s", table.TableID)
+}
@@ -0,0 +1,63 @@
+package bqbackup
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// pathSegment encodes a project, dataset or table ID as one segment of a
+// backup object path. Letters, digits, '_' and '-' are kept as they are, so
+// the paths of ordinary IDs don't change; anything else, including '/', '.',
+// '*' and '%', is percent-encoded. This keeps domain-scoped project IDs,
+// Unicode table names and names like ".." from breaking the
+// PROJECT/DATE/DATASET/TABLE layout or the export wildcard.
+func pathSegment(id string) string {
+	var b strings.Builder
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// parsePathSegment decodes a segment written by pathSegment. Segments that are
+// not valid encodings are returned unchanged.
+func parsePathSegment(segment string) string {
+	id, err := url.PathUnescape(segment)
+	if err != nil {
+		return segment
+	}
+	return id
+}
+
+// backupPath joins IDs into a backup object path, e.g.
+// backupPath(projectID, date, datasetID) for a dataset's directory.
+func backupPath(ids ...string) string {
+	segments := make([]string, len(ids))
+	for i, id := range ids {
+		segments[i] = pathSegment(id)
+	}
+	return strings.Join(segments, "/")
+}
+
+// quoteIdentifier quotes each part of a BigQuery table path with backticks,
+// escaping backticks and backslashes, and joins them with dots.
+func quoteIdentifier(parts ...string) string {
+	quoted := make([]string, len(parts))
+	for i, part := range parts {
+		part = strings.ReplaceAll(part, `\`, `\\`)
+		quoted[i] = "`" + strings.ReplaceAll(part, "`", "\\`") + "`"
+	}
+	return strings.Join(quoted, ".")
+}
+
+func quoteTable(table *bigquery.Table) string {
+	return quoteIdentifier(table.ProjectID, table.DatasetID, table.TableID)
+}
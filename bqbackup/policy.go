@@ -0,0 +1,60 @@
+package bqbackup
+
+import (
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+const (
+	backupLabel        = "bq-backup"
+	backupLabelExclude = "exclude"
+	backupLabelInclude = "include"
+)
+
+// tablePolicy decides which tables are not worth backing up.
+type tablePolicy struct {
+	SkipExpiringWithin time.Duration
+	SkipSnapshots      bool
+	SkipClones         bool
+	// Allowlist backs up only tables labelled bq-backup:include. Otherwise
+	// every table is backed up except those labelled bq-backup:exclude.
+	Allowlist bool
+}
+
+// skipReason returns why a table should be skipped, or "" to back it up.
+func (p tablePolicy) skipReason(meta *bigquery.TableMetadata, now time.Time) string {
+	label := meta.Labels[backupLabel]
+	if label == backupLabelExclude {
+		return fmt.Sprintf("labelled %s:%s", backupLabel, backupLabelExclude)
+	}
+	if p.Allowlist && label != backupLabelInclude {
+		return fmt.Sprintf("not labelled %s:%s", backupLabel, backupLabelInclude)
+	}
+	if p.SkipExpiringWithin > 0 && !meta.ExpirationTime.IsZero() && meta.ExpirationTime.Before(now.Add(p.SkipExpiringWithin)) {
+		return fmt.Sprintf("expires %s", meta.ExpirationTime.Format(time.RFC3339))
+	}
+	if p.SkipSnapshots && meta.Type == bigquery.Snapshot {
+		return fmt.Sprintf("snapshot of %s", baseTableReference(meta))
+	}
+	if p.SkipClones && meta.CloneDefinition != nil {
+		return fmt.Sprintf("clone of %s", baseTableReference(meta))
+	}
+	return ""
+}
+
+// baseTableReference returns the table a snapshot or clone was taken from.
+func baseTableReference(meta *bigquery.TableMetadata) string {
+	var base *bigquery.Table
+	switch {
+	case meta.SnapshotDefinition != nil:
+		base = meta.SnapshotDefinition.BaseTableReference
+	case meta.CloneDefinition != nil:
+		base = meta.CloneDefinition.BaseTableReference
+	}
+	if base == nil {
+		return ""
+	}
+	return base.FullyQualifiedName()
+}
@@ -0,0 +1,206 @@
+package bqbackup
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/schollz/progressbar/v3"
+)
+
+// estimateLargestTables is how many of the largest tables --estimate lists
+// per project.
+const estimateLargestTables = 5
+
+// metadataCache holds the table metadata prefetched for the project being
+// backed up. It plans the run and is what tables are exported with, so a
+// table's metadata is only fetched again to check its read-back row count.
+type metadataCache struct {
+	fetched time.Time
+	// tables is keyed by DATASET.TABLE and only read once prefetched.
+	tables map[string]*bigquery.TableMetadata
+}
+
+// prefetchMetadata fetches the metadata of a project's tables with up to
+// concurrency requests in flight, drawing a progress bar if showProgress.
+// Tables whose metadata can't be fetched are left out, and fetched again as
+// they are backed up.
+func prefetchMetadata(ctx context.Context, reader metadataReader, projectID string, datasets []string, tables map[string][]string, total, concurrency int, showProgress bool) *metadataCache {
+	c := &metadataCache{fetched: time.Now(), tables: make(map[string]*bigquery.TableMetadata, total)}
+	bar := progressbar.NewOptions(total,
+		progressbar.OptionSetDescription(fmt.Sprintf("Fetching table metadata of project %s", projectID)),
+		progressbar.OptionShowCount(),
+		progressbar.OptionSetWidth(30),
+		progressbar.OptionClearOnFinish(),
+		progressbar.OptionSpinnerType(14),
+		progressbar.OptionSetVisibility(showProgress),
+	)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(concurrency, 1))
+	failed := 0
+	for _, datasetID := range datasets {
+		for _, tableID := range tables[datasetID] {
+			if ctx.Err() != nil {
+				break
+			}
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(datasetID, tableID string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				meta, err := reader.TableMetadata(ctx, datasetID, tableID)
+				bar.Add(1)
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					failed++
+					return
+				}
+				c.tables[datasetID+"."+tableID] = meta
+			}(datasetID, tableID)
+		}
+	}
+	wg.Wait()
+	bar.Finish()
+
+	fmt.Printf("Fetched metadata of %d tables in project %s in %s", len(c.tables), projectID, time.Since(c.fetched).Round(time.Millisecond))
+	if failed > 0 {
+		fmt.Printf(", %d failed and are planned as empty", failed)
+	}
+	fmt.Println()
+	return c
+}
+
+// table returns the prefetched metadata of a table, or false if it wasn't
+// prefetched.
+func (c *metadataCache) table(datasetID, tableID string) (*bigquery.TableMetadata, bool) {
+	if c == nil {
+		return nil, false
+	}
+	meta, ok := c.tables[datasetID+"."+tableID]
+	return meta, ok
+}
+
+// sizes returns the prefetched sizes of a dataset's tables, or false if any
+// of them is missing.
+func (c *metadataCache) sizes(datasetID string, tables []string) (map[string]int64, bool) {
+	if c == nil {
+		return nil, false
+	}
+	sizes := make(map[string]int64, len(tables))
+	for _, tableID := range tables {
+		meta, ok := c.tables[datasetID+"."+tableID]
+		if !ok {
+			return nil, false
+		}
+		sizes[tableID] = meta.NumBytes
+	}
+	return sizes, true
+}
+
+// backupPlan is the work of a project's run as planned from the prefetched
+// metadata.
+type backupPlan struct {
+	// datasets are in the order they are scheduled in, the most bytes to
+	// export first, so the longest dataset doesn't start last.
+	datasets     []string
+	tables       int
+	bytes        int64
+	skipped      int
+	skippedBytes int64
+	largest      []tableResult
+}
+
+// planBackup plans the backup of a project's tables. Tables policy skips
+// don't count towards the bytes to export; tables without prefetched metadata
+// count as empty.
+func planBackup(policy tablePolicy, datasets []string, tables map[string][]string, cache *metadataCache, now time.Time) backupPlan {
+	plan := backupPlan{datasets: append([]string(nil), datasets...)}
+	datasetBytes := make(map[string]int64, len(datasets))
+	for _, datasetID := range datasets {
+		for _, tableID := range tables[datasetID] {
+			plan.tables++
+			meta, ok := cache.tables[datasetID+"."+tableID]
+			if !ok {
+				continue
+			}
+			if policy.skipReason(meta, now) != "" {
+				plan.skipped++
+				plan.skippedBytes += meta.NumBytes
+				continue
+			}
+			plan.bytes += meta.NumBytes
+			datasetBytes[datasetID] += meta.NumBytes
+			plan.largest = append(plan.largest, tableResult{DatasetID: datasetID, TableID: tableID, NumBytes: meta.NumBytes, NumRows: meta.NumRows})
+		}
+	}
+	sort.SliceStable(plan.datasets, func(i, j int) bool { return datasetBytes[plan.datasets[i]] > datasetBytes[plan.datasets[j]] })
+	sort.SliceStable(plan.largest, func(i, j int) bool { return plan.largest[i].NumBytes > plan.largest[j].NumBytes })
+	if len(plan.largest) > estimateLargestTables {
+		plan.largest = plan.largest[:estimateLargestTables]
+	}
+	return plan
+}
+
+// printEstimate prints a project's plan for --estimate. The duration is
+// projected from the throughput of the project's latest run in the catalog.
+func printEstimate(stateDir, projectID string, plan backupPlan) {
+	fmt.Printf("Estimate for project %s: %d datasets, %d tables, %s to export", projectID, len(plan.datasets), plan.tables-plan.skipped, formatBytes(plan.bytes))
+	if plan.skipped > 0 {
+		fmt.Printf(", %d tables (%s) skipped by policy", plan.skipped, formatBytes(plan.skippedBytes))
+	}
+	fmt.Println()
+	for _, t := range plan.largest {
+		fmt.Printf("* %s.%s: %s, %d rows\n", t.DatasetID, t.TableID, formatBytes(t.NumBytes), t.NumRows)
+	}
+
+	entries, err := readCatalog(stateDir)
+	if err != nil {
+		fmt.Println("No catalog to estimate the duration from")
+		return
+	}
+	var previous *catalogEntry
+	for i, entry := range entries {
+		if entry.Kind != "" || entry.ProjectID != projectID || entry.Finished.IsZero() || entry.TimedOut {
+			continue
+		}
+		if previous == nil || entry.Started.After(previous.Started) {
+			previous = &entries[i]
+		}
+	}
+	if previous == nil {
+		fmt.Println("No earlier run of the project to estimate the duration from")
+		return
+	}
+	var exported int64
+	for _, t := range previous.Tables {
+		if t.Status != statusSkipped {
+			exported += t.NumBytes
+		}
+	}
+	took := previous.Finished.Sub(previous.Started)
+	if exported == 0 || took <= 0 {
+		fmt.Printf("Estimated duration: %s, as long as the run of %s\n", took.Round(time.Second), previous.Date)
+		return
+	}
+	estimate := time.Duration(float64(took) * float64(plan.bytes) / float64(exported))
+	fmt.Printf("Estimated duration: %s, at the %s/s of the run of %s\n", estimate.Round(time.Second), formatBytes(int64(float64(exported)/took.Seconds())), previous.Date)
+}
+
+// remainingTime projects how much longer a project takes from the time its
+// finished tables took, going by bytes if the plan has any and tables
+// otherwise.
+func remainingTime(elapsed time.Duration, tablesDone, tables int, bytesDone, bytes int64) (time.Duration, bool) {
+	if bytes > 0 && bytesDone > 0 && bytesDone < bytes {
+		return time.Duration(float64(elapsed) / float64(bytesDone) * float64(bytes-bytesDone)), true
+	}
+	if tablesDone > 0 && tablesDone < tables {
+		return time.Duration(float64(elapsed) / float64(tablesDone) * float64(tables-tablesDone)), true
+	}
+	return 0, false
+}
@@ -0,0 +1,66 @@
+package bqbackup
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestPlanBackup(t *testing.T) {
+	_, c := newTestBackend(t)
+	// The fake's tables hold 64000 bytes per 1000 rows, the first table of
+	// a dataset 1000 rows, the next 2000 and so on, so sales.customers and
+	// analytics.sessions hold 128000 bytes and analytics.events 64000.
+	datasets := []string{"sales", "analytics"}
+	tables := map[string][]string{"sales": {"customers", "gone"}, "analytics": {"events", "sessions"}}
+	cache := prefetchMetadata(context.Background(), c.tables, "p", datasets, tables, 4, 2, false)
+
+	tests := []struct {
+		name         string
+		policy       tablePolicy
+		wantDatasets []string
+		wantBytes    int64
+		wantSkipped  int
+		wantLargest  []string
+	}{
+		{"default", tablePolicy{}, []string{"analytics", "sales"}, 320000, 0, []string{"sales.customers", "analytics.sessions", "analytics.events"}},
+		{"allowlist", tablePolicy{Allowlist: true}, []string{"sales", "analytics"}, 0, 3, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := planBackup(tt.policy, datasets, tables, cache, time.Now())
+			if !reflect.DeepEqual(plan.datasets, tt.wantDatasets) {
+				t.Errorf("datasets = %v, want %v", plan.datasets, tt.wantDatasets)
+			}
+			if plan.tables != 4 || plan.bytes != tt.wantBytes || plan.skipped != tt.wantSkipped {
+				t.Errorf("plan = %d tables, %d bytes, %d skipped, want 4, %d, %d", plan.tables, plan.bytes, plan.skipped, tt.wantBytes, tt.wantSkipped)
+			}
+			var largest []string
+			for _, r := range plan.largest {
+				largest = append(largest, r.DatasetID+"."+r.TableID)
+			}
+			if !reflect.DeepEqual(largest, tt.wantLargest) {
+				t.Errorf("largest = %v, want %v", largest, tt.wantLargest)
+			}
+		})
+	}
+}
+
+func TestMetadataCacheSizes(t *testing.T) {
+	cache := &metadataCache{tables: map[string]*bigquery.TableMetadata{"a.t1": {NumBytes: 1}, "a.t2": {NumBytes: 2}}}
+	if sizes, ok := cache.sizes("a", []string{"t1", "t2"}); !ok || !reflect.DeepEqual(sizes, map[string]int64{"t1": 1, "t2": 2}) {
+		t.Errorf("sizes = %v, %t", sizes, ok)
+	}
+	if _, ok := cache.sizes("a", []string{"t1", "t3"}); ok {
+		t.Error("sizes with a table missing = ok")
+	}
+	if _, ok := (*metadataCache)(nil).sizes("a", nil); ok {
+		t.Error("sizes of nil cache = ok")
+	}
+	if _, ok := (*metadataCache)(nil).table("a", "t1"); ok {
+		t.Error("table of nil cache = ok")
+	}
+}
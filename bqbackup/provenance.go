@@ -0,0 +1,177 @@
+package bqbackup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+)
+
+// runProvenance records how a backup was taken, so a backup that restores
+// wrong can be traced back to the settings and credentials that produced it.
+type runProvenance struct {
+	Config runConfig `json:"config"`
+	// ConfigFingerprint is the SHA-256 of Config, to tell at a glance
+	// whether two runs were configured alike.
+	ConfigFingerprint string `json:"config_fingerprint"`
+	// Identity is the principal the run's clients authenticated as.
+	Identity string `json:"identity"`
+	// EncryptionKey is the Cloud KMS key the bucket encrypts new objects
+	// with, or "google-managed".
+	EncryptionKey string `json:"encryption_key"`
+	// SigningKey is the --kms-key the manifest is signed with.
+	SigningKey string `json:"signing_key,omitempty"`
+}
+
+// runConfig is the effective configuration of a tenant's run: what was
+// selected, how it was exported and where it went.
+type runConfig struct {
+	Bucket          string `json:"bucket"`
+	RetentionDays   int    `json:"retention_days"`
+	StrictRetention bool   `json:"strict_retention,omitempty"`
+
+	DatasetID          string   `json:"dataset_id,omitempty"`
+	TableID            string   `json:"table_id,omitempty"`
+	Locations          []string `json:"locations,omitempty"`
+	LabelAllowlist     bool     `json:"label_allowlist,omitempty"`
+	SkipExpiringWithin string   `json:"skip_expiring_within,omitempty"`
+	SkipSnapshots      bool     `json:"skip_snapshots,omitempty"`
+	SkipClones         bool     `json:"skip_clones,omitempty"`
+	MaterializeWindow  string   `json:"materialize_window,omitempty"`
+	MaterializeTimeout string   `json:"materialize_timeout,omitempty"`
+
+	Format           string       `json:"format"`
+	ExportRules      []ExportRule `json:"export_rules,omitempty"`
+	HivePartitions   bool         `json:"hive_partitions,omitempty"`
+	TinyTableBytes   int64        `json:"tiny_table_bytes,omitempty"`
+	BundleTinyTables bool         `json:"bundle_tiny_tables,omitempty"`
+
+	TemporaryHold     bool   `json:"temporary_hold,omitempty"`
+	ReplicateDir      string `json:"replicate_dir,omitempty"`
+	InformationSchema bool   `json:"information_schema,omitempty"`
+	Connections       bool   `json:"connections,omitempty"`
+	ReadbackProbe     bool   `json:"readback_probe,omitempty"`
+	Reservation       string `json:"reservation,omitempty"`
+
+	// A rehearsal that fails tables on purpose, or runs against the fake
+	// backend, must never look like a real backup.
+	SimulateFailures float64 `json:"simulate_failures,omitempty"`
+	FakeBackend      bool    `json:"fake_backend,omitempty"`
+}
+
+// newRunProvenance collects the provenance of a tenant's run. Whatever can't
+// be determined is recorded as unknown rather than failing the run.
+func (b *backupRun) newRunProvenance(ctx context.Context, t tenantConfig, storageClient *storage.Client) runProvenance {
+	config := runConfig{
+		Bucket:            t.Bucket,
+		RetentionDays:     t.RetentionDays,
+		StrictRetention:   b.strictRetention,
+		DatasetID:         b.scope.DatasetID,
+		TableID:           b.scope.TableID,
+		Locations:         b.locations,
+		LabelAllowlist:    b.policy.Allowlist,
+		SkipSnapshots:     b.policy.SkipSnapshots,
+		SkipClones:        b.policy.SkipClones,
+		Format:            b.format.name,
+		HivePartitions:    b.hivePartitions,
+		TinyTableBytes:    b.tinyTableBytes,
+		BundleTinyTables:  b.bundleTinyTables,
+		TemporaryHold:     b.temporaryHold,
+		ReplicateDir:      b.replicateDir,
+		InformationSchema: b.informationSchema,
+		Connections:       b.connections,
+		ReadbackProbe:     b.readbackProbe,
+		Reservation:       b.reservation,
+		SimulateFailures:  b.simulateFailureRate,
+		FakeBackend:       b.fake != nil,
+	}
+	if b.policy.SkipExpiringWithin > 0 {
+		config.SkipExpiringWithin = b.policy.SkipExpiringWithin.String()
+	}
+	if b.materializeWindow.set {
+		config.MaterializeWindow = b.materializeWindow.String()
+	}
+	if b.materializeTimeout > 0 {
+		config.MaterializeTimeout = b.materializeTimeout.String()
+	}
+	for _, r := range b.exportRules {
+		config.ExportRules = append(config.ExportRules, ExportRule{
+			Project:     r.project,
+			Dataset:     r.dataset,
+			Table:       r.table,
+			Format:      r.settings.format.name,
+			Compression: strings.ToLower(string(r.settings.compression)),
+		})
+	}
+
+	p := runProvenance{Config: config, Identity: t.identity(ctx, b.fake), EncryptionKey: "unknown", SigningKey: b.kmsKeyVersion}
+	data, err := json.Marshal(config)
+	if err != nil {
+		fmt.Printf("Failed to fingerprint run configuration: %v\n", err)
+	} else {
+		sum := sha256.Sum256(data)
+		p.ConfigFingerprint = hex.EncodeToString(sum[:])
+	}
+
+	attrs, err := storageClient.Bucket(t.Bucket).Attrs(ctx)
+	switch {
+	case err != nil:
+		fmt.Printf("Failed to read encryption settings of bucket %s: %v\n", t.Bucket, err)
+	case attrs.Encryption != nil && attrs.Encryption.DefaultKMSKeyName != "":
+		p.EncryptionKey = attrs.Encryption.DefaultKMSKeyName
+	default:
+		p.EncryptionKey = "google-managed"
+	}
+	return p
+}
+
+// identity returns the principal the tenant's clients authenticate as: the
+// impersonated service account, the service account of the credentials file
+// or of the application default credentials, or the service account of the
+// VM they run on. Clients of a fake backend authenticate as nobody.
+func (t tenantConfig) identity(ctx context.Context, fake *fakeBackend) string {
+	if fake != nil {
+		return "fake-backend"
+	}
+	if t.ImpersonateServiceAccount != "" {
+		return t.ImpersonateServiceAccount
+	}
+	if t.CredentialsFile != "" {
+		data, err := os.ReadFile(t.CredentialsFile)
+		if email := credentialsEmail(data); err == nil && email != "" {
+			return email
+		}
+		return "credentials file " + t.CredentialsFile
+	}
+	creds, err := google.FindDefaultCredentials(ctx)
+	if err == nil {
+		if email := credentialsEmail(creds.JSON); email != "" {
+			return email
+		}
+	}
+	if metadata.OnGCE() {
+		if email, err := metadata.Email("default"); err == nil {
+			return email
+		}
+	}
+	return "application default credentials"
+}
+
+// credentialsEmail returns the client_email of a service account key, or ""
+// for other kinds of credentials, such as a user's.
+func credentialsEmail(data []byte) string {
+	var key struct {
+		ClientEmail string `json:"client_email"`
+	}
+	if json.Unmarshal(data, &key) != nil {
+		return ""
+	}
+	return key.ClientEmail
+}
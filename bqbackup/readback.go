@@ -0,0 +1,100 @@
+package bqbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// readbackResult is the outcome of a read-back probe.
+type readbackResult struct {
+	Rows uint64 `json:"rows"`
+	// Seconds is the time from defining the external table to the query's
+	// result.
+	Seconds float64 `json:"seconds"`
+}
+
+// probeReadback defines a temporary external table over a table's backup
+// files in dataset and counts its rows, as proof that the backup can be read.
+func (b *backupRun) probeReadback(ctx context.Context, client *bigquery.Client, storageClient *storage.Client, dataset *bigquery.Dataset, bucketName, projectID, date, tableID string) (readbackResult, error) {
+	source, err := backupSource(ctx, storageClient, bucketName, projectID, date, dataset.DatasetID, tableID)
+	if err != nil {
+		return readbackResult{}, fmt.Errorf("failed to find backup files: %w", err)
+	}
+	sourceURI, err := source.externalSource()
+	if err != nil {
+		return readbackResult{}, err
+	}
+	f := source.format
+	probe, err := newTempTable(ctx, dataset, tableID, b.runID)
+	if err != nil {
+		return readbackResult{}, err
+	}
+
+	started := time.Now()
+	meta := &bigquery.TableMetadata{
+		Description: fmt.Sprintf("bq-backup read-back probe of %s", sourceURI),
+		Labels:      map[string]string{tempTableLabel: "true", runLabel: b.runID},
+		// Left over external tables are not cleaned up like temporary
+		// tables, so they expire on their own.
+		ExpirationTime: started.Add(24 * time.Hour),
+		ExternalDataConfig: &bigquery.ExternalDataConfig{
+			SourceFormat: f.format,
+			SourceURIs:   []string{sourceURI},
+		},
+	}
+	if f == avroFormat {
+		meta.ExternalDataConfig.Options = &bigquery.AvroOptions{UseAvroLogicalTypes: true}
+	}
+	if err := probe.Create(ctx, meta); err != nil {
+		return readbackResult{}, fmt.Errorf("failed to create external table: %w", err)
+	}
+	defer func() {
+		if err := deleteTempTable(ctx, probe); err != nil {
+			fmt.Printf("Failed to delete read-back probe table %s: %v\n", probe.TableID, err)
+		}
+	}()
+
+	it, err := client.Query(b.withReservation("SELECT COUNT(*) FROM " + quoteTable(probe))).Read(ctx)
+	if err != nil {
+		return readbackResult{}, err
+	}
+	var row []bigquery.Value
+	if err := it.Next(&row); err == iterator.Done {
+		return readbackResult{}, errors.New("count query returned no rows")
+	} else if err != nil {
+		return readbackResult{}, err
+	}
+	count, ok := row[0].(int64)
+	if !ok {
+		return readbackResult{}, fmt.Errorf("unexpected count %v", row[0])
+	}
+	return readbackResult{Rows: uint64(count), Seconds: time.Since(started).Seconds()}, nil
+}
+
+// formatSlowReadbacks lists the tables whose read-back probe took longer than
+// slo, slowest first (0 lists none).
+func formatSlowReadbacks(results []tableResult, slo time.Duration) []string {
+	if slo <= 0 {
+		return nil
+	}
+	var slow []tableResult
+	for _, r := range results {
+		if r.Readback != nil && r.Readback.Seconds > slo.Seconds() {
+			slow = append(slow, r)
+		}
+	}
+	sort.Slice(slow, func(i, j int) bool { return slow[i].Readback.Seconds > slow[j].Readback.Seconds })
+
+	lines := make([]string, 0, len(slow))
+	for _, r := range slow {
+		lines = append(lines, fmt.Sprintf("* %s.%s - %s", r.DatasetID, r.TableID, time.Duration(r.Readback.Seconds*float64(time.Second)).Round(time.Second)))
+	}
+	return lines
+}
@@ -0,0 +1,263 @@
+package bqbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	replicationChunkSize = 64 * 1024 * 1024
+	partSuffix           = ".part"
+	// replicationWorkers is how many objects are copied at once.
+	replicationWorkers = 4
+	// maxReplicaFailuresReported bounds the failed copies listed in
+	// notifications.
+	maxReplicaFailuresReported = 10
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// replicateBackup copies every object of a project's backup of date to the
+// run's --replicate-to directory, such as a mounted volume, under its object
+// name: the tables' files as well as the
+// manifest, schemas, dataset.json and the other metadata objects. It runs
+// once the backup is final, so a failed copy never fails the backup itself,
+// and returns one line per object that failed to copy.
+func (b *backupRun) replicateBackup(ctx context.Context, storageClient *storage.Client, bucketName, projectID, date string) []string {
+	objects, err := listObjects(ctx, gcsStore{storageClient}, bucketName, backupPath(projectID, date)+"/")
+	if err != nil {
+		return []string{fmt.Sprintf("failed to list the backup: %v", err)}
+	}
+
+	limiter := replicationLimiter(b.maxBandwidth)
+	jobs := make(chan *storage.ObjectAttrs)
+	var mu sync.Mutex
+	var failures []string
+	var wg sync.WaitGroup
+	for i := 0; i < replicationWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for attrs := range jobs {
+				if err := copyObject(ctx, storageClient, bucketName, attrs, filepath.Join(b.replicateDir, filepath.FromSlash(attrs.Name)), limiter); err != nil {
+					mu.Lock()
+					failures = append(failures, fmt.Sprintf("%s: %v", attrs.Name, err))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, attrs := range objects {
+		jobs <- attrs
+	}
+	close(jobs)
+	wg.Wait()
+	sort.Strings(failures)
+	return failures
+}
+
+// formatReplicaFailures lists the objects that failed to copy to the replica,
+// up to maxReplicaFailuresReported of them.
+func formatReplicaFailures(failures []string) []string {
+	var lines []string
+	for i, failure := range failures {
+		if i == maxReplicaFailuresReported {
+			lines = append(lines, fmt.Sprintf("* and %d more", len(failures)-i))
+			break
+		}
+		lines = append(lines, "* "+failure)
+	}
+	return lines
+}
+
+// cleanupReplica removes the project's backups in the replica that are older
+// than retentionDays, as cleanupOldBackups does in the bucket.
+func (b *backupRun) cleanupReplica(projectID string, retentionDays int) {
+	dir := filepath.Join(b.replicateDir, pathSegment(projectID))
+	dates, err := os.ReadDir(dir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("Failed to list replica of project %s: %v\n", projectID, err)
+		}
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -retentionDays).Format("2006-01-02")
+	removed := 0
+	for _, d := range dates {
+		date := parsePathSegment(d.Name())
+		if _, err := time.Parse("2006-01-02", date); err != nil || !d.IsDir() || date >= cutoff {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, d.Name())); err != nil {
+			fmt.Printf("Failed to remove replica of project %s from %s: %v\n", projectID, date, err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		fmt.Printf("Removed %d old backups of project %s from %s\n", removed, projectID, b.replicateDir)
+	}
+}
+
+// copyObject copies an object to dest in chunks of ranged reads. The copy is
+// written to dest.part and resumed from there if an earlier copy was
+// interrupted; it is only renamed to dest once its CRC32C matches the
+// object's. A dest that already has the object's CRC32C is left alone.
+func copyObject(ctx context.Context, storageClient *storage.Client, bucketName string, attrs *storage.ObjectAttrs, dest string, limiter *bandwidthLimiter) error {
+	if info, err := os.Stat(dest); err == nil && info.Size() == attrs.Size {
+		if sum, err := fileCRC32C(dest); err == nil && sum == attrs.CRC32C {
+			return nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+
+	part := dest + partSuffix
+	file, err := os.OpenFile(part, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Resume after the bytes already copied, hashing them first.
+	hash := crc32.New(crc32cTable)
+	offset, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	if offset > attrs.Size {
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		hash.Reset()
+		offset = 0
+	}
+
+	// Read the generation that was listed, so a concurrent overwrite can't
+	// mix two versions into one copy.
+	object := storageClient.Bucket(bucketName).Object(attrs.Name).Generation(attrs.Generation)
+	for offset < attrs.Size {
+		length := min(int64(replicationChunkSize), attrs.Size-offset)
+		reader, err := object.NewRangeReader(ctx, offset, length)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(io.MultiWriter(file, hash), limiter.reader(ctx, reader))
+		reader.Close()
+		offset += n
+		if err != nil {
+			return err
+		}
+	}
+
+	if hash.Sum32() != attrs.CRC32C {
+		file.Close()
+		os.Remove(part)
+		return fmt.Errorf("checksum mismatch: CRC32C %08x, expected %08x", hash.Sum32(), attrs.CRC32C)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(part, dest)
+}
+
+func fileCRC32C(name string) (uint32, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	hash := crc32.New(crc32cTable)
+	if _, err := io.Copy(hash, file); err != nil {
+		return 0, err
+	}
+	return hash.Sum32(), nil
+}
+
+// bandwidthLimiter throttles reads to a number of bytes per second. A nil
+// *bandwidthLimiter doesn't throttle.
+type bandwidthLimiter struct {
+	bytesPerSecond int64
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+var (
+	limiterMu     sync.Mutex
+	sharedLimiter *bandwidthLimiter
+)
+
+// replicationLimiter returns the limiter for bytesPerSecond (0 is
+// unlimited), shared by every table so concurrent copies stay within the
+// limit together.
+func replicationLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	limiterMu.Lock()
+	defer limiterMu.Unlock()
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	if sharedLimiter == nil || sharedLimiter.bytesPerSecond != bytesPerSecond {
+		sharedLimiter = &bandwidthLimiter{bytesPerSecond: bytesPerSecond}
+	}
+	return sharedLimiter
+}
+
+func (l *bandwidthLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{ctx: ctx, r: r, limiter: l}
+}
+
+// wait sleeps until n more bytes fit within the limit.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *bandwidthLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,195 @@
+package bqbackup
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+)
+
+// defaultTimeTravelWindow is the time travel window of datasets that don't
+// set one.
+const defaultTimeTravelWindow = 7 * 24 * time.Hour
+
+// runRescue recovers a dropped or overwritten table as it was at a point in
+// time. BigQuery time travel is tried first, as a copy job from the table's
+// snapshot decorator is instant and loads nothing. Only when the point is
+// outside the dataset's time travel window, the dataset itself is gone or the
+// copy fails is the table loaded from its backup in GCS.
+func runRescue(args []string) {
+	fs := flag.NewFlagSet("rescue", flag.ExitOnError)
+	projectID := fs.String("project", "", "Project of the table")
+	datasetID := fs.String("dataset", "", "Dataset of the table")
+	tableID := fs.String("table", "", "Table to rescue")
+	at := fs.String("at", "", "Point in time to rescue the table as of, before it was dropped or overwritten (RFC 3339)")
+	bucketName := fs.String("bucket", "", "GCS bucket to fall back to when time travel can't help")
+	date := fs.String("date", "", "Backup date to fall back to (defaults to the newest complete backup of the table from before the day of --at)")
+	targetDataset := fs.String("target-dataset", "", "Dataset to rescue into (defaults to --dataset)")
+	targetTable := fs.String("target-table", "", "Table to rescue into (defaults to --table)")
+	ifExists := fs.String("if-exists", "fail", "What to do when the destination table already exists: fail or truncate")
+	dryRun := fs.Bool("dry-run", false, "Print how the table would be rescued and exit")
+	maxAttempts := fs.Int("retries", defaultMaxAttempts, "Number of attempts for copy and load jobs that fail with a transient error")
+	stateDir := fs.String("state-dir", defaultStateDir, "Directory containing the catalog")
+	fs.Parse(args)
+
+	if *projectID == "" || *datasetID == "" || *tableID == "" || *at == "" {
+		fmt.Println("Usage: bq-backup rescue --project=PROJECT_ID --dataset=DATASET --table=TABLE --at=TIMESTAMP [--bucket=BUCKET_NAME [--date=YYYY-MM-DD]] [--target-dataset=DATASET] [--target-table=TABLE] [--if-exists=fail|truncate] [--dry-run]")
+		fs.PrintDefaults()
+		os.Exit(1)
+	}
+	asOf, err := time.Parse(time.RFC3339, *at)
+	if err != nil {
+		fmt.Printf("Invalid --at %q, expected an RFC 3339 timestamp such as 2024-07-01T09:30:00Z\n", *at)
+		os.Exit(1)
+	}
+	if asOf.After(time.Now()) {
+		fmt.Printf("--at %s is in the future\n", *at)
+		os.Exit(1)
+	}
+	disposition := bigquery.WriteEmpty
+	switch *ifExists {
+	case "fail":
+	case "truncate":
+		disposition = bigquery.WriteTruncate
+	default:
+		fmt.Printf("Invalid --if-exists %q, expected fail or truncate\n", *ifExists)
+		os.Exit(1)
+	}
+	if *targetDataset == "" {
+		*targetDataset = *datasetID
+	}
+	if *targetTable == "" {
+		*targetTable = *tableID
+	}
+
+	ctx := context.Background()
+	client, err := bigquery.NewClient(ctx, *projectID)
+	if err != nil {
+		fmt.Printf("Failed to create BigQuery client for project %s: %v\n", *projectID, err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	dest := client.Dataset(*targetDataset).Table(*targetTable)
+	_, err = dest.Metadata(ctx)
+	switch {
+	case err == nil && *ifExists == "fail":
+		fmt.Printf("%s.%s already exists, use --if-exists=truncate to replace it\n", *targetDataset, *targetTable)
+		os.Exit(1)
+	case err == nil:
+		fmt.Printf("%s.%s exists and will be overwritten\n", *targetDataset, *targetTable)
+	case !isNotFound(err):
+		fmt.Printf("Failed to check %s.%s: %v\n", *targetDataset, *targetTable, err)
+		os.Exit(1)
+	}
+
+	source := client.Dataset(*datasetID).Table(fmt.Sprintf("%s@%d", *tableID, asOf.UnixMilli()))
+	reason := timeTravelUnavailable(ctx, client.Dataset(*datasetID), asOf)
+	if reason == "" {
+		if *dryRun {
+			fmt.Printf("Dry run: %s.%s would be copied from time travel as of %s into %s.%s\n", *datasetID, *tableID, asOf.Format(time.RFC3339), *targetDataset, *targetTable)
+			return
+		}
+		err := retryTransient(ctx, *maxAttempts, fmt.Sprintf("Rescue of %s.%s", *datasetID, *tableID), func() error {
+			return copyTable(ctx, source, dest, disposition)
+		})
+		if err == nil {
+			fmt.Printf("Rescued %s.%s from time travel as of %s into %s.%s\n", *datasetID, *tableID, asOf.Format(time.RFC3339), *targetDataset, *targetTable)
+			return
+		}
+		reason = err.Error()
+	}
+	fmt.Printf("Time travel can't rescue %s.%s: %s\n", *datasetID, *tableID, reason)
+
+	if *bucketName == "" {
+		fmt.Println("Pass --bucket to fall back to the backup in GCS")
+		os.Exit(1)
+	}
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		fmt.Printf("Failed to create Storage client: %v\n", err)
+		os.Exit(1)
+	}
+	defer storageClient.Close()
+
+	if *date == "" {
+		// Backups are kept by date, so one from the day of --at may already
+		// hold the damage.
+		*date, err = latestCompleteBackup(ctx, *stateDir, storageClient, *bucketName, *projectID, *datasetID, *tableID, asOf.UTC().Format("2006-01-02"))
+		if err != nil {
+			fmt.Printf("Failed to look up the latest backup: %v\n", err)
+			os.Exit(1)
+		}
+		if *date == "" {
+			fmt.Printf("No complete backup of %s.%s in %s from before %s\n", *datasetID, *tableID, *projectID, asOf.UTC().Format("2006-01-02"))
+			os.Exit(1)
+		}
+	}
+	backup, err := backupSource(ctx, storageClient, *bucketName, *projectID, *date, *datasetID, *tableID)
+	if err != nil {
+		fmt.Printf("Failed to find the backup of %s.%s from %s: %v\n", *datasetID, *tableID, *date, err)
+		os.Exit(1)
+	}
+	if *dryRun {
+		fmt.Printf("Dry run: %s.%s would be loaded from %s into %s.%s\n", *datasetID, *tableID, backup, *targetDataset, *targetTable)
+		return
+	}
+
+	if err := ensureDataset(ctx, client.Dataset(*targetDataset), storageClient, *bucketName, *projectID, *date, *datasetID); err != nil {
+		fmt.Printf("Failed to prepare dataset %s: %v\n", *targetDataset, err)
+		os.Exit(1)
+	}
+	err = retryTransient(ctx, *maxAttempts, fmt.Sprintf("Restore of %s.%s", *datasetID, *tableID), func() error {
+		return restoreTable(ctx, dest, backup, disposition)
+	})
+	if err != nil {
+		fmt.Printf("Failed to restore %s.%s from %s: %v\n", *datasetID, *tableID, backup, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Rescued %s.%s from the backup of %s into %s.%s\n", *datasetID, *tableID, *date, *targetDataset, *targetTable)
+}
+
+// timeTravelUnavailable returns why time travel can't reach a table of
+// dataset as of at, or "" if it may.
+func timeTravelUnavailable(ctx context.Context, dataset *bigquery.Dataset, at time.Time) string {
+	meta, err := dataset.Metadata(ctx)
+	if isNotFound(err) {
+		return fmt.Sprintf("dataset %s no longer exists", dataset.DatasetID)
+	}
+	if err != nil {
+		return fmt.Sprintf("failed to read dataset %s: %v", dataset.DatasetID, err)
+	}
+	window := meta.MaxTimeTravel
+	if window == 0 {
+		window = defaultTimeTravelWindow
+	}
+	if time.Since(at) >= window {
+		return fmt.Sprintf("%s is outside the dataset's time travel window of %s", at.Format(time.RFC3339), window)
+	}
+	return ""
+}
+
+func copyTable(ctx context.Context, source, dest *bigquery.Table, disposition bigquery.TableWriteDisposition) error {
+	copier := dest.CopierFrom(source)
+	copier.WriteDisposition = disposition
+
+	job, err := copier.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start copy job: %w", err)
+	}
+
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to wait for copy job: %w", err)
+	}
+
+	if err := status.Err(); err != nil {
+		return fmt.Errorf("copy job failed: %w", err)
+	}
+
+	return nil
+}
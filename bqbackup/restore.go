@@ -0,0 +1,525 @@
+package bqbackup
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	catalogKindRehearsal      = "rehearsal"
+	defaultRehearsalSample    = 5
+	defaultRestoreConcurrency = 4
+)
+
+func runRestore(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	bucketName := fs.String("bucket", "", "GCS bucket name")
+	projectID := fs.String("project", "", "Project ID the backup was taken from")
+	date := fs.String("date", "", "Backup date (YYYY-MM-DD)")
+	tag := fs.String("tag", "", "Restore the latest backup of a run tagged with --run-tag=TAG instead of --date")
+	latest := fs.Bool("latest", false, "Restore the newest backup without failures of the dataset or table instead of --date")
+	latestBefore := fs.String("latest-before", "", "Like --latest, but only consider backups taken before this date (YYYY-MM-DD)")
+	datasetID := fs.String("dataset", "", "Dataset to restore")
+	tableID := fs.String("table", "", "Table to restore (defaults to every table in the dataset)")
+	targetProject := fs.String("target-project", "", "Project to restore into (defaults to --project)")
+	targetDataset := fs.String("target-dataset", "", "Dataset to restore into (defaults to --dataset)")
+	rehearse := fs.Bool("rehearse", false, "Restore a sample into a temporary dataset, validate row counts and drop it")
+	sample := fs.Int("sample", defaultRehearsalSample, "Number of tables to restore with --rehearse")
+	ifExists := fs.String("if-exists", "fail", "What to do when a destination table already exists: fail, skip, truncate or append")
+	dryRun := fs.Bool("dry-run", false, "List the tables that would be restored, skipped or overwritten and exit")
+	asExternal := fs.Bool("as-external", false, "Create external tables over the backup files instead of loading them")
+	concurrency := fs.Int("restore-concurrency", defaultRestoreConcurrency, "Number of load jobs run in parallel")
+	maxAttempts := fs.Int("retries", defaultMaxAttempts, "Number of attempts for load jobs that fail with a transient error")
+	stateDir := fs.String("state-dir", defaultStateDir, "Directory containing the catalog")
+	fs.Parse(args)
+
+	disposition := bigquery.WriteEmpty
+	if d, ok := writeDispositions[*ifExists]; ok {
+		disposition = d
+	} else if *ifExists != "fail" && *ifExists != "skip" {
+		fmt.Printf("Invalid --if-exists %q, expected fail, skip, truncate or append\n", *ifExists)
+		os.Exit(1)
+	}
+	if *asExternal && *ifExists == "append" {
+		fmt.Println("--if-exists=append cannot be used with --as-external")
+		os.Exit(1)
+	}
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+
+	if *latestBefore != "" {
+		if _, err := time.Parse("2006-01-02", *latestBefore); err != nil {
+			fmt.Printf("Invalid --latest-before %q, expected YYYY-MM-DD\n", *latestBefore)
+			os.Exit(1)
+		}
+		*latest = true
+	}
+	selectors := 0
+	for _, set := range []bool{*date != "", *tag != "", *latest} {
+		if set {
+			selectors++
+		}
+	}
+	if selectors > 1 {
+		fmt.Println("--date, --tag and --latest are mutually exclusive")
+		os.Exit(1)
+	}
+	if *tag != "" && *projectID != "" {
+		entries, err := readCatalog(*stateDir)
+		if err != nil {
+			fmt.Printf("Failed to read catalog: %v\n", err)
+			os.Exit(1)
+		}
+		entry, ok := latestTaggedEntry(entries, *projectID, *tag)
+		if !ok {
+			fmt.Printf("No backup of %s tagged %q in the catalog\n", *projectID, *tag)
+			os.Exit(1)
+		}
+		*date = entry.Date
+		fmt.Printf("Restoring backup %s from %s tagged %q\n", entry.RunID, entry.Date, *tag)
+	}
+
+	if *bucketName == "" || *projectID == "" || *date == "" && !*latest || *datasetID == "" {
+		fmt.Println("Usage: bq-backup restore --bucket=BUCKET_NAME --project=PROJECT_ID --date=YYYY-MM-DD|--tag=TAG|--latest|--latest-before=YYYY-MM-DD --dataset=DATASET [--table=TABLE] [--target-project=PROJECT_ID] [--target-dataset=DATASET] [--if-exists=fail|skip|truncate|append] [--dry-run] [--as-external] [--rehearse] [--sample=N] [--restore-concurrency=N]")
+		os.Exit(1)
+	}
+	if *targetProject == "" {
+		*targetProject = *projectID
+	}
+	if *targetDataset == "" {
+		*targetDataset = *datasetID
+	}
+
+	ctx := context.Background()
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		fmt.Printf("Failed to create Storage client: %v\n", err)
+		os.Exit(1)
+	}
+	defer storageClient.Close()
+
+	if *latest {
+		*date, err = latestCompleteBackup(ctx, *stateDir, storageClient, *bucketName, *projectID, *datasetID, *tableID, *latestBefore)
+		if err != nil {
+			fmt.Printf("Failed to look up the latest backup: %v\n", err)
+			os.Exit(1)
+		}
+		scope := *datasetID
+		if *tableID != "" {
+			scope += "." + *tableID
+		}
+		if *date == "" {
+			if *latestBefore != "" {
+				fmt.Printf("No complete backup of %s in %s before %s\n", scope, *projectID, *latestBefore)
+			} else {
+				fmt.Printf("No complete backup of %s in %s\n", scope, *projectID)
+			}
+			os.Exit(1)
+		}
+		fmt.Printf("Restoring the latest complete backup of %s, from %s\n", scope, *date)
+	}
+
+	client, err := bigquery.NewClient(ctx, *targetProject)
+	if err != nil {
+		fmt.Printf("Failed to create BigQuery client for project %s: %v\n", *targetProject, err)
+		os.Exit(1)
+	}
+	defer client.Close()
+
+	tables := []string{*tableID}
+	if *tableID == "" {
+		tables, err = listBackupTables(ctx, storageClient, *bucketName, *projectID, *date, *datasetID)
+		if err != nil {
+			fmt.Printf("Failed to list backup tables: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if len(tables) == 0 {
+		fmt.Printf("No backup found under gs://%s/%s/\n", *bucketName, backupPath(*projectID, *date, *datasetID))
+		os.Exit(1)
+	}
+
+	if *rehearse {
+		if err := rehearseRestore(ctx, *stateDir, *maxAttempts, client, storageClient, *bucketName, *projectID, *date, *datasetID, tables, *sample); err != nil {
+			fmt.Printf("Restore rehearsal failed: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	dataset := client.Dataset(*targetDataset)
+	existing, err := existingTables(ctx, dataset, tables)
+	if err != nil {
+		fmt.Printf("Failed to check destination tables: %v\n", err)
+		os.Exit(1)
+	}
+	if len(existing) > 0 {
+		fmt.Printf("%d of %d tables already exist in %s:\n", len(existing), len(tables), *targetDataset)
+		for _, t := range existing {
+			fmt.Printf("* %s.%s: %s\n", *targetDataset, t, existingTableAction[*ifExists])
+		}
+	}
+	if *dryRun {
+		loaded := len(tables) - len(existing)
+		if disposition != bigquery.WriteEmpty {
+			loaded = len(tables)
+		}
+		fmt.Printf("Dry run: %d tables would be loaded from gs://%s/%s/\n", loaded, *bucketName, backupPath(*projectID, *date, *datasetID))
+		return
+	}
+	if *ifExists == "fail" && len(existing) > 0 {
+		fmt.Println("Refusing to restore over existing tables, use --if-exists=skip, truncate or append")
+		os.Exit(1)
+	}
+	if *ifExists == "skip" {
+		tables = withoutTables(tables, existing)
+	}
+
+	if err := ensureDataset(ctx, dataset, storageClient, *bucketName, *projectID, *date, *datasetID); err != nil {
+		fmt.Printf("Failed to prepare dataset %s: %v\n", *targetDataset, err)
+		os.Exit(1)
+	}
+	if *asExternal {
+		if failed := createExternalTables(ctx, dataset, storageClient, *bucketName, *projectID, *date, *datasetID, tables, existing); failed > 0 {
+			fmt.Printf("%d of %d external tables failed to create\n", failed, len(tables))
+			os.Exit(1)
+		}
+		return
+	}
+	restored := restoreTables(ctx, dataset, storageClient, *bucketName, *projectID, *date, *datasetID, tables, *concurrency, *maxAttempts, disposition)
+	keysFailed := restoreConstraints(ctx, dataset, storageClient, *bucketName, *projectID, *date, *datasetID, restored)
+	if keysFailed > 0 {
+		fmt.Printf("Failed to restore the keys of %d tables\n", keysFailed)
+	}
+	if failed := len(tables) - len(restored); failed > 0 {
+		fmt.Printf("%d of %d tables failed to restore\n", failed, len(tables))
+		os.Exit(1)
+	}
+	if keysFailed > 0 {
+		os.Exit(1)
+	}
+}
+
+// restoreTables loads tables into dataset with up to concurrency load jobs in
+// flight, each attempted up to maxAttempts times, and returns the tables that
+// were restored.
+func restoreTables(ctx context.Context, dataset *bigquery.Dataset, storageClient *storage.Client, bucketName, projectID, date, datasetID string, tables []string, concurrency, maxAttempts int, disposition bigquery.TableWriteDisposition) []string {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	done := 0
+	var restored []string
+	started := time.Now()
+
+	for _, t := range tables {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(t string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			source, err := backupSource(ctx, storageClient, bucketName, projectID, date, datasetID, t)
+			if err == nil {
+				err = retryTransient(ctx, maxAttempts, fmt.Sprintf("Restore of %s.%s", dataset.DatasetID, t), func() error {
+					return restoreTable(ctx, dataset.Table(t), source, disposition)
+				})
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			done++
+			progress := fmt.Sprintf("[%d/%d, %s elapsed]", done, len(tables), time.Since(started).Round(time.Second))
+			if err != nil {
+				fmt.Printf("%s Failed to restore %s.%s: %v\n", progress, dataset.DatasetID, t, err)
+				return
+			}
+			restored = append(restored, t)
+			fmt.Printf("%s Restored %s.%s from %s\n", progress, dataset.DatasetID, t, source)
+		}(t)
+	}
+	wg.Wait()
+	return restored
+}
+
+// createExternalTables defines external tables over the backup files, so a
+// backup can be queried without loading it. Tables listed in replace are
+// dropped first. It returns the number of tables that failed.
+func createExternalTables(ctx context.Context, dataset *bigquery.Dataset, storageClient *storage.Client, bucketName, projectID, date, datasetID string, tables, replace []string) int {
+	replaced := make(map[string]bool, len(replace))
+	for _, t := range replace {
+		replaced[t] = true
+	}
+
+	failed := 0
+	for _, t := range tables {
+		table := dataset.Table(t)
+		if replaced[t] {
+			if err := table.Delete(ctx); err != nil && !isNotFound(err) {
+				fmt.Printf("Failed to replace %s.%s: %v\n", dataset.DatasetID, t, err)
+				failed++
+				continue
+			}
+		}
+
+		source, err := backupSource(ctx, storageClient, bucketName, projectID, date, datasetID, t)
+		if err != nil {
+			fmt.Printf("Failed to find backup files of %s: %v\n", t, err)
+			failed++
+			continue
+		}
+		sourceURI, err := source.externalSource()
+		if err != nil {
+			fmt.Printf("Can't create external table %s.%s: %v\n", dataset.DatasetID, t, err)
+			failed++
+			continue
+		}
+		f := source.format
+		meta := &bigquery.TableMetadata{
+			Description: fmt.Sprintf("bq-backup of %s.%s from %s", projectID, t, date),
+			ExternalDataConfig: &bigquery.ExternalDataConfig{
+				SourceFormat: f.format,
+				SourceURIs:   []string{sourceURI},
+			},
+		}
+		if f == avroFormat {
+			meta.ExternalDataConfig.Options = &bigquery.AvroOptions{UseAvroLogicalTypes: true}
+		}
+		if err := table.Create(ctx, meta); err != nil {
+			fmt.Printf("Failed to create external table %s.%s: %v\n", dataset.DatasetID, t, err)
+			failed++
+			continue
+		}
+		fmt.Printf("Created external table %s.%s over %s\n", dataset.DatasetID, t, sourceURI)
+	}
+	return failed
+}
+
+// writeDispositions maps --if-exists to the load job write disposition. fail
+// and skip load with WriteEmpty once existing tables have been dealt with.
+var writeDispositions = map[string]bigquery.TableWriteDisposition{
+	"truncate": bigquery.WriteTruncate,
+	"append":   bigquery.WriteAppend,
+}
+
+var existingTableAction = map[string]string{
+	"fail":     "exists, restore refused",
+	"skip":     "exists, skipped",
+	"truncate": "exists, will be overwritten",
+	"append":   "exists, rows will be appended",
+}
+
+// existingTables returns the tables that already exist in dataset.
+func existingTables(ctx context.Context, dataset *bigquery.Dataset, tables []string) ([]string, error) {
+	var existing []string
+	for _, t := range tables {
+		_, err := dataset.Table(t).Metadata(ctx)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		existing = append(existing, t)
+	}
+	return existing, nil
+}
+
+func withoutTables(tables, exclude []string) []string {
+	excluded := make(map[string]bool, len(exclude))
+	for _, t := range exclude {
+		excluded[t] = true
+	}
+	var kept []string
+	for _, t := range tables {
+		if !excluded[t] {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// listBackupTables returns the tables that have a backup directory or are in
+// the tiny table archive for the given project, date and dataset.
+func listBackupTables(ctx context.Context, storageClient *storage.Client, bucketName, projectID, date, datasetID string) ([]string, error) {
+	prefix := backupPath(projectID, date, datasetID) + "/"
+	it := storageClient.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: "/"})
+
+	var tables []string
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if attrs.Prefix != "" {
+			tables = append(tables, parsePathSegment(strings.TrimSuffix(strings.TrimPrefix(attrs.Prefix, prefix), "/")))
+		}
+	}
+
+	index, err := readBundleIndex(ctx, storageClient, bucketName, projectID, date, datasetID)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]bool, len(tables))
+	for _, t := range tables {
+		listed[t] = true
+	}
+	for _, t := range index.tableIDs() {
+		if !listed[t] {
+			tables = append(tables, t)
+		}
+	}
+	return tables, nil
+}
+
+// restoreTable loads a table's backup into table. The files of an archived
+// table are each loaded from the archive by their own load job.
+func restoreTable(ctx context.Context, table *bigquery.Table, source tableSource, disposition bigquery.TableWriteDisposition) error {
+	if len(source.archived) == 0 {
+		gcsRef := bigquery.NewGCSReference(source.uri)
+		gcsRef.SourceFormat = source.format.format
+		return runLoad(ctx, table.LoaderFrom(gcsRef), disposition)
+	}
+	for i, file := range source.archived {
+		reader, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("failed to read %s from the archive: %w", file.Name, err)
+		}
+		readerSource := bigquery.NewReaderSource(reader)
+		readerSource.SourceFormat = source.format.format
+		if i > 0 {
+			disposition = bigquery.WriteAppend
+		}
+		err = runLoad(ctx, table.LoaderFrom(readerSource), disposition)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.Name, err)
+		}
+	}
+	return nil
+}
+
+func runLoad(ctx context.Context, loader *bigquery.Loader, disposition bigquery.TableWriteDisposition) error {
+	loader.UseAvroLogicalTypes = true
+	loader.WriteDisposition = disposition
+
+	job, err := loader.Run(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start load job: %w", err)
+	}
+
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to wait for load job: %w", err)
+	}
+
+	if err := status.Err(); err != nil {
+		return fmt.Errorf("load job failed: %w", err)
+	}
+
+	return nil
+}
+
+// rehearseRestore restores a random sample of tables into a temporary dataset,
+// compares row counts against the catalog, records the outcome and drops the
+// dataset again.
+func rehearseRestore(ctx context.Context, stateDir string, maxAttempts int, client *bigquery.Client, storageClient *storage.Client, bucketName, projectID, date, datasetID string, tables []string, sample int) error {
+	rand.Shuffle(len(tables), func(i, j int) { tables[i], tables[j] = tables[j], tables[i] })
+	if sample > 0 && len(tables) > sample {
+		tables = tables[:sample]
+	}
+
+	expected := make(map[string]tableResult)
+	if entries, err := readCatalog(stateDir); err == nil {
+		latest, ok := latestCatalogEntries(entries, date)[projectID]
+		if !ok {
+			fmt.Printf("No catalog entry found for %s on %s, row counts will not be validated\n", projectID, date)
+		}
+		for _, t := range latest.Tables {
+			if t.DatasetID == datasetID {
+				expected[t.TableID] = t
+			}
+		}
+	} else {
+		fmt.Printf("Failed to read catalog, row counts will not be validated: %v\n", err)
+	}
+
+	runID := newRunID()
+	rehearsal := client.Dataset("bq_backup_rehearsal_" + runID)
+	datasetMeta := &bigquery.DatasetMetadata{
+		Description:            fmt.Sprintf("bq-backup restore rehearsal of %s/%s/%s", projectID, date, datasetID),
+		DefaultTableExpiration: 24 * time.Hour,
+		Labels:                 map[string]string{tempTableLabel: "true", runLabel: runID},
+	}
+	if source, err := client.DatasetInProject(projectID, datasetID).Metadata(ctx); err == nil {
+		datasetMeta.Location = source.Location
+	}
+	if err := rehearsal.Create(ctx, datasetMeta); err != nil {
+		return fmt.Errorf("failed to create rehearsal dataset: %w", err)
+	}
+	defer func() {
+		if err := rehearsal.DeleteWithContents(ctx); err != nil {
+			fmt.Printf("Failed to delete rehearsal dataset %s: %v\n", rehearsal.DatasetID, err)
+		}
+	}()
+
+	entry := catalogEntry{
+		RunID:     runID,
+		Kind:      catalogKindRehearsal,
+		Date:      date,
+		ProjectID: projectID,
+		Bucket:    bucketName,
+		Started:   time.Now(),
+	}
+	for _, tableID := range tables {
+		result := tableResult{DatasetID: datasetID, TableID: tableID, Status: statusSuccess, Started: time.Now()}
+		table := rehearsal.Table(tableID)
+		source, err := backupSource(ctx, storageClient, bucketName, projectID, date, datasetID, tableID)
+		if err == nil {
+			err = retryTransient(ctx, maxAttempts, fmt.Sprintf("Restore of %s.%s", rehearsal.DatasetID, tableID), func() error {
+				return restoreTable(ctx, table, source, bigquery.WriteEmpty)
+			})
+		}
+		if err != nil {
+			result.fail("Failed to restore table", err)
+		} else if meta, err := table.Metadata(ctx); err != nil {
+			result.fail("Failed to get metadata", err)
+		} else {
+			result.NumRows = meta.NumRows
+			result.NumBytes = meta.NumBytes
+			if want, ok := expected[tableID]; !ok {
+				result.Reason = fmt.Sprintf("%d rows restored, no catalog entry to validate against", meta.NumRows)
+			} else if want.NumRows != meta.NumRows {
+				result.Status, result.Reason = statusFailed, fmt.Sprintf("%d rows restored, expected %d", meta.NumRows, want.NumRows)
+				result.ErrorClass = errorClassValidation
+			}
+		}
+		result.Finished = time.Now()
+		entry.Tables = append(entry.Tables, result)
+		fmt.Printf("%s %s.%s %s\n", result.Status, datasetID, tableID, result.Reason)
+	}
+	entry.Finished = time.Now()
+
+	if err := appendCatalogEntry(stateDir, entry); err != nil {
+		fmt.Printf("Failed to write catalog entry: %v\n", err)
+	}
+
+	if failed := countFailed(entry); failed > 0 {
+		return fmt.Errorf("%d of %d sampled tables failed validation", failed, len(tables))
+	}
+	fmt.Printf("Restore rehearsal of %d tables succeeded\n", len(tables))
+	return nil
+}
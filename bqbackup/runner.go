@@ -0,0 +1,416 @@
+// Package bqbackup backs up BigQuery datasets to Cloud Storage. Main runs the
+// bq-backup command line; Runner embeds scheduled or ad-hoc backups in other
+// programs.
+package bqbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Options configures a Runner. Zero values leave optional features off;
+// RetentionDays, TinyTableConcurrency and MaxAttempts default as their
+// bq-backup flags do. An empty StateDir writes no local status log or catalog.
+type Options struct {
+	// Projects are the projects to back up into Bucket.
+	Projects []string
+	Bucket   string
+	// DatasetID and TableID narrow the backup down to one dataset, or one
+	// table of it, as with the backup subcommand.
+	DatasetID string
+	TableID   string
+
+	// CredentialsFile and ImpersonateServiceAccount select credentials as in
+	// a --config tenant block. By default the application default
+	// credentials are used.
+	CredentialsFile           string
+	ImpersonateServiceAccount string
+
+	// RetentionDays defaults to 7. SkipCleanup keeps old backups, as ad-hoc
+	// backups do.
+	RetentionDays int
+	SkipCleanup   bool
+	// StrictRetention reports objects without a date in their path instead
+	// of cleaning them up by creation time.
+	StrictRetention bool
+
+	DiscordWebhook    string
+	WorkspaceWebhook  string
+	CompletionWebhook string
+
+	StateDir string
+	// TempTableMaxAge is how old leftover temporary tables must be to be
+	// deleted at the start of each project (0 disables).
+	TempTableMaxAge    time.Duration
+	MaterializeTimeout time.Duration
+	// Reservation assigns materialization queries to a BigQuery reservation
+	// and MaterializeWindow (HH:MM-HH:MM local time) limits when they start.
+	Reservation       string
+	MaterializeWindow string
+
+	SkipExpiringWithin time.Duration
+	SkipSnapshots      bool
+	SkipClones         bool
+	// LabelAllowlist backs up only tables labelled bq-backup:include.
+	LabelAllowlist bool
+	Locations      []string
+	RunTags        []string
+
+	TemporaryHold     bool
+	InformationSchema bool
+	Connections       bool
+	KMSKeyVersion     string
+	// ReadbackProbe counts each table's rows through an external table over
+	// its backup; probes slower than ReadbackSLO are reported.
+	ReadbackProbe bool
+	ReadbackSLO   time.Duration
+	// Format is avro (the default) or parquet. HivePartitions exports
+	// partitioned tables one partition per COLUMN=VALUE directory.
+	Format         string
+	HivePartitions bool
+	// ExportRules override Format and set compression per table, as the
+	// exports of a --config file do.
+	ExportRules []ExportRule
+	// ReplicateDir is a directory exported files are also copied to, at
+	// most MaxBandwidth bytes per second (0 is unlimited).
+	ReplicateDir   string
+	MaxBandwidth   int64
+	TinyTableBytes int64
+	// TinyTableConcurrency defaults to 8.
+	TinyTableConcurrency int
+	// BundleTinyTables moves the files of tiny tables into one zip archive
+	// per dataset. It can't be combined with TemporaryHold.
+	BundleTinyTables bool
+	// MaxAttempts defaults to 3.
+	MaxAttempts int
+	// LogFileFormat is csv (the default) or jsonl, and MaxLogArchives the
+	// number of rotated status logs kept in StateDir (0 keeps all).
+	LogFileFormat  string
+	MaxLogArchives int
+	// AggregateWindow is how long a dataset's failures are batched into one
+	// alert while its project runs (0 sends no alerts before the summary).
+	AggregateWindow time.Duration
+	// AutotuneWorkers adapts the number of extract jobs in flight between
+	// MinWorkers (default 1) and MaxWorkers (default 16).
+	AutotuneWorkers bool
+	MinWorkers      int
+	MaxWorkers      int
+	// MaxErrors abandons a project after this many consecutive table
+	// failures (0 disables).
+	MaxErrors int
+	// MetadataConcurrency bounds the table metadata requests in flight
+	// while a project's tables are prefetched (default 16).
+	MetadataConcurrency int
+
+	// Estimate only plans each project's backup from its tables' metadata
+	// and prints the plan, exporting nothing.
+	Estimate bool
+
+	// GrafanaURL is a Grafana to push an annotation of each project's run
+	// to, with GrafanaToken unless it is empty.
+	GrafanaURL   string
+	GrafanaToken string
+	// Tickets opens issues for tables that keep failing.
+	Tickets TicketOptions
+
+	// Hooks are called before and after each project and table.
+	Hooks []Hook
+
+	// FakeBackend runs against an in-memory emulation of BigQuery and Cloud
+	// Storage instead of GCP, as --fake-backend does, for tests and dry runs.
+	// StateDir and the webhooks are then ignored.
+	FakeBackend bool
+}
+
+// Report summarises a Runner's run.
+type Report struct {
+	RunID    string
+	Projects int
+	Tables   int
+	Failed   int
+}
+
+// Runner backs up a set of projects. Each run keeps its own settings and
+// progress, so Runners may run concurrently.
+type Runner struct {
+	opts Options
+}
+
+// NewRunner returns a Runner for opts, with defaults filled in.
+func NewRunner(opts Options) *Runner {
+	if opts.RetentionDays == 0 {
+		opts.RetentionDays = defaultRetentionDays
+	}
+	if opts.TinyTableConcurrency == 0 {
+		opts.TinyTableConcurrency = 8
+	}
+	if opts.MaxAttempts == 0 {
+		opts.MaxAttempts = defaultMaxAttempts
+	}
+	if opts.MinWorkers == 0 {
+		opts.MinWorkers = 1
+	}
+	if opts.MetadataConcurrency == 0 {
+		opts.MetadataConcurrency = 16
+	}
+	if opts.MaxWorkers == 0 {
+		opts.MaxWorkers = max(opts.MinWorkers, 16)
+	}
+	return &Runner{opts: opts}
+}
+
+// Run backs up every project and returns once all of them are done or ctx is
+// cancelled. Failures, such as a project whose datasets can't be listed, are
+// reported in the Report and the error rather than ending the process.
+func (r *Runner) Run(ctx context.Context) (Report, error) {
+	opts := r.opts
+	if opts.Bucket == "" || len(opts.Projects) == 0 {
+		return Report{}, errors.New("a bucket and at least one project are required")
+	}
+	b, err := newBackupRun(opts)
+	if err != nil {
+		return Report{}, err
+	}
+
+	if opts.FakeBackend {
+		if b.fake, err = startFakeBackend(); err != nil {
+			return Report{}, fmt.Errorf("failed to start fake backend: %w", err)
+		}
+		defer b.fake.close()
+	}
+
+	ctx = b.open(ctx, 0)
+	defer b.close()
+
+	report := b.backupTenant(ctx, tenantConfig{
+		Projects:                  opts.Projects,
+		Bucket:                    opts.Bucket,
+		CredentialsFile:           opts.CredentialsFile,
+		ImpersonateServiceAccount: opts.ImpersonateServiceAccount,
+		RetentionDays:             opts.RetentionDays,
+		DiscordWebhook:            opts.DiscordWebhook,
+		WorkspaceWebhook:          opts.WorkspaceWebhook,
+	})
+	return Report{RunID: b.runID, Projects: report.Projects, Tables: report.Tables, Failed: report.Failed}, report.Err
+}
+
+// backupRun is the configuration and progress of one run, shared by the
+// tenants and projects it backs up. Runner.Run and the command line each
+// build their own from Options.
+type backupRun struct {
+	runID             string
+	scope             backupScope
+	stateDir          string
+	logFileFormat     string
+	maxLogArchives    int
+	skipCleanup       bool
+	tempTableMaxAge   time.Duration
+	strictRetention   bool
+	completionWebhook string
+	grafanaURL        string
+	grafanaToken      string
+	tickets           TicketOptions
+	// estimateOnly prints each project's plan instead of backing it up.
+	estimateOnly bool
+
+	materializeTimeout time.Duration
+	materializeWindow  timeWindow
+	reservation        string
+
+	policy    tablePolicy
+	locations []string
+	runTags   []string
+
+	temporaryHold     bool
+	informationSchema bool
+	connections       bool
+	kmsKeyVersion     string
+	readbackProbe     bool
+	readbackSLO       time.Duration
+
+	format         exportFormat
+	exportRules    []exportRule
+	hivePartitions bool
+	replicateDir   string
+	maxBandwidth   int64
+
+	tinyTableBytes       int64
+	tinyTableConcurrency int
+	bundleTinyTables     bool
+
+	maxAttempts         int
+	maxErrors           int
+	metadataConcurrency int
+	autotuneWorkers     bool
+	minWorkers          int
+	maxWorkers          int
+
+	aggregateWindow time.Duration
+
+	// simulateFailureRate is the fraction of tables whose failure is
+	// simulated, with the hidden --simulate-failures flag.
+	simulateFailureRate float64
+	// fake is the backend the run's clients use instead of GCP, if any.
+	fake *fakeBackend
+	// jsonOut routes stdout through JSON logs and tui shows in-flight
+	// work, if the command line asks for them.
+	jsonOut *jsonStdout
+	tui     *liveStatus
+	// cursorMu serialises updates of the cleanup cursor file by the run's
+	// tenants.
+	cursorMu sync.Mutex
+
+	hooks []Hook
+	// pendingPostRun holds the post-run events of the projects whose pre-run
+	// hooks ran, until their post-run hooks run.
+	pendingMu      sync.Mutex
+	pendingPostRun map[string]HookEvent
+
+	// statusLog, state and watchdog are nil when the run doesn't keep them.
+	statusLog *statusLogWriter
+	state     *statusTracker
+	watchdog  *watchdog
+	// prefetched and extractWorkers are those of the project being backed
+	// up.
+	prefetched     *metadataCache
+	extractWorkers *workerController
+}
+
+// newBackupRun checks opts and returns the run they configure.
+func newBackupRun(opts Options) (*backupRun, error) {
+	if opts.TableID != "" && opts.DatasetID == "" {
+		return nil, errors.New("a table requires a dataset")
+	}
+	if err := validateReservation(opts.Reservation); err != nil {
+		return nil, fmt.Errorf("invalid reservation: %w", err)
+	}
+	window, err := parseTimeWindow(opts.MaterializeWindow)
+	if err != nil {
+		return nil, fmt.Errorf("invalid materialize window: %w", err)
+	}
+	if opts.MinWorkers < 1 || opts.MaxWorkers < opts.MinWorkers {
+		return nil, fmt.Errorf("invalid worker bounds %d and %d, expected 1 <= min <= max", opts.MinWorkers, opts.MaxWorkers)
+	}
+	if opts.LogFileFormat == "" {
+		opts.LogFileFormat = "csv"
+	}
+	if opts.LogFileFormat != "csv" && opts.LogFileFormat != "jsonl" {
+		return nil, fmt.Errorf("invalid log file format %q, expected csv or jsonl", opts.LogFileFormat)
+	}
+	if opts.BundleTinyTables && opts.TemporaryHold {
+		return nil, errors.New("tiny tables can't be archived with a temporary hold, as held files can't be removed once archived")
+	}
+	exportFmt := avroFormat
+	if opts.Format != "" {
+		if exportFmt, err = parseExportFormat(opts.Format); err != nil {
+			return nil, fmt.Errorf("invalid format: %w", err)
+		}
+	}
+	rules, err := compileExportRules(opts.ExportRules, exportFmt)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Tickets.After > 0 && opts.StateDir == "" {
+		return nil, errors.New("tickets need a state directory, failure streaks are counted from the catalog")
+	}
+	// A dry run leaves the catalog and state of real runs alone.
+	if opts.FakeBackend {
+		opts.StateDir, opts.CompletionWebhook = "", ""
+	}
+
+	return &backupRun{
+		runID:             newRunID(),
+		scope:             backupScope{DatasetID: opts.DatasetID, TableID: opts.TableID},
+		stateDir:          opts.StateDir,
+		logFileFormat:     opts.LogFileFormat,
+		maxLogArchives:    opts.MaxLogArchives,
+		skipCleanup:       opts.SkipCleanup,
+		tempTableMaxAge:   opts.TempTableMaxAge,
+		strictRetention:   opts.StrictRetention,
+		completionWebhook: opts.CompletionWebhook,
+		grafanaURL:        opts.GrafanaURL,
+		grafanaToken:      opts.GrafanaToken,
+		tickets:           opts.Tickets,
+		estimateOnly:      opts.Estimate,
+
+		materializeTimeout: opts.MaterializeTimeout,
+		materializeWindow:  window,
+		reservation:        opts.Reservation,
+
+		policy: tablePolicy{
+			SkipExpiringWithin: opts.SkipExpiringWithin,
+			SkipSnapshots:      opts.SkipSnapshots,
+			SkipClones:         opts.SkipClones,
+			Allowlist:          opts.LabelAllowlist,
+		},
+		locations: opts.Locations,
+		runTags:   opts.RunTags,
+
+		temporaryHold:     opts.TemporaryHold,
+		informationSchema: opts.InformationSchema,
+		connections:       opts.Connections,
+		kmsKeyVersion:     opts.KMSKeyVersion,
+		readbackProbe:     opts.ReadbackProbe,
+		readbackSLO:       opts.ReadbackSLO,
+
+		format:         exportFmt,
+		exportRules:    rules,
+		hivePartitions: opts.HivePartitions,
+		replicateDir:   opts.ReplicateDir,
+		maxBandwidth:   opts.MaxBandwidth,
+
+		tinyTableBytes:       opts.TinyTableBytes,
+		tinyTableConcurrency: opts.TinyTableConcurrency,
+		bundleTinyTables:     opts.BundleTinyTables,
+
+		maxAttempts:         opts.MaxAttempts,
+		maxErrors:           opts.MaxErrors,
+		metadataConcurrency: opts.MetadataConcurrency,
+		autotuneWorkers:     opts.AutotuneWorkers,
+		minWorkers:          opts.MinWorkers,
+		maxWorkers:          opts.MaxWorkers,
+
+		aggregateWindow: opts.AggregateWindow,
+
+		hooks:          opts.Hooks,
+		pendingPostRun: make(map[string]HookEvent),
+	}, nil
+}
+
+// open starts the run's status log if it has a state directory and, unless
+// it only estimates, its status tracker and a watchdog cancelling it after
+// timeout (0 disables). The run goes on in the context open returns.
+func (b *backupRun) open(ctx context.Context, timeout time.Duration) context.Context {
+	if b.stateDir != "" {
+		b.statusLog = openStatusLog(b.stateDir, b.runID, b.logFileFormat, b.maxLogArchives)
+	}
+	// An estimate exports nothing, so there is no run for monitoring to
+	// follow or to time out.
+	if b.estimateOnly {
+		return ctx
+	}
+	b.state = startStatusTracker(b.stateDir, b.runID)
+	if timeout > 0 {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		b.watchdog = startWatchdog(b, timeout, cancel)
+	}
+	return ctx
+}
+
+// showProgress reports whether progress bars are drawn, which they are
+// unless the output is JSON or the live view is on.
+func (b *backupRun) showProgress() bool {
+	return b.tui == nil && b.jsonOut == nil
+}
+
+// close stops what open started, writing out the final status and the
+// status log.
+func (b *backupRun) close() {
+	b.watchdog.stop()
+	b.state.finish(runStateFinished)
+	b.statusLog.close()
+}
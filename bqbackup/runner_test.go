@@ -0,0 +1,77 @@
+package bqbackup
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestRunnerFakeBackend(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       Options
+		wantTables int
+	}{
+		{"projects", Options{Projects: []string{"p1", "p2"}}, 10},
+		{"dataset", Options{Projects: []string{"p1"}, DatasetID: "sales"}, 3},
+		{"table", Options{Projects: []string{"p1"}, DatasetID: "sales", TableID: "orders"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			opts.Bucket, opts.FakeBackend = "bucket", true
+			// Ignored by a dry run.
+			opts.StateDir, opts.DiscordWebhook = t.TempDir(), "http://127.0.0.1:1/webhook"
+			report, err := NewRunner(opts).Run(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Projects != len(opts.Projects) || report.Tables != tt.wantTables || report.Failed != 0 {
+				t.Errorf("report = %+v, want %d projects, %d tables, none failed", report, len(opts.Projects), tt.wantTables)
+			}
+			if entries, _ := os.ReadDir(opts.StateDir); len(entries) > 0 {
+				t.Errorf("dry run wrote %d files into the state directory", len(entries))
+			}
+		})
+	}
+}
+
+func TestRunnersConcurrently(t *testing.T) {
+	runs := []struct {
+		opts       Options
+		wantTables int
+	}{
+		{Options{Projects: []string{"p1"}, Estimate: true}, 0},
+		{Options{Projects: []string{"p2"}, MaxAttempts: 1}, 5},
+		{Options{Projects: []string{"p3"}, DatasetID: "sales"}, 3},
+	}
+	reports := make([]Report, len(runs))
+	errs := make([]error, len(runs))
+	var wg sync.WaitGroup
+	for i, run := range runs {
+		opts := run.opts
+		opts.Bucket, opts.FakeBackend = "bucket", true
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reports[i], errs[i] = NewRunner(opts).Run(context.Background())
+		}()
+	}
+	wg.Wait()
+	for i, run := range runs {
+		if errs[i] != nil || reports[i].Tables != run.wantTables {
+			t.Errorf("run %d: report = %+v, %v, want %d tables", i, reports[i], errs[i], run.wantTables)
+		}
+	}
+}
+
+// newTestRun returns a run with opts, with defaults filled in as Runner does.
+func newTestRun(t *testing.T, opts Options) *backupRun {
+	t.Helper()
+	b, err := newBackupRun(NewRunner(opts).opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,162 @@
+package bqbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/storage"
+)
+
+const schemaFileSuffix = ".schema.json"
+
+// schemaPath returns where a table's schema is written: next to the table's
+// directory rather than in it, so it isn't taken for an exported file.
+func schemaPath(projectID, date, datasetID, tableID string) string {
+	return backupPath(projectID, date, datasetID, tableID) + schemaFileSuffix
+}
+
+// writeTableSchema writes a table's schema in the JSON format of bq show
+// --schema and returns how it changed since the backup of previousDate, if
+// that backup has a schema of the table.
+func writeTableSchema(ctx context.Context, store objectStore, bucketName, projectID, date, previousDate, datasetID, tableID string, schema bigquery.Schema) ([]string, error) {
+	data, err := schema.ToJSONFields()
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Write(ctx, bucketName, schemaPath(projectID, date, datasetID, tableID), data); err != nil {
+		return nil, err
+	}
+	if previousDate == "" {
+		return nil, nil
+	}
+
+	previousData, err := store.Read(ctx, bucketName, schemaPath(projectID, previousDate, datasetID, tableID))
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read previous schema: %w", err)
+	}
+	previous, err := bigquery.SchemaFromJSON(previousData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse previous schema: %w", err)
+	}
+	return diffSchemas(previous, schema), nil
+}
+
+// previousBackupDate returns the latest date before date with a backup of the
+// project, or "" if there is none.
+func previousBackupDate(ctx context.Context, store objectStore, bucketName, projectID, date string) (string, error) {
+	prefix := pathSegment(projectID) + "/"
+	previous := ""
+	err := store.List(ctx, bucketName, &storage.Query{Prefix: prefix, Delimiter: "/"}, func(attrs *storage.ObjectAttrs) error {
+		d := strings.TrimSuffix(strings.TrimPrefix(attrs.Prefix, prefix), "/")
+		if attrs.Prefix != "" && d < date && d > previous {
+			previous = d
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return previous, nil
+}
+
+// schemaColumn is a column of a flattened schema; nested columns are named by
+// their path, e.g. address.city.
+type schemaColumn struct {
+	Parent   string
+	Position int
+	Type     string
+}
+
+func flattenSchema(schema bigquery.Schema, parent string, columns map[string]schemaColumn) {
+	for i, field := range schema {
+		name := field.Name
+		if parent != "" {
+			name = parent + "." + field.Name
+		}
+		typ := string(field.Type)
+		if field.Repeated {
+			typ = "REPEATED " + typ
+		}
+		columns[name] = schemaColumn{Parent: parent, Position: i, Type: typ}
+		flattenSchema(field.Schema, name, columns)
+	}
+}
+
+// diffSchemas describes columns that were added, removed, renamed or changed
+// type. A removed and an added column of the same type at the same position
+// are taken to be a rename.
+func diffSchemas(before, after bigquery.Schema) []string {
+	prev := make(map[string]schemaColumn)
+	cur := make(map[string]schemaColumn)
+	flattenSchema(before, "", prev)
+	flattenSchema(after, "", cur)
+
+	var added, removed, changes []string
+	for name, c := range cur {
+		p, ok := prev[name]
+		switch {
+		case !ok:
+			added = append(added, name)
+		case p.Type != c.Type:
+			changes = append(changes, fmt.Sprintf("%s %s -> %s", name, p.Type, c.Type))
+		}
+	}
+	for name := range prev {
+		if _, ok := cur[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	renamed := make(map[string]bool)
+	for _, r := range removed {
+		// Columns nested in a renamed column show up as removed and added
+		// too; they are covered by the rename of their parent.
+		if renamed[prev[r].Parent] {
+			renamed[r] = true
+			continue
+		}
+		for _, a := range added {
+			if !renamed[a] && cur[a].Parent == prev[r].Parent && cur[a].Position == prev[r].Position && cur[a].Type == prev[r].Type {
+				changes = append(changes, fmt.Sprintf("renamed %s -> %s", r, a))
+				renamed[r], renamed[a] = true, true
+				break
+			}
+		}
+	}
+	for _, a := range added {
+		if renamed[cur[a].Parent] {
+			renamed[a] = true
+		}
+		if !renamed[a] {
+			changes = append(changes, fmt.Sprintf("added %s %s", a, cur[a].Type))
+		}
+	}
+	for _, r := range removed {
+		if !renamed[r] {
+			changes = append(changes, "removed "+r)
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// formatSchemaChanges lists the schema changes of a run, one line per table.
+func formatSchemaChanges(results []tableResult) []string {
+	var lines []string
+	for _, r := range results {
+		if len(r.SchemaChanges) > 0 {
+			lines = append(lines, fmt.Sprintf("%s.%s: %s", r.DatasetID, r.TableID, strings.Join(r.SchemaChanges, ", ")))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
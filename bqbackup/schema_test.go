@@ -0,0 +1,100 @@
+package bqbackup
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	raw "google.golang.org/api/storage/v1"
+)
+
+func TestDiffSchemas(t *testing.T) {
+	id := &bigquery.FieldSchema{Name: "id", Type: bigquery.IntegerFieldType}
+	name := &bigquery.FieldSchema{Name: "name", Type: bigquery.StringFieldType}
+	tests := []struct {
+		name          string
+		before, after bigquery.Schema
+		want          []string
+	}{
+		{"unchanged", bigquery.Schema{id, name}, bigquery.Schema{id, name}, nil},
+		{"added", bigquery.Schema{id}, bigquery.Schema{id, name}, []string{"added name STRING"}},
+		{"removed", bigquery.Schema{id, name}, bigquery.Schema{id}, []string{"removed name"}},
+		{"type changed", bigquery.Schema{id}, bigquery.Schema{{Name: "id", Type: bigquery.StringFieldType}}, []string{"id INTEGER -> STRING"}},
+		{"renamed", bigquery.Schema{id, name}, bigquery.Schema{id, {Name: "label", Type: bigquery.StringFieldType}}, []string{"renamed name -> label"}},
+		{
+			"renamed record",
+			bigquery.Schema{{Name: "a", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{id}}},
+			bigquery.Schema{{Name: "b", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{id}}},
+			[]string{"renamed a -> b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffSchemas(tt.before, tt.after); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffSchemas() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreviousBackupDate(t *testing.T) {
+	tests := []struct {
+		name    string
+		objects []string
+		want    string
+	}{
+		{"none", nil, ""},
+		{"latest earlier", []string{"p/2024-04-01/a/t/0.avro", "p/2024-04-30/a/t/0.avro", "p/2024-05-01/a/t/0.avro"}, "2024-04-30"},
+		{"other projects", []string{"p2/2024-04-30/a/t/0.avro", "p/2024-04-01/a/t/0.avro"}, "2024-04-01"},
+		{"only later", []string{"p/2024-05-02/a/t/0.avro"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, c := newTestBackend(t)
+			for _, name := range tt.objects {
+				putTestObject(f, "bucket", name, time.Now(), raw.Object{})
+			}
+			got, err := previousBackupDate(context.Background(), c.objects, "bucket", "p", "2024-05-01")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("previousBackupDate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackupDatasetTableSchemaChanges(t *testing.T) {
+	// The fake's tables have a NUMERIC amount.
+	const previous = `[{"name": "id", "type": "INTEGER", "mode": "REQUIRED"}, {"name": "name", "type": "STRING"}, {"name": "amount", "type": "FLOAT"}, {"name": "created", "type": "TIMESTAMP"}]`
+	tests := []struct {
+		name     string
+		previous string
+		want     []string
+	}{
+		{"changed", previous, []string{"amount FLOAT -> NUMERIC"}},
+		{"no previous schema", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, c := newTestBackend(t)
+			ctx := context.Background()
+			if tt.previous != "" {
+				if err := c.objects.Write(ctx, "bucket", "p/2024-05-01/sales/orders.schema.json", []byte(tt.previous)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			b := newTestRun(t, Options{MaxAttempts: 1})
+			result := b.backupDatasetTable(ctx, c, "bucket", "p", "2024-05-02", "2024-05-01", "sales", "orders")
+			if result.Status != statusSuccess {
+				t.Fatalf("status = %s (%s), want %s", result.Status, result.Reason, statusSuccess)
+			}
+			if !reflect.DeepEqual(result.SchemaChanges, tt.want) {
+				t.Errorf("schema changes = %v, want %v", result.SchemaChanges, tt.want)
+			}
+		})
+	}
+}
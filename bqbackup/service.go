@@ -0,0 +1,162 @@
+package bqbackup
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// serveBackups backs up the tenants of the config file at path with run,
+// starting a run every interval the config sets, or else every interval, until
+// ctx is done. Changes to the file are logged as they are made and apply from the
+// next run; a file that no longer parses, or whose export rules don't compile
+// against format, is ignored until it is fixed.
+func serveBackups(ctx context.Context, path string, config backupConfig, interval time.Duration, format exportFormat, run func(backupConfig)) {
+	reloads := make(chan backupConfig, 1)
+	go watchConfig(ctx, path, config, format, reloads)
+
+	var started time.Time
+	for {
+		next := started.Add(config.interval(interval))
+		wait := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			wait.Stop()
+			return
+		case config = <-reloads:
+			// The new interval counts from the start of the last run.
+			wait.Stop()
+			continue
+		case <-wait.C:
+		}
+		started = time.Now()
+		run(config)
+		if ctx.Err() == nil {
+			fmt.Printf("Next run at %s\n", started.Add(config.interval(interval)).Format(time.RFC3339))
+		}
+	}
+}
+
+// watchConfig sends the config file at path to reloads whenever it changes
+// from config, replacing a change the runs haven't picked up yet.
+func watchConfig(ctx context.Context, path string, config backupConfig, format exportFormat, reloads chan backupConfig) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Printf("Failed to watch %s, changes need a restart: %v\n", path, err)
+		return
+	}
+	defer watcher.Close()
+	// The directory is watched, as editors and Kubernetes config maps replace
+	// the file rather than write to it. Config maps swap their ..data link.
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		fmt.Printf("Failed to watch %s, changes need a restart: %v\n", path, err)
+		return
+	}
+
+	var invalid string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-watcher.Errors:
+			fmt.Printf("Failed to watch %s: %v\n", path, err)
+		case event := <-watcher.Events:
+			if name := filepath.Base(event.Name); name != filepath.Base(path) && name != "..data" {
+				continue
+			}
+			changed, err := readConfig(path)
+			if err == nil {
+				_, err = compileExportRules(changed.Exports, format)
+			}
+			if err != nil {
+				// A file being written is read several times.
+				if err.Error() != invalid {
+					fmt.Printf("Ignoring the change to %s: %v\n", path, err)
+				}
+				invalid = err.Error()
+				continue
+			}
+			invalid = ""
+			diff := diffConfigs(config, changed)
+			if len(diff) == 0 {
+				continue
+			}
+			fmt.Printf("Reloaded %s, the changes apply from the next run:\n", path)
+			for _, line := range diff {
+				fmt.Printf("* %s\n", line)
+			}
+			config = changed
+			select {
+			case <-reloads:
+			default:
+			}
+			reloads <- config
+		}
+	}
+}
+
+// diffConfigs describes what changed from before to after. Webhook URLs carry
+// their secret, so only whether they changed is described.
+func diffConfigs(before, after backupConfig) []string {
+	var diff []string
+	if before.Every != after.Every {
+		diff = append(diff, fmt.Sprintf("every: %s -> %s", orNone(before.Every), orNone(after.Every)))
+	}
+	if !slices.Equal(before.Exports, after.Exports) {
+		diff = append(diff, fmt.Sprintf("exports: %d rules -> %d rules", len(before.Exports), len(after.Exports)))
+	}
+	if !slices.Equal(before.Locations, after.Locations) {
+		diff = append(diff, fmt.Sprintf("locations: %s -> %s", orNone(strings.Join(before.Locations, ",")), orNone(strings.Join(after.Locations, ","))))
+	}
+	if before.LabelMode != after.LabelMode {
+		diff = append(diff, fmt.Sprintf("label_mode: %s -> %s", orNone(before.LabelMode), orNone(after.LabelMode)))
+	}
+
+	tenants := make(map[string]tenantConfig, len(before.Tenants))
+	for _, t := range before.Tenants {
+		tenants[t.Name] = t
+	}
+	for _, t := range after.Tenants {
+		o, ok := tenants[t.Name]
+		if !ok {
+			diff = append(diff, fmt.Sprintf("tenant %s added", t.Name))
+			continue
+		}
+		delete(tenants, t.Name)
+		changed := func(field, from, to string) {
+			if from != to {
+				diff = append(diff, fmt.Sprintf("tenant %s: %s %s -> %s", t.Name, field, orNone(from), orNone(to)))
+			}
+		}
+		changed("projects", fmt.Sprint(o.Projects), fmt.Sprint(t.Projects))
+		changed("bucket", o.Bucket, t.Bucket)
+		changed("credentials_file", o.CredentialsFile, t.CredentialsFile)
+		changed("impersonate_service_account", o.ImpersonateServiceAccount, t.ImpersonateServiceAccount)
+		changed("retention_days", fmt.Sprint(o.RetentionDays), fmt.Sprint(t.RetentionDays))
+		changed("tag_ids", fmt.Sprint(o.TagIDs), fmt.Sprint(t.TagIDs))
+		if o.DiscordWebhook != t.DiscordWebhook {
+			diff = append(diff, fmt.Sprintf("tenant %s: discord_webhook changed", t.Name))
+		}
+		if o.WorkspaceWebhook != t.WorkspaceWebhook {
+			diff = append(diff, fmt.Sprintf("tenant %s: workspace_webhook changed", t.Name))
+		}
+	}
+	for _, t := range before.Tenants {
+		if _, ok := tenants[t.Name]; ok {
+			diff = append(diff, fmt.Sprintf("tenant %s removed", t.Name))
+		}
+	}
+	return diff
+}
+
+func orNone(s string) string {
+	if s == "" || s == "[]" {
+		return "(none)"
+	}
+	return s
+}
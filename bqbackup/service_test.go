@@ -0,0 +1,45 @@
+package bqbackup
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	tenant := tenantConfig{Name: "a", Projects: []string{"p1"}, Bucket: "b", DiscordWebhook: "https://discord/secret"}
+	tests := []struct {
+		name   string
+		change func(c *backupConfig)
+		want   []string
+	}{
+		{"unchanged", func(c *backupConfig) {}, nil},
+		{"every", func(c *backupConfig) { c.Every = "6h" }, []string{"every: (none) -> 6h"}},
+		{"exports", func(c *backupConfig) { c.Exports = []ExportRule{{Dataset: "raw"}} }, []string{"exports: 0 rules -> 1 rules"}},
+		{"filters", func(c *backupConfig) {
+			c.Locations = []string{"EU", "US"}
+			c.LabelMode = "allowlist"
+		}, []string{"locations: (none) -> EU,US", "label_mode: (none) -> allowlist"}},
+		{"tenant added", func(c *backupConfig) {
+			c.Tenants = append(c.Tenants, tenantConfig{Name: "b"})
+		}, []string{"tenant b added"}},
+		{"tenant removed", func(c *backupConfig) { c.Tenants = nil }, []string{"tenant a removed"}},
+		{"projects and bucket", func(c *backupConfig) {
+			c.Tenants[0].Projects = append(c.Tenants[0].Projects, "p2")
+			c.Tenants[0].Bucket = "c"
+		}, []string{"tenant a: projects [p1] -> [p1 p2]", "tenant a: bucket b -> c"}},
+		{"webhook is not logged", func(c *backupConfig) {
+			c.Tenants[0].DiscordWebhook = "https://discord/other"
+		}, []string{"tenant a: discord_webhook changed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := backupConfig{Tenants: []tenantConfig{tenant}}
+			after := backupConfig{Tenants: []tenantConfig{tenant}}
+			after.Tenants[0].Projects = append([]string(nil), tenant.Projects...)
+			tt.change(&after)
+			if got := diffConfigs(before, after); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffConfigs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
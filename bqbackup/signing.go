@@ -0,0 +1,123 @@
+package bqbackup
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+const signatureSuffix = ".sig"
+
+// manifestSignature is written next to a manifest as MANIFEST.sig. The
+// signature is over the SHA-256 digest of the manifest object as written.
+type manifestSignature struct {
+	KMSKeyVersion string    `json:"kms_key_version"`
+	Algorithm     string    `json:"algorithm"`
+	SHA256        string    `json:"sha256"`
+	Signature     string    `json:"signature"`
+	Signed        time.Time `json:"signed"`
+}
+
+// manifestSigner signs manifests with a Cloud KMS asymmetric signing key. A
+// nil *manifestSigner signs nothing.
+type manifestSigner struct {
+	kms        *cloudkms.Service
+	keyVersion string
+	algorithm  string
+}
+
+func newManifestSigner(ctx context.Context, keyVersion string, opts ...option.ClientOption) (*manifestSigner, error) {
+	if keyVersion == "" {
+		return nil, nil
+	}
+	service, err := cloudkms.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := service.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions.GetPublicKey(keyVersion).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get public key of %s: %w", keyVersion, err)
+	}
+	if !strings.HasSuffix(publicKey.Algorithm, "_SHA256") {
+		return nil, fmt.Errorf("key %s uses %s, only SHA-256 signing keys are supported", keyVersion, publicKey.Algorithm)
+	}
+	return &manifestSigner{kms: service, keyVersion: keyVersion, algorithm: publicKey.Algorithm}, nil
+}
+
+func (s *manifestSigner) sign(ctx context.Context, data []byte) (*manifestSignature, error) {
+	if s == nil {
+		return nil, nil
+	}
+	digest := sha256.Sum256(data)
+	resp, err := s.kms.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions.AsymmetricSign(s.keyVersion, &cloudkms.AsymmetricSignRequest{
+		Digest: &cloudkms.Digest{Sha256: base64.StdEncoding.EncodeToString(digest[:])},
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return &manifestSignature{
+		KMSKeyVersion: s.keyVersion,
+		Algorithm:     s.algorithm,
+		SHA256:        hex.EncodeToString(digest[:]),
+		Signature:     resp.Signature,
+		Signed:        time.Now(),
+	}, nil
+}
+
+// verifySignature checks that sig is a valid signature of data by the public
+// key of the trusted KMS key version keyVersion.
+func verifySignature(ctx context.Context, service *cloudkms.Service, keyVersion string, data []byte, sig manifestSignature) error {
+	digest := sha256.Sum256(data)
+	if hex.EncodeToString(digest[:]) != sig.SHA256 {
+		return errors.New("manifest digest does not match the signed digest")
+	}
+	signature, err := base64.StdEncoding.DecodeString(sig.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %w", err)
+	}
+
+	publicKey, err := service.Projects.Locations.KeyRings.CryptoKeys.CryptoKeyVersions.GetPublicKey(keyVersion).Context(ctx).Do()
+	if err != nil {
+		return fmt.Errorf("failed to get public key of %s: %w", keyVersion, err)
+	}
+	block, _ := pem.Decode([]byte(publicKey.Pem))
+	if block == nil {
+		return fmt.Errorf("failed to decode public key of %s", keyVersion)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse public key of %s: %w", keyVersion, err)
+	}
+
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return errors.New("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if strings.Contains(publicKey.Algorithm, "_PSS_") {
+			err = rsa.VerifyPSS(key, crypto.SHA256, digest[:], signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid signature: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	return nil
+}
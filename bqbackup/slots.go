@@ -0,0 +1,84 @@
+package bqbackup
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var reservationPattern = regexp.MustCompile(`^(none|projects/[a-z0-9-]+/locations/[a-z0-9-]+/reservations/[a-z0-9_-]+)$`)
+
+// validateReservation checks the reservation materialization queries are
+// assigned to, as projects/P/locations/L/reservations/R or "none" for
+// on-demand (empty uses the project's assignment).
+func validateReservation(name string) error {
+	if name != "" && !reservationPattern.MatchString(name) {
+		return fmt.Errorf("%q, expected projects/P/locations/L/reservations/R or none", name)
+	}
+	return nil
+}
+
+// timeWindow is a daily window of local time, such as 22:00-06:00. The zero
+// value is always open.
+type timeWindow struct {
+	start, end time.Duration
+	set        bool
+}
+
+// parseTimeWindow parses HH:MM-HH:MM; an empty string is always open. A window
+// whose end is before its start spans midnight.
+func parseTimeWindow(s string) (timeWindow, error) {
+	if s == "" {
+		return timeWindow{}, nil
+	}
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return timeWindow{}, fmt.Errorf("%q, expected HH:MM-HH:MM", s)
+	}
+	start, err := parseTimeOfDay(from)
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("%q: %w", s, err)
+	}
+	end, err := parseTimeOfDay(to)
+	if err != nil {
+		return timeWindow{}, fmt.Errorf("%q: %w", s, err)
+	}
+	return timeWindow{start: start, end: end, set: true}, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// contains reports whether t falls within the window.
+func (w timeWindow) contains(t time.Time) bool {
+	if !w.set {
+		return true
+	}
+	of := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.start <= w.end {
+		return of >= w.start && of < w.end
+	}
+	return of >= w.start || of < w.end
+}
+
+func (w timeWindow) String() string {
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return format(w.start) + "-" + format(w.end)
+}
+
+// withReservation prefixes a query with the statement that assigns it to the
+// run's reservation, if one is configured.
+func (b *backupRun) withReservation(sql string) string {
+	if b.reservation == "" {
+		return sql
+	}
+	return fmt.Sprintf("SET @@reservation = '%s';\n%s", b.reservation, sql)
+}
@@ -0,0 +1,63 @@
+package bqbackup
+
+import (
+	"context"
+)
+
+const datasetStatsFileName = "_stats.json"
+
+// datasetStats summarises one dataset's backup so consumers can check its
+// scope without listing every exported file.
+type datasetStats struct {
+	ProjectID     string       `json:"project_id"`
+	DatasetID     string       `json:"dataset_id"`
+	Date          string       `json:"date"`
+	RunID         string       `json:"run_id"`
+	Tables        int          `json:"tables"`
+	Succeeded     int          `json:"succeeded"`
+	Failed        int          `json:"failed"`
+	Skipped       int          `json:"skipped"`
+	ExportedBytes int64        `json:"exported_bytes"`
+	ExportedFiles int          `json:"exported_files"`
+	TableStats    []tableStats `json:"table_stats"`
+}
+
+type tableStats struct {
+	TableID       string `json:"table_id"`
+	Status        string `json:"status"`
+	Reason        string `json:"reason,omitempty"`
+	ExportedBytes int64  `json:"exported_bytes"`
+	ExportedFiles int    `json:"exported_files"`
+}
+
+func writeDatasetStats(ctx context.Context, store objectStore, bucketName, projectID, date, datasetID, runID string, results []tableResult) error {
+	stats := datasetStats{
+		ProjectID: projectID,
+		DatasetID: datasetID,
+		Date:      date,
+		RunID:     runID,
+		Tables:    len(results),
+	}
+	for _, r := range results {
+		switch r.Status {
+		case statusSuccess:
+			stats.Succeeded++
+		case statusFailed:
+			stats.Failed++
+		case statusSkipped:
+			stats.Skipped++
+		}
+		stats.ExportedBytes += r.ExportedBytes
+		stats.ExportedFiles += r.ExportedFiles
+		stats.TableStats = append(stats.TableStats, tableStats{
+			TableID:       r.TableID,
+			Status:        r.Status,
+			Reason:        r.Reason,
+			ExportedBytes: r.ExportedBytes,
+			ExportedFiles: r.ExportedFiles,
+		})
+	}
+
+	name := backupPath(projectID, date, datasetID) + "/" + datasetStatsFileName
+	return writeJSONObject(ctx, store, bucketName, name, stats)
+}
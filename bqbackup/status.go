@@ -0,0 +1,253 @@
+package bqbackup
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	statusFileName          = "status.json"
+	statusFileWriteInterval = 5 * time.Second
+)
+
+// runStatus is what status.json and /status report about the run in
+// progress.
+type runStatus struct {
+	RunID          string    `json:"run_id"`
+	State          string    `json:"state"`
+	Started        time.Time `json:"started"`
+	Updated        time.Time `json:"updated"`
+	ProjectsDone   int       `json:"projects_done"`
+	ProjectID      string    `json:"project_id,omitempty"`
+	ProjectStarted time.Time `json:"project_started"`
+	Datasets       int       `json:"datasets"`
+	DatasetsDone   int       `json:"datasets_done"`
+	Tables         int       `json:"tables"`
+	TablesDone     int       `json:"tables_done"`
+	TablesFailed   int       `json:"tables_failed"`
+	TablesSkipped  int       `json:"tables_skipped"`
+	// Bytes are the bytes the project plans to export, and BytesDone those
+	// of its finished tables.
+	Bytes     int64 `json:"bytes"`
+	BytesDone int64 `json:"bytes_done"`
+	// InFlight are the tables being backed up, as DATASET.TABLE.
+	InFlight []string `json:"in_flight"`
+	// ETA is when the current project is expected to finish, going by the
+	// time its finished tables took, per byte if it has any.
+	ETA *time.Time `json:"eta,omitempty"`
+}
+
+const (
+	runStateRunning  = "running"
+	runStateFinished = "finished"
+	runStateTimedOut = "timed_out"
+)
+
+// statusTracker keeps the run's status for orchestrators polling a run in
+// progress, writing it to status.json in the state directory as it changes.
+// A nil *statusTracker ignores all updates.
+type statusTracker struct {
+	dir string
+
+	mu     sync.Mutex
+	status runStatus
+	// ready is set once the run's clients are initialised, until it
+	// finishes.
+	ready    bool
+	inFlight map[string]bool
+	dirty    bool
+	done     chan struct{}
+	stopped  chan struct{}
+	once     sync.Once
+}
+
+// startStatusTracker tracks the run, writing status.json into dir unless it
+// is empty.
+func startStatusTracker(dir, runID string) *statusTracker {
+	t := &statusTracker{
+		dir:      dir,
+		status:   runStatus{RunID: runID, State: runStateRunning, Started: time.Now()},
+		inFlight: make(map[string]bool),
+		dirty:    true,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *statusTracker) update(f func(s *runStatus)) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(&t.status)
+	t.dirty = true
+}
+
+func (t *statusTracker) startProject(projectID string, datasets, tables int, bytes int64) {
+	t.update(func(s *runStatus) {
+		s.ProjectID, s.ProjectStarted = projectID, time.Now()
+		s.Datasets, s.DatasetsDone = datasets, 0
+		s.Tables, s.TablesDone, s.TablesFailed, s.TablesSkipped = tables, 0, 0, 0
+		s.Bytes, s.BytesDone = bytes, 0
+	})
+}
+
+func (t *statusTracker) finishProject() {
+	t.update(func(s *runStatus) {
+		s.ProjectsDone++
+	})
+}
+
+func (t *statusTracker) finishDataset() {
+	t.update(func(s *runStatus) {
+		s.DatasetsDone++
+	})
+}
+
+func (t *statusTracker) startTable(datasetID, tableID string) {
+	t.update(func(s *runStatus) {
+		t.inFlight[datasetID+"."+tableID] = true
+	})
+}
+
+func (t *statusTracker) finishTable(result tableResult) {
+	t.update(func(s *runStatus) {
+		delete(t.inFlight, result.DatasetID+"."+result.TableID)
+		s.TablesDone++
+		switch result.Status {
+		case statusFailed:
+			s.TablesFailed++
+		case statusSkipped:
+			s.TablesSkipped++
+		}
+		if result.Status != statusSkipped {
+			s.BytesDone += result.NumBytes
+		}
+	})
+}
+
+// snapshot returns the current status.
+func (t *statusTracker) snapshot() runStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.status
+	s.Updated = time.Now()
+	s.InFlight = make([]string, 0, len(t.inFlight))
+	for name := range t.inFlight {
+		s.InFlight = append(s.InFlight, name)
+	}
+	sort.Strings(s.InFlight)
+	if remaining, ok := remainingTime(time.Since(s.ProjectStarted), s.TablesDone, s.Tables, s.BytesDone, s.Bytes); ok && s.State == runStateRunning {
+		eta := time.Now().Add(remaining)
+		s.ETA = &eta
+	}
+	return s
+}
+
+// markReady marks the run's clients initialised.
+func (t *statusTracker) markReady() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ready = true
+}
+
+// isReady reports whether the run's clients are initialised and it is not
+// finished yet.
+func (t *statusTracker) isReady() bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ready
+}
+
+// finish sets the final state of the run and writes the final status.
+func (t *statusTracker) finish(state string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.ready = false
+	t.mu.Unlock()
+	// Only the first final state counts, in case the watchdog fires as the
+	// run finishes.
+	t.once.Do(func() {
+		t.update(func(s *runStatus) {
+			s.State = state
+		})
+		close(t.done)
+	})
+	<-t.stopped
+}
+
+func (t *statusTracker) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(statusFileWriteInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			t.write()
+			return
+		case <-ticker.C:
+			t.write()
+		}
+	}
+}
+
+// write replaces status.json if the status changed since it was last
+// written. The file is renamed into place, so readers never see half of it.
+func (t *statusTracker) write() {
+	if t.dir == "" {
+		return
+	}
+	t.mu.Lock()
+	dirty := t.dirty
+	t.dirty = false
+	t.mu.Unlock()
+	if !dirty {
+		return
+	}
+
+	data, err := json.MarshalIndent(t.snapshot(), "", "  ")
+	if err != nil {
+		fmt.Printf("Failed to marshal run status: %v\n", err)
+		return
+	}
+	path := filepath.Join(t.dir, statusFileName)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		fmt.Printf("Failed to write run status: %v\n", err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		fmt.Printf("Failed to write run status: %v\n", err)
+	}
+}
+
+// serveStatus serves the status of the run whose tracker status holds, the
+// latest one with --every, as JSON.
+func serveStatus(status *atomic.Pointer[statusTracker]) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := status.Load()
+		if t == nil {
+			http.Error(w, "no run in progress", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.snapshot())
+	}
+}
@@ -0,0 +1,160 @@
+package bqbackup
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	statusLogFlushInterval = time.Second
+	statusLogQueueSize     = 1024
+)
+
+type statusLogLine struct {
+	entry  statusLogEntry
+	reason string
+}
+
+// statusLogWriter appends table outcomes to the status log in the state
+// directory from a single goroutine, so lines from concurrent tables are
+// never interleaved and the file is opened once per run. Lines are buffered
+// and flushed periodically; the log is rotated between flushes. Lines
+// written after close are dropped. A nil *statusLogWriter is valid and
+// discards all lines.
+type statusLogWriter struct {
+	path string
+	// runID names the archives of the log the run rotates, of which
+	// maxArchives are kept.
+	runID       string
+	maxArchives int
+	// format is csv or jsonl.
+	format string
+	lines  chan statusLogLine
+	done   chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func openStatusLog(stateDir, runID, format string, maxArchives int) *statusLogWriter {
+	path := filepath.Join(stateDir, logFileName)
+	if format == "jsonl" {
+		path = filepath.Join(stateDir, jsonLogFileName)
+	}
+	w := &statusLogWriter{
+		path:        path,
+		runID:       runID,
+		maxArchives: maxArchives,
+		format:      format,
+		lines:       make(chan statusLogLine, statusLogQueueSize),
+		done:        make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *statusLogWriter) write(entry statusLogEntry, reason string) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.closed {
+		w.lines <- statusLogLine{entry, reason}
+	}
+}
+
+// close writes out every queued line and waits for the file to be closed.
+// Closing it again only waits.
+func (w *statusLogWriter) close() {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.lines)
+	}
+	w.mu.Unlock()
+	<-w.done
+}
+
+func (w *statusLogWriter) run() {
+	defer close(w.done)
+
+	var file *os.File
+	var buf *bufio.Writer
+	open := func() {
+		if err := manageLogFileSize(w.path, w.runID, w.maxArchives); err != nil {
+			fmt.Printf("Failed to manage log file size: %v\n", err)
+		}
+		var err error
+		file, err = os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Printf("Failed to open log file: %v\n", err)
+			file, buf = nil, nil
+			return
+		}
+		buf = bufio.NewWriter(file)
+	}
+	flush := func() {
+		if file == nil {
+			return
+		}
+		if err := buf.Flush(); err != nil {
+			fmt.Printf("Failed to write log entry: %v\n", err)
+		}
+		file.Close()
+		file = nil
+	}
+
+	ticker := time.NewTicker(statusLogFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-w.lines:
+			if !ok {
+				flush()
+				return
+			}
+			if file == nil {
+				open()
+			}
+			if file != nil {
+				w.writeLine(buf, line)
+			}
+		case <-ticker.C:
+			// Closing the file on every flush lets the next line check the
+			// size and rotate the log before reopening it.
+			flush()
+		}
+	}
+}
+
+func (w *statusLogWriter) writeLine(buf *bufio.Writer, line statusLogLine) {
+	if w.format == "jsonl" {
+		data, err := json.Marshal(line.entry)
+		if err != nil {
+			fmt.Printf("Failed to marshal log entry: %v\n", err)
+			return
+		}
+		buf.Write(append(data, '\n'))
+		return
+	}
+
+	result := line.entry.tableResult
+	writer := csv.NewWriter(buf)
+	logEntry := []string{line.entry.Date, line.entry.ProjectID, result.DatasetID, result.TableID, result.Status, line.reason,
+		result.Started.Format(time.RFC3339), result.Finished.Format(time.RFC3339),
+		fmt.Sprintf("%.1f", result.duration().Seconds()), fmt.Sprintf("%.2f", result.MBPerSec), result.ErrorClass}
+	if err := writer.Write(logEntry); err != nil {
+		fmt.Printf("Failed to write log entry: %v\n", err)
+	}
+	writer.Flush()
+}
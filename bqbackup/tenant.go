@@ -0,0 +1,148 @@
+package bqbackup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// backupConfig is the file given with --config.
+type backupConfig struct {
+	Tenants []tenantConfig `json:"tenants"`
+	// Exports override --format for the tables they match, in every tenant.
+	Exports []ExportRule `json:"exports,omitempty"`
+	// Every overrides --every, e.g. "6h", and runs the tenants as a service
+	// even without it.
+	Every string `json:"every,omitempty"`
+	// Locations and LabelMode override --locations and --label-mode.
+	Locations []string `json:"locations,omitempty"`
+	LabelMode string   `json:"label_mode,omitempty"`
+}
+
+// interval returns how often the tenants are backed up as a service, which
+// is fallback unless the config sets it.
+func (c backupConfig) interval(fallback time.Duration) time.Duration {
+	if every, err := time.ParseDuration(c.Every); err == nil {
+		return every
+	}
+	return fallback
+}
+
+// options returns opts with the settings of the config applied.
+func (c backupConfig) options(opts Options) Options {
+	opts.ExportRules = c.Exports
+	if c.Locations != nil {
+		opts.Locations = c.Locations
+	}
+	if c.LabelMode != "" {
+		opts.LabelAllowlist = c.LabelMode == "allowlist"
+	}
+	return opts
+}
+
+// tenantConfig is a set of projects backed up into one bucket with its own
+// credentials and notification channels. Runs without --config back up a
+// single unnamed tenant built from the flags.
+type tenantConfig struct {
+	Name     string   `json:"name"`
+	Projects []string `json:"projects"`
+	Bucket   string   `json:"bucket"`
+	// CredentialsFile is a service account key used instead of the
+	// application default credentials.
+	CredentialsFile string `json:"credentials_file,omitempty"`
+	// ImpersonateServiceAccount is a service account to impersonate, on top
+	// of CredentialsFile or the application default credentials.
+	ImpersonateServiceAccount string `json:"impersonate_service_account,omitempty"`
+	// RetentionDays defaults to --retention.
+	RetentionDays    int    `json:"retention_days,omitempty"`
+	DiscordWebhook   string `json:"discord_webhook,omitempty"`
+	WorkspaceWebhook string `json:"workspace_webhook,omitempty"`
+	// TagIDs defaults to --tagid.
+	TagIDs []string `json:"tag_ids,omitempty"`
+}
+
+func readConfig(path string) (backupConfig, error) {
+	var config backupConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	seen := make(map[string]bool)
+	for i, t := range config.Tenants {
+		if t.Name == "" || t.Bucket == "" || len(t.Projects) == 0 {
+			return config, fmt.Errorf("tenant %d needs a name, a bucket and at least one project", i+1)
+		}
+		if seen[t.Name] {
+			return config, fmt.Errorf("duplicate tenant %q", t.Name)
+		}
+		seen[t.Name] = true
+	}
+	if len(config.Tenants) == 0 {
+		return config, fmt.Errorf("no tenants in %s", path)
+	}
+	if config.LabelMode != "" && config.LabelMode != "denylist" && config.LabelMode != "allowlist" {
+		return config, fmt.Errorf("invalid label_mode %q, expected denylist or allowlist", config.LabelMode)
+	}
+	if config.Every != "" {
+		if every, err := time.ParseDuration(config.Every); err != nil || every <= 0 {
+			return config, fmt.Errorf("invalid every %q, expected a duration such as 6h", config.Every)
+		}
+	}
+	return config, nil
+}
+
+// clientOptions returns the options to create the tenant's BigQuery and
+// Storage clients with, pointing them at fake unless it is nil.
+func (t tenantConfig) clientOptions(ctx context.Context, fake *fakeBackend) ([]option.ClientOption, error) {
+	if fake != nil {
+		return fake.clientOptions(), nil
+	}
+	var opts []option.ClientOption
+	if t.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(t.CredentialsFile))
+	}
+	if t.ImpersonateServiceAccount != "" {
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: t.ImpersonateServiceAccount,
+			Scopes:          []string{"https://www.googleapis.com/auth/cloud-platform"},
+		}, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to impersonate %s: %w", t.ImpersonateServiceAccount, err)
+		}
+		opts = []option.ClientOption{option.WithTokenSource(ts)}
+	}
+	return opts, nil
+}
+
+// tenantReport summarises a tenant's run for the end-of-run report.
+type tenantReport struct {
+	Name     string
+	Projects int
+	Tables   int
+	Failed   int
+	Err      error
+}
+
+func printTenantReports(reports []tenantReport) {
+	fmt.Println("Tenant summary:")
+	for _, r := range reports {
+		if r.Err != nil {
+			fmt.Printf("%s %s: %v\n", statusFailed, r.Name, r.Err)
+			continue
+		}
+		status := statusSuccess
+		if r.Failed > 0 {
+			status = statusFailed
+		}
+		fmt.Printf("%s %s: %d projects, %d tables, %d failed\n", status, r.Name, r.Projects, r.Tables, r.Failed)
+	}
+}
@@ -0,0 +1,70 @@
+package bqbackup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		wantErr   string
+		wantEvery time.Duration
+	}{
+		{"valid", `{"tenants": [{"name": "a", "bucket": "b", "projects": ["p"]}]}`, "", time.Hour},
+		{"every", `{"every": "6h", "tenants": [{"name": "a", "bucket": "b", "projects": ["p"]}]}`, "", 6 * time.Hour},
+		{"invalid every", `{"every": "daily", "tenants": [{"name": "a", "bucket": "b", "projects": ["p"]}]}`, `invalid every "daily"`, 0},
+		{"negative every", `{"every": "-1h", "tenants": [{"name": "a", "bucket": "b", "projects": ["p"]}]}`, `invalid every "-1h"`, 0},
+		{"invalid label mode", `{"label_mode": "all", "tenants": [{"name": "a", "bucket": "b", "projects": ["p"]}]}`, `invalid label_mode "all"`, 0},
+		{"no tenants", `{"tenants": []}`, "no tenants", 0},
+		{"no bucket", `{"tenants": [{"name": "a", "projects": ["p"]}]}`, "tenant 1 needs a name, a bucket and at least one project", 0},
+		{"duplicate", `{"tenants": [{"name": "a", "bucket": "b", "projects": ["p"]}, {"name": "a", "bucket": "c", "projects": ["q"]}]}`, `duplicate tenant "a"`, 0},
+		{"not json", `tenants:`, "failed to parse", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(path, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			config, err := readConfig(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("readConfig() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := config.interval(time.Hour); got != tt.wantEvery {
+				t.Errorf("interval = %s, want %s", got, tt.wantEvery)
+			}
+		})
+	}
+}
+
+func TestConfigOptions(t *testing.T) {
+	flags := Options{Locations: []string{"US"}, LabelAllowlist: true}
+	tests := []struct {
+		name   string
+		config backupConfig
+		want   Options
+	}{
+		{"flags", backupConfig{}, flags},
+		{"filters", backupConfig{Locations: []string{"EU"}, LabelMode: "denylist"}, Options{Locations: []string{"EU"}}},
+		{"exports", backupConfig{Exports: []ExportRule{{Dataset: "raw"}}}, Options{Locations: []string{"US"}, LabelAllowlist: true, ExportRules: []ExportRule{{Dataset: "raw"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.options(flags); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("options() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package bqbackup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// TicketOptions configures the issues opened for tables that keep failing,
+// in GitHub, Jira or both.
+type TicketOptions struct {
+	// After is how many runs in a row a table must fail in before an issue
+	// is opened or updated (0 disables). Streaks are counted from the
+	// catalog, so it needs a state directory.
+	After int
+
+	GitHubRepo  string
+	GitHubToken string
+
+	JiraURL     string
+	JiraProject string
+	JiraUser    string
+	JiraToken   string
+}
+
+// enabled reports whether failures are tracked in any issue tracker.
+func (o TicketOptions) enabled() bool {
+	return o.After > 0 && (o.GitHubRepo != "" || o.JiraURL != "")
+}
+
+// failureStreaks returns, for every table that failed in the latest backup of
+// projectID, the number of consecutive runs it has failed in.
+func failureStreaks(entries []catalogEntry, projectID string) map[string]int {
+	var runs []catalogEntry
+	for _, entry := range entries {
+		if entry.Kind == "" && entry.ProjectID == projectID {
+			runs = append(runs, entry)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Started.After(runs[j].Started) })
+
+	streaks := make(map[string]int)
+	if len(runs) == 0 {
+		return streaks
+	}
+	for _, t := range runs[0].Tables {
+		if !t.failed() {
+			continue
+		}
+		name := t.DatasetID + "." + t.TableID
+		for _, run := range runs {
+			if !tableFailedIn(run, t.DatasetID, t.TableID) {
+				break
+			}
+			streaks[name]++
+		}
+	}
+	return streaks
+}
+
+func tableFailedIn(entry catalogEntry, datasetID, tableID string) bool {
+	for _, t := range entry.Tables {
+		if t.DatasetID == datasetID && t.TableID == tableID {
+			return t.failed()
+		}
+	}
+	return false
+}
+
+// fileTicketsForPersistentFailures opens or updates an issue for every table
+// of the latest run that has failed at least o.After runs in a row.
+func (o TicketOptions) fileTicketsForPersistentFailures(stateDir string, entry catalogEntry) {
+	entries, err := readCatalog(stateDir)
+	if err != nil {
+		fmt.Printf("Failed to read catalog for failure tracking: %v\n", err)
+		return
+	}
+
+	streaks := failureStreaks(entries, entry.ProjectID)
+	for _, t := range entry.Tables {
+		name := t.DatasetID + "." + t.TableID
+		if streaks[name] < o.After {
+			continue
+		}
+
+		title := fmt.Sprintf("[bq-backup] %s.%s has failed %d runs in a row", entry.ProjectID, name, streaks[name])
+		body := fmt.Sprintf("Backup of `%s.%s` failed in run %s on %s (%d consecutive failures).\n\nClass: %s\nError: %s\n",
+			entry.ProjectID, name, entry.RunID, entry.Date, streaks[name], t.ErrorClass, t.Reason)
+		key := fmt.Sprintf("[bq-backup] %s.%s", entry.ProjectID, name)
+
+		if o.GitHubRepo != "" {
+			if err := o.upsertGitHubIssue(key, title, body); err != nil {
+				fmt.Printf("Failed to update GitHub issue for %s: %v\n", name, err)
+			}
+		}
+		if o.JiraURL != "" {
+			if err := o.upsertJiraIssue(key, title, body); err != nil {
+				fmt.Printf("Failed to update Jira issue for %s: %v\n", name, err)
+			}
+		}
+	}
+}
+
+// upsertGitHubIssue comments on the open issue whose title starts with key, or
+// opens a new one.
+func (o TicketOptions) upsertGitHubIssue(key, title, body string) error {
+	query := fmt.Sprintf("repo:%s is:issue is:open in:title \"%s\"", o.GitHubRepo, key)
+	var search struct {
+		Items []struct {
+			Number int    `json:"number"`
+			Title  string `json:"title"`
+		} `json:"items"`
+	}
+	if err := o.githubRequest(http.MethodGet, "/search/issues?q="+url.QueryEscape(query), nil, &search); err != nil {
+		return err
+	}
+
+	for _, issue := range search.Items {
+		if strings.HasPrefix(issue.Title, key) {
+			return o.githubRequest(http.MethodPost, fmt.Sprintf("/repos/%s/issues/%d/comments", o.GitHubRepo, issue.Number),
+				map[string]interface{}{"body": body}, nil)
+		}
+	}
+	return o.githubRequest(http.MethodPost, fmt.Sprintf("/repos/%s/issues", o.GitHubRepo),
+		map[string]interface{}{"title": title, "body": body, "labels": []string{"bq-backup"}}, nil)
+}
+
+func (o TicketOptions) githubRequest(method, path string, payload, out interface{}) error {
+	req, err := newJSONRequest(method, "https://api.github.com"+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+o.GitHubToken)
+	return doJSONRequest(req, out)
+}
+
+// upsertJiraIssue comments on the unresolved issue whose summary contains key,
+// or creates a new bug.
+func (o TicketOptions) upsertJiraIssue(key, title, body string) error {
+	jql := fmt.Sprintf("project = %q AND summary ~ %q AND statusCategory != Done", o.JiraProject, "\""+key+"\"")
+	var search struct {
+		Issues []struct {
+			Key    string `json:"key"`
+			Fields struct {
+				Summary string `json:"summary"`
+			} `json:"fields"`
+		} `json:"issues"`
+	}
+	if err := o.jiraRequest(http.MethodPost, "/rest/api/2/search", map[string]interface{}{"jql": jql, "fields": []string{"summary"}}, &search); err != nil {
+		return err
+	}
+
+	for _, issue := range search.Issues {
+		if strings.HasPrefix(issue.Fields.Summary, key) {
+			return o.jiraRequest(http.MethodPost, fmt.Sprintf("/rest/api/2/issue/%s/comment", issue.Key), map[string]interface{}{"body": body}, nil)
+		}
+	}
+	return o.jiraRequest(http.MethodPost, "/rest/api/2/issue", map[string]interface{}{
+		"fields": map[string]interface{}{
+			"project":     map[string]string{"key": o.JiraProject},
+			"summary":     title,
+			"description": body,
+			"issuetype":   map[string]string{"name": "Bug"},
+			"labels":      []string{"bq-backup"},
+		},
+	}, nil)
+}
+
+func (o TicketOptions) jiraRequest(method, path string, payload, out interface{}) error {
+	req, err := newJSONRequest(method, strings.TrimSuffix(o.JiraURL, "/")+path, payload)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(o.JiraUser, o.JiraToken)
+	return doJSONRequest(req, out)
+}
+
+func newJSONRequest(method, url string, payload interface{}) (*http.Request, error) {
+	var body bytes.Buffer
+	if payload != nil {
+		if err := json.NewEncoder(&body).Encode(payload); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, url, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func doJSONRequest(req *http.Request, out interface{}) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: received status code %d", req.Method, req.URL.Path, resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
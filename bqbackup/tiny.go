@@ -0,0 +1,60 @@
+package bqbackup
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// splitTinyTables separates tables below --tiny-table-bytes from the rest,
+// using the prefetched sizes or, failing that, a single __TABLES__ query.
+func (b *backupRun) splitTinyTables(ctx context.Context, client *bigquery.Client, dataset *bigquery.Dataset, tables []string) (tiny, large []string) {
+	if b.tinyTableBytes <= 0 || b.tinyTableConcurrency <= 1 {
+		return nil, tables
+	}
+
+	sizes, ok := b.prefetched.sizes(dataset.DatasetID, tables)
+	if !ok {
+		var err error
+		if sizes, err = datasetTableSizes(ctx, client, dataset); err != nil {
+			fmt.Printf("Failed to get table sizes for dataset %s, exporting tables one by one: %v\n", dataset.DatasetID, err)
+			return nil, tables
+		}
+	}
+
+	for _, tableID := range tables {
+		if size, ok := sizes[tableID]; ok && size < b.tinyTableBytes {
+			tiny = append(tiny, tableID)
+		} else {
+			large = append(large, tableID)
+		}
+	}
+	return tiny, large
+}
+
+func datasetTableSizes(ctx context.Context, client *bigquery.Client, dataset *bigquery.Dataset) (map[string]int64, error) {
+	query := client.Query("SELECT table_id, size_bytes FROM " + quoteIdentifier(dataset.ProjectID, dataset.DatasetID, "__TABLES__"))
+	it, err := query.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[string]int64)
+	for {
+		var row struct {
+			TableID   string `bigquery:"table_id"`
+			SizeBytes int64  `bigquery:"size_bytes"`
+		}
+		err := it.Next(&row)
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		sizes[row.TableID] = row.SizeBytes
+	}
+	return sizes, nil
+}
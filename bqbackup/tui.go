@@ -0,0 +1,176 @@
+package bqbackup
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tuiRefreshInterval = 500 * time.Millisecond
+	tuiMaxFailures     = 10
+	tuiLineWidth       = 100
+)
+
+// liveStatus tracks in-flight work for the --tui mode. A nil *liveStatus is
+// valid and ignores all updates, so callers don't need to check whether the
+// TUI is enabled.
+type liveStatus struct {
+	mu           sync.Mutex
+	projectID    string
+	started      time.Time
+	datasets     int
+	datasetsDone int
+	tables       int
+	tablesDone   int
+	tablesFailed int
+	bytesDone    int64
+	inFlight     map[string]time.Time
+	failures     []string
+	done         chan struct{}
+
+	// bytes are the bytes the project plans to export, and bytesProcessed
+	// those of the tables finished, whether they succeeded or not.
+	bytes          int64
+	bytesProcessed int64
+}
+
+func newLiveStatus() *liveStatus {
+	return &liveStatus{inFlight: make(map[string]time.Time)}
+}
+
+func (s *liveStatus) startProject(projectID string, datasets, tables int, bytes int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.projectID = projectID
+	s.started = time.Now()
+	s.datasets = datasets
+	s.datasetsDone = 0
+	s.tables = tables
+	s.tablesDone = 0
+	s.tablesFailed = 0
+	s.bytesDone = 0
+	s.bytes = bytes
+	s.bytesProcessed = 0
+	s.failures = nil
+	s.done = make(chan struct{})
+	s.mu.Unlock()
+
+	go s.renderLoop(s.done)
+}
+
+func (s *liveStatus) finishProject() {
+	if s == nil {
+		return
+	}
+	close(s.done)
+	s.render()
+}
+
+func (s *liveStatus) startTable(datasetID, tableID string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight[datasetID+"."+tableID] = time.Now()
+}
+
+func (s *liveStatus) finishTable(result tableResult) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inFlight, result.DatasetID+"."+result.TableID)
+	s.tablesDone++
+	if result.Status != statusSkipped {
+		s.bytesProcessed += result.NumBytes
+	}
+	if result.Status == statusFailed {
+		s.tablesFailed++
+		s.failures = append(s.failures, fmt.Sprintf("%s.%s: %s", result.DatasetID, result.TableID, result.Reason))
+		if len(s.failures) > tuiMaxFailures {
+			s.failures = s.failures[1:]
+		}
+		return
+	}
+	if result.Status == statusSuccess {
+		s.bytesDone += result.NumBytes
+	}
+}
+
+func (s *liveStatus) finishDataset() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.datasetsDone++
+}
+
+func (s *liveStatus) renderLoop(done chan struct{}) {
+	ticker := time.NewTicker(tuiRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.render()
+		}
+	}
+}
+
+func (s *liveStatus) render() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elapsed := time.Since(s.started)
+	var b strings.Builder
+	b.WriteString("\033[H\033[2J")
+	fmt.Fprintf(&b, "bq-backup  project %s  elapsed %s\n\n", s.projectID, elapsed.Round(time.Second))
+	fmt.Fprintf(&b, "Datasets  %d/%d\n", s.datasetsDone, s.datasets)
+	fmt.Fprintf(&b, "Tables    %d/%d done, %d failed, %d in flight\n", s.tablesDone, s.tables, s.tablesFailed, len(s.inFlight))
+
+	seconds := elapsed.Seconds()
+	if seconds > 0 {
+		fmt.Fprintf(&b, "Rate      %.2f tables/s, %.1f MB/s\n", float64(s.tablesDone)/seconds, float64(s.bytesDone)/seconds/1024/1024)
+	}
+	if eta, ok := remainingTime(elapsed, s.tablesDone, s.tables, s.bytesProcessed, s.bytes); ok {
+		fmt.Fprintf(&b, "ETA       %s\n", eta.Round(time.Second))
+	}
+
+	names := make([]string, 0, len(s.inFlight))
+	for name := range s.inFlight {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return s.inFlight[names[i]].Before(s.inFlight[names[j]]) })
+
+	fmt.Fprintf(&b, "\nIn flight\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "  %-70s %s\n", truncate(name, 70), time.Since(s.inFlight[name]).Round(time.Second))
+	}
+
+	if len(s.failures) > 0 {
+		fmt.Fprintf(&b, "\nRecent failures\n")
+		for _, failure := range s.failures {
+			fmt.Fprintf(&b, "  %s\n", truncate(failure, tuiLineWidth))
+		}
+	}
+
+	fmt.Fprint(os.Stdout, b.String())
+}
+
+func truncate(s string, n int) string {
+	r := []rune(strings.ReplaceAll(s, "\n", " "))
+	if len(r) <= n {
+		return string(r)
+	}
+	return string(r[:n-3]) + "..."
+}
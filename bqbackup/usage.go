@@ -0,0 +1,249 @@
+package bqbackup
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// projectUsage is the storage a project's backups take up in the bucket.
+type projectUsage struct {
+	ProjectID string
+	Total     int64
+	// Dates and Datasets break Total down by backup date and by dataset
+	// across all dates.
+	Dates    map[string]int64
+	Datasets map[string]int64
+	// DatasetClasses breaks each dataset down by storage class, and
+	// DatasetLatest is the size of its latest backup, taken on
+	// DatasetLatestDate.
+	DatasetClasses    map[string]map[string]int64
+	DatasetLatest     map[string]int64
+	DatasetLatestDate map[string]string
+}
+
+func runUsage(args []string) {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	bucketName := fs.String("bucket", "", "GCS bucket name")
+	projectID := fs.String("project", "", "Only report this project")
+	scenarios := fs.String("retention-scenarios", "7,14,30,60,90", "Comma-separated retention periods in days to project the footprint for")
+	pricingFile := fs.String("pricing", "", "JSON pricing table overriding the default GCS storage and transfer prices")
+	costCSV := fs.String("cost-csv", "", "Write the estimated monthly cost per dataset to this CSV file")
+	fs.Parse(args)
+
+	if *bucketName == "" {
+		fmt.Println("Usage: bq-backup usage --bucket=BUCKET_NAME [--project=PROJECT_ID] [--retention-scenarios=7,14,30] [--pricing=PRICING_FILE] [--cost-csv=FILE]")
+		os.Exit(1)
+	}
+	pricing, err := readPricing(*pricingFile)
+	if err != nil {
+		fmt.Printf("Failed to read pricing: %v\n", err)
+		os.Exit(1)
+	}
+	var retentions []int
+	for _, s := range strings.Split(*scenarios, ",") {
+		days, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || days <= 0 {
+			fmt.Printf("Invalid --retention-scenarios entry %q\n", s)
+			os.Exit(1)
+		}
+		retentions = append(retentions, days)
+	}
+
+	ctx := context.Background()
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		fmt.Printf("Failed to create Storage client: %v\n", err)
+		os.Exit(1)
+	}
+	defer storageClient.Close()
+
+	bucketAttrs, err := storageClient.Bucket(*bucketName).Attrs(ctx)
+	if err != nil {
+		fmt.Printf("Failed to get bucket attributes: %v\n", err)
+		os.Exit(1)
+	}
+
+	prefix := ""
+	if *projectID != "" {
+		prefix = pathSegment(*projectID) + "/"
+	}
+	usage, err := bucketUsage(ctx, storageClient, *bucketName, prefix, bucketAttrs.StorageClass)
+	if err != nil {
+		fmt.Printf("Failed to list backups: %v\n", err)
+		os.Exit(1)
+	}
+	if len(usage) == 0 {
+		fmt.Printf("No backups found in gs://%s/%s\n", *bucketName, prefix)
+		return
+	}
+
+	var total int64
+	var costs []datasetCost
+	var monthly float64
+	for _, u := range usage {
+		total += u.Total
+		projectCosts := estimateCosts(ctx, storageClient, *bucketName, bucketAttrs.Location, u, pricing)
+		for _, c := range projectCosts {
+			monthly += c.total()
+		}
+		costs = append(costs, projectCosts...)
+		fmt.Print(formatProjectUsage(u, retentions) + formatCosts(projectCosts, pricing))
+	}
+	fmt.Printf("\nTotal: %s, estimated %.2f %s/month\n", formatBytes(total), monthly, pricing.Currency)
+
+	if *costCSV != "" {
+		if err := writeCostCSV(*costCSV, costs, pricing); err != nil {
+			fmt.Printf("Failed to write cost report: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// bucketUsage adds up the size of every backup object under prefix by project,
+// date and dataset. Objects outside the PROJECT/DATE/ layout are ignored.
+// Objects without a storage class are counted under the bucket's defaultClass.
+func bucketUsage(ctx context.Context, storageClient *storage.Client, bucketName, prefix, defaultClass string) ([]*projectUsage, error) {
+	byProject := make(map[string]*projectUsage)
+	it := storageClient.Bucket(bucketName).Objects(ctx, &storage.Query{Prefix: prefix})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		parts := strings.Split(attrs.Name, "/")
+		if len(parts) < 3 {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", parts[1]); err != nil {
+			continue
+		}
+
+		projectID := parsePathSegment(parts[0])
+		u, ok := byProject[projectID]
+		if !ok {
+			u = &projectUsage{
+				ProjectID:         projectID,
+				Dates:             make(map[string]int64),
+				Datasets:          make(map[string]int64),
+				DatasetClasses:    make(map[string]map[string]int64),
+				DatasetLatest:     make(map[string]int64),
+				DatasetLatestDate: make(map[string]string),
+			}
+			byProject[projectID] = u
+		}
+		u.Total += attrs.Size
+		u.Dates[parts[1]] += attrs.Size
+		if len(parts) > 3 {
+			datasetID := parsePathSegment(parts[2])
+			u.Datasets[datasetID] += attrs.Size
+
+			class := attrs.StorageClass
+			if class == "" {
+				class = defaultClass
+			}
+			if u.DatasetClasses[datasetID] == nil {
+				u.DatasetClasses[datasetID] = make(map[string]int64)
+			}
+			u.DatasetClasses[datasetID][class] += attrs.Size
+
+			if parts[1] > u.DatasetLatestDate[datasetID] {
+				u.DatasetLatestDate[datasetID] = parts[1]
+				u.DatasetLatest[datasetID] = 0
+			}
+			if parts[1] == u.DatasetLatestDate[datasetID] {
+				u.DatasetLatest[datasetID] += attrs.Size
+			}
+		}
+	}
+
+	usage := make([]*projectUsage, 0, len(byProject))
+	for _, u := range byProject {
+		usage = append(usage, u)
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].ProjectID < usage[j].ProjectID })
+	return usage, nil
+}
+
+// growthPerDay is the average daily change in backup size between the first
+// and the latest backup date.
+func (u *projectUsage) growthPerDay() float64 {
+	dates := sortedKeys(u.Dates)
+	if len(dates) < 2 {
+		return 0
+	}
+	first, _ := time.Parse("2006-01-02", dates[0])
+	last, _ := time.Parse("2006-01-02", dates[len(dates)-1])
+	days := last.Sub(first).Hours() / 24
+	return float64(u.Dates[dates[len(dates)-1]]-u.Dates[dates[0]]) / days
+}
+
+func formatProjectUsage(u *projectUsage, retentions []int) string {
+	dates := sortedKeys(u.Dates)
+	latest := u.Dates[dates[len(dates)-1]]
+	report := fmt.Sprintf("\nProject : %s\n", u.ProjectID)
+	report += fmt.Sprintf("* %s across %d backups (%s to %s)\n", formatBytes(u.Total), len(dates), dates[0], dates[len(dates)-1])
+	report += fmt.Sprintf("* latest backup %s, growth %s/day\n", formatBytes(latest), formatBytes(int64(u.growthPerDay())))
+
+	report += "* by dataset:\n"
+	datasets := sortedKeys(u.Datasets)
+	sort.SliceStable(datasets, func(i, j int) bool { return u.Datasets[datasets[i]] > u.Datasets[datasets[j]] })
+	for _, datasetID := range datasets {
+		report += fmt.Sprintf("  %s: %s\n", datasetID, formatBytes(u.Datasets[datasetID]))
+	}
+
+	report += "* by date:\n"
+	for i := len(dates) - 1; i >= 0; i-- {
+		report += fmt.Sprintf("  %s: %s\n", dates[i], formatBytes(u.Dates[dates[i]]))
+	}
+
+	// Project the steady-state footprint as retention days times the
+	// latest backup size.
+	report += "* projected footprint by retention:\n"
+	for _, days := range retentions {
+		projected := latest * int64(days)
+		report += fmt.Sprintf("  %d days: %s (%+.0f%% vs now)\n", days, formatBytes(projected), percentChange(u.Total, projected))
+	}
+	return report
+}
+
+func percentChange(from, to int64) float64 {
+	if from == 0 {
+		return 0
+	}
+	return float64(to-from) / float64(from) * 100
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit && n > -unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, exp := float64(n), 0
+	for value >= unit*unit || value <= -unit*unit {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", value/unit, "KMGTPE"[exp])
+}
@@ -0,0 +1,144 @@
+package bqbackup
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/cloudkms/v1"
+)
+
+// runVerify checks a backup against its manifest: the manifest's KMS
+// signature, made with the trusted --kms-key, and that every table's exported
+// files are still there with the recorded size. It exits with status 1 on any
+// mismatch.
+func runVerify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	bucketName := fs.String("bucket", "", "GCS bucket name")
+	projectID := fs.String("project", "", "Project ID the backup was taken from")
+	date := fs.String("date", "", "Backup date (YYYY-MM-DD)")
+	keyVersion := fs.String("kms-key", "", "Cloud KMS key version the manifest must be signed with; required to verify signed manifests")
+	fs.Parse(args)
+
+	if *bucketName == "" || *projectID == "" || *date == "" {
+		fmt.Println("Usage: bq-backup verify --bucket=BUCKET_NAME --project=PROJECT_ID --date=YYYY-MM-DD [--kms-key=KEY_VERSION]")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	storageClient, err := storage.NewClient(ctx)
+	if err != nil {
+		fmt.Printf("Failed to create Storage client: %v\n", err)
+		os.Exit(1)
+	}
+	defer storageClient.Close()
+
+	name := manifestPath(*projectID, *date, "")
+	data, err := gcsStore{storageClient}.Read(ctx, *bucketName, name)
+	if err != nil {
+		fmt.Printf("Failed to read manifest gs://%s/%s: %v\n", *bucketName, name, err)
+		os.Exit(1)
+	}
+	manifest, err := parseManifest(data)
+	if err != nil {
+		fmt.Printf("Failed to parse manifest: %v\n", err)
+		os.Exit(1)
+	}
+
+	var problems []string
+	// A manifest that records a signing key, or has a signature, must be
+	// signed with the trusted key: the key version in the signature file is
+	// whatever wrote it.
+	signed := *keyVersion != "" || manifest.Provenance != nil && manifest.Provenance.SigningKey != ""
+	if !signed {
+		if _, err := storageClient.Bucket(*bucketName).Object(name + signatureSuffix).Attrs(ctx); !errors.Is(err, storage.ErrObjectNotExist) {
+			signed = true
+		}
+	}
+	switch {
+	case !signed:
+		fmt.Println("Warning: manifest is not signed")
+	case *keyVersion == "":
+		problems = append(problems, "signature: the manifest is signed, pass the trusted key version with --kms-key to verify it")
+	default:
+		if err := verifyManifestSignature(ctx, storageClient, *bucketName, name, data, *keyVersion); err != nil {
+			problems = append(problems, fmt.Sprintf("signature: %v", err))
+		} else {
+			fmt.Printf("%s Manifest signature valid\n", statusSuccess)
+		}
+	}
+
+	archives := make(map[string]map[string]*zip.File)
+	for _, t := range manifest.TableResults {
+		if t.Status != statusSuccess {
+			continue
+		}
+		objects, err := listObjects(ctx, gcsStore{storageClient}, *bucketName, backupPath(*projectID, *date, t.DatasetID, t.TableID)+"/")
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s.%s: failed to list files: %v", t.DatasetID, t.TableID, err))
+			continue
+		}
+		files := len(objects)
+		var size int64
+		for _, attrs := range objects {
+			size += attrs.Size
+		}
+		// Tiny tables may have been moved into their dataset's archive.
+		if files == 0 {
+			archive, ok := archives[t.DatasetID]
+			if !ok {
+				if index, err := readBundleIndex(ctx, storageClient, *bucketName, *projectID, *date, t.DatasetID); err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %v", t.DatasetID, err))
+				} else if len(index.Tables) > 0 {
+					if archive, err = openBundle(ctx, storageClient, *bucketName, *projectID, *date, t.DatasetID); err != nil {
+						problems = append(problems, fmt.Sprintf("%s: %v", t.DatasetID, err))
+					}
+				}
+				archives[t.DatasetID] = archive
+			}
+			tablePrefix := pathSegment(t.TableID) + "/"
+			for name, f := range archive {
+				if strings.HasPrefix(name, tablePrefix) {
+					files++
+					size += int64(f.UncompressedSize64)
+				}
+			}
+		}
+		if files != t.ExportedFiles || size != t.ExportedBytes {
+			problems = append(problems, fmt.Sprintf("%s.%s: %d files, %d bytes, manifest records %d files, %d bytes",
+				t.DatasetID, t.TableID, files, size, t.ExportedFiles, t.ExportedBytes))
+		}
+	}
+
+	if len(problems) > 0 {
+		fmt.Printf("%s Backup of %s on %s does not match its manifest:\n", statusFailed, *projectID, *date)
+		for _, problem := range problems {
+			fmt.Printf("* %s\n", problem)
+		}
+		os.Exit(1)
+	}
+	fmt.Printf("%s Backup of %s on %s matches its manifest (%d tables)\n", statusSuccess, *projectID, *date, manifest.Tables)
+}
+
+// verifyManifestSignature checks the signature written next to the manifest
+// against the public key of keyVersion. A missing signature is an error.
+func verifyManifestSignature(ctx context.Context, storageClient *storage.Client, bucketName, name string, data []byte, keyVersion string) error {
+	var sig manifestSignature
+	if err := readJSONObject(ctx, gcsStore{storageClient}, bucketName, name+signatureSuffix, &sig); err != nil {
+		return fmt.Errorf("failed to read %s%s: %w", name, signatureSuffix, err)
+	}
+	if sig.KMSKeyVersion != keyVersion {
+		return fmt.Errorf("signed with %s, expected %s", sig.KMSKeyVersion, keyVersion)
+	}
+
+	service, err := cloudkms.NewService(ctx)
+	if err != nil {
+		return err
+	}
+	return verifySignature(ctx, service, keyVersion, data, sig)
+}
@@ -0,0 +1,147 @@
+package bqbackup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// exitCodeRunTimeout is the exit status of a run stopped by --run-timeout.
+	exitCodeRunTimeout = 3
+	// watchdogFlushTimeout bounds the final report, in case whatever wedged
+	// the run also wedges the notifications.
+	watchdogFlushTimeout = time.Minute
+)
+
+// errRunTimedOut is the cause of the cancellation of a run the watchdog
+// ended.
+var errRunTimedOut = errors.New("run timed out")
+
+// watchdog cancels a run that is still going after its deadline, recording
+// and reporting the results of the projects in progress itself, so they don't
+// wait for the run to wind down. A nil *watchdog does nothing.
+type watchdog struct {
+	run     *backupRun
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelCauseFunc
+	// fired is closed once the watchdog has fired and reported.
+	fired chan struct{}
+
+	mu     sync.Mutex
+	active map[*reporter]*watchedProject
+}
+
+// watchedProject is a project in progress. entry is its catalog entry
+// without its tables, until recorded is set once an entry of the project is
+// in the catalog.
+type watchedProject struct {
+	entry    catalogEntry
+	recorded bool
+}
+
+func startWatchdog(b *backupRun, timeout time.Duration, cancel context.CancelCauseFunc) *watchdog {
+	w := &watchdog{run: b, timeout: timeout, cancel: cancel, fired: make(chan struct{}), active: make(map[*reporter]*watchedProject)}
+	w.timer = time.AfterFunc(timeout, w.fire)
+	return w
+}
+
+// watch registers the reporter of a project in progress, whose catalog
+// entry so far is entry.
+func (w *watchdog) watch(entry catalogEntry, rep *reporter) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.active[rep] = &watchedProject{entry: entry}
+}
+
+// claim reports whether the catalog entry of a watched project is still to
+// be recorded, which it no longer is once the watchdog fired and recorded the
+// project as timed out.
+func (w *watchdog) claim(rep *reporter) bool {
+	if w == nil {
+		return true
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if p, ok := w.active[rep]; ok {
+		if p.recorded {
+			return false
+		}
+		p.recorded = true
+	}
+	return true
+}
+
+// done unregisters a project's reporter once its own report has been sent.
+func (w *watchdog) done(rep *reporter) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.active, rep)
+}
+
+// stop stops the watchdog, waiting for its report if it already fired.
+func (w *watchdog) stop() {
+	if w == nil {
+		return
+	}
+	if !w.timer.Stop() {
+		<-w.fired
+	}
+	w.cancel(nil)
+}
+
+// timedOut reports whether the run of ctx was ended by a watchdog.
+func timedOut(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errRunTimedOut)
+}
+
+func (w *watchdog) fire() {
+	defer close(w.fired)
+	fmt.Printf("Run still going after --run-timeout of %s, reporting what is done and cancelling it\n", w.timeout)
+	w.mu.Lock()
+	active := make(map[*reporter]*watchedProject, len(w.active))
+	for rep, p := range w.active {
+		if !p.recorded {
+			active[rep] = &watchedProject{entry: p.entry}
+			p.recorded = true
+		}
+	}
+	w.mu.Unlock()
+	w.run.state.finish(runStateTimedOut)
+	w.cancel(errRunTimedOut)
+
+	ctx, cancel := context.WithTimeout(context.Background(), watchdogFlushTimeout)
+	defer cancel()
+	flushed := make(chan struct{})
+	go func() {
+		defer close(flushed)
+		for rep, p := range active {
+			partial := rep.snapshot()
+			projectID := p.entry.ProjectID
+			fmt.Printf("Project %s timed out after %d tables (%d failed)\n", projectID, len(partial.results), countFailed(catalogEntry{Tables: partial.results}))
+			entry := p.entry
+			entry.Finished, entry.Tables, entry.TimedOut = time.Now(), partial.results, true
+			if err := appendCatalogEntry(w.run.stateDir, entry); err != nil {
+				fmt.Printf("Failed to write catalog entry: %v\n", err)
+			}
+			partial.note = fmt.Sprintf("Run timed out after %s, the remaining tables were not backed up", w.timeout)
+			partial.sendNotifications(ctx, projectID)
+		}
+		w.run.runPendingPostRunHooks(ctx, "the run timed out")
+	}()
+
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		fmt.Println("Timed out sending the final report")
+	}
+}
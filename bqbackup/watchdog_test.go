@@ -0,0 +1,34 @@
+package bqbackup
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWatchdogCancelsRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		timeout   time.Duration
+		wantState string
+	}{
+		{"timed out", time.Millisecond, runStateTimedOut},
+		{"finished in time", time.Hour, runStateFinished},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestRun(t, Options{Projects: []string{"p"}, Bucket: "b", FakeBackend: true})
+			ctx := b.open(context.Background(), tt.timeout)
+			if tt.wantState == runStateTimedOut {
+				<-ctx.Done()
+			}
+			b.close()
+			if got := timedOut(ctx); got != (tt.wantState == runStateTimedOut) {
+				t.Errorf("timedOut() = %t", got)
+			}
+			if got := b.state.snapshot().State; got != tt.wantState {
+				t.Errorf("state = %s, want %s", got, tt.wantState)
+			}
+		})
+	}
+}
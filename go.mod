@@ -1,11 +1,14 @@
-module bq
+module github.com/bayra1n/bq-backup
 
 go 1.22.3
 
 require (
 	cloud.google.com/go/bigquery v1.61.0
+	cloud.google.com/go/compute/metadata v0.3.0
 	cloud.google.com/go/storage v1.42.0
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/schollz/progressbar/v3 v3.14.4
+	golang.org/x/oauth2 v0.21.0
 	google.golang.org/api v0.187.0
 )
 
@@ -13,7 +16,6 @@ require (
 	cloud.google.com/go v0.115.0 // indirect
 	cloud.google.com/go/auth v0.6.1 // indirect
 	cloud.google.com/go/auth/oauth2adapt v0.2.2 // indirect
-	cloud.google.com/go/compute/metadata v0.3.0 // indirect
 	cloud.google.com/go/iam v1.1.8 // indirect
 	github.com/apache/arrow/go/v15 v15.0.2 // indirect
 	github.com/felixge/httpsnoop v1.0.4 // indirect
@@ -43,7 +45,6 @@ require (
 	golang.org/x/exp v0.0.0-20231006140011-7918f672742d // indirect
 	golang.org/x/mod v0.17.0 // indirect
 	golang.org/x/net v0.26.0 // indirect
-	golang.org/x/oauth2 v0.21.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
 	golang.org/x/sys v0.21.0 // indirect
 	golang.org/x/term v0.21.0 // indirect